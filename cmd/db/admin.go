@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+type ImportBody struct {
+	Imported int `json:"imported"`
+}
+
+var contentTypes = map[datastore.Format]string{
+	datastore.NDJSON: "application/x-ndjson",
+	datastore.CSV:    "text/csv",
+}
+
+// handleAdmin serves
+//
+//	GET  /admin/export?format=ndjson|csv  stream all keys
+//	POST /admin/import?format=ndjson|csv  write the keys of an export
+//	GET  /admin/scrub                     scrubber stats and damaged ranges
+//	POST /admin/scrub                     run a scrub pass, then the stats
+//	GET  /admin/audit?key=&since=         audit entries, since is RFC 3339
+//
+// ndjson is the default format.
+func handleAdmin(h *http.ServeMux, db *datastore.Db, trail *auditor) {
+	h.HandleFunc("/admin/export", func(rw http.ResponseWriter, req *http.Request) {
+		format, err := datastore.ParseFormat(req.URL.Query().Get("format"))
+		if req.Method != "GET" || err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("content-type", contentTypes[format])
+		rw.WriteHeader(http.StatusOK)
+		// The status is sent already, a failure cuts the export short.
+		if err := db.Export(rw, format); err != nil {
+			log.Printf("export: %s", err)
+		}
+	})
+	h.HandleFunc("/admin/import", func(rw http.ResponseWriter, req *http.Request) {
+		format, err := datastore.ParseFormat(req.URL.Query().Get("format"))
+		if req.Method != "POST" || err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n, err := db.ImportFunc(req.Body, format, func(bucket, key, typ string) error {
+			return trail.imported(req, bucket, key, typ)
+		})
+		if errors.Is(err, datastore.ErrBadImport) {
+			writeJSON(rw, http.StatusBadRequest, ImportBody{Imported: n})
+			return
+		} else if err != nil {
+			rw.WriteHeader(statusFor(err))
+			return
+		}
+		writeJSON(rw, http.StatusOK, ImportBody{Imported: n})
+	})
+	h.HandleFunc("/admin/scrub", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+		case "POST":
+			if err := db.Scrub(); err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stats, err := db.ScrubStats()
+		if err != nil {
+			rw.WriteHeader(statusFor(err))
+			return
+		}
+		writeJSON(rw, http.StatusOK, stats)
+	})
+	h.HandleFunc("/admin/audit", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var since time.Time
+		if s := req.URL.Query().Get("since"); s != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := db.AuditTrail(req.URL.Query().Get("key"), since)
+		if err != nil {
+			rw.WriteHeader(statusFor(err))
+			return
+		}
+		if entries == nil {
+			entries = []datastore.AuditEntry{}
+		}
+		writeJSON(rw, http.StatusOK, entries)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// auditor records the changes made through the service in the audit log of
+// the Db. The key of an entry is the key as /db/ addresses it, <bucket>/* for
+// a dropped bucket, and the request path for blobs and locks, which have keys
+// of their own. The service does not check credentials: the client is the
+// name the request gives, the basic auth user name or else the header, and
+// is recorded as such along with the remote address.
+type auditor struct {
+	db     *datastore.Db
+	header string
+}
+
+// client returns the name req gives for its client, empty when there is none.
+func (a *auditor) client(req *http.Request) string {
+	if user, _, ok := req.BasicAuth(); ok {
+		return user
+	}
+	return req.Header.Get(a.header)
+}
+
+// change runs mutate, the change of key in s made by req, and records it once
+// it succeeded under path, the key as addressed in the URL. The change is
+// reported failed when it cannot be recorded. The versions are read around
+// the change, so a concurrent change of the same key may show in either
+// entry; without a store there are none. A nil auditor only runs mutate.
+func (a *auditor) change(req *http.Request, s store, key, path string, mutate func() error) error {
+	if a == nil {
+		return mutate()
+	}
+	e := datastore.AuditEntry{
+		Method: req.Method,
+		Key:    path,
+	}
+	if s != nil {
+		e.OldVersion, _ = s.LatestVersion(key)
+	}
+	if err := mutate(); err != nil {
+		return err
+	}
+	if s != nil {
+		e.NewVersion, _ = s.LatestVersion(key)
+	}
+	return a.record(req, e)
+}
+
+// imported records a key written by an import, fn of Db.ImportFunc.
+func (a *auditor) imported(req *http.Request, bucket, key, typ string) error {
+	if a == nil {
+		return nil
+	}
+	path := key
+	switch {
+	case typ == "blob":
+		path = "/blobs/" + key
+	case bucket != "":
+		path = bucket + "/" + key
+	}
+	return a.record(req, datastore.AuditEntry{Method: req.Method, Key: path})
+}
+
+func (a *auditor) record(req *http.Request, e datastore.AuditEntry) error {
+	e.Client, e.Remote = a.client(req), req.RemoteAddr
+	if err := a.db.Audit(e); err != nil {
+		return fmt.Errorf("audit %s %s: %w", req.Method, e.Key, err)
+	}
+	return nil
+}
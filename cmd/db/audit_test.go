@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestAuditor(t *testing.T) {
+	fs := datastore.NewFaultFS(1)
+	db, err := datastore.NewDbWithOptions("/db", 250, datastore.Options{FS: fs, AuditLog: true, KeepVersions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := &auditor{db: db, header: "X-Client-Id"}
+
+	req := httptest.NewRequest("POST", "/db/k", nil)
+	req.Header.Set("X-Client-Id", "svc-1")
+	for _, v := range []string{"v1", "v2"} {
+		v := v
+		if err := a.change(req, db, "k", "k", func() error { return db.Put("k", v) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req = httptest.NewRequest("DELETE", "/db/k", nil)
+	req.SetBasicAuth("bob", "secret")
+	req.Header.Set("X-Client-Id", "svc-1")
+	if err := a.change(req, db, "k", "k", func() error { return db.Delete("k") }); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.AuditTrail("k", time.Time{})
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %+v (%v)", entries, err)
+	}
+	if e := entries[0]; e.Client != "svc-1" || e.Remote != req.RemoteAddr || e.Method != "POST" || e.OldVersion != 0 || e.NewVersion == 0 {
+		t.Errorf("Bad first entry %+v", e)
+	}
+	if e := entries[1]; e.OldVersion != entries[0].NewVersion || e.NewVersion <= e.OldVersion {
+		t.Errorf("Bad versions of the second entry %+v", e)
+	}
+	if e := entries[2]; e.Client != "bob" || e.Method != "DELETE" {
+		t.Errorf("Expected the user over the header, got %+v", e)
+	}
+
+	unaudited, err := datastore.NewDbWithOptions("/unaudited", 250, datastore.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unaudited.Close()
+	a = &auditor{db: unaudited, header: "X-Client-Id"}
+	if err := a.change(req, unaudited, "k", "k", func() error { return unaudited.Put("k", "v") }); !errors.Is(err, datastore.ErrNoAudit) {
+		t.Errorf("Expected the change to fail when it cannot be recorded, got %v", err)
+	}
+}
+
+func TestAuditor_Handlers(t *testing.T) {
+	db, err := datastore.NewDbWithOptions("/db", 250, datastore.Options{FS: datastore.NewFaultFS(1), AuditLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	trail := &auditor{db: db, header: "X-Client-Id"}
+	locks := newLockManager(db)
+	h := new(http.ServeMux)
+	handleCollections(h, db, trail)
+	handleSeries(h, db, trail)
+	handleBlobs(h, db, trail)
+	handleAdmin(h, db, trail)
+	handleQueues(h, db, datastore.QueueOptions{}, trail)
+	handleLocks(h, locks, trail)
+
+	for _, r := range []struct{ method, path, body string }{
+		{"POST", "/lists/l/lpush", `{"values": ["a"]}`},
+		{"POST", "/hashes/h/f", `{"value": "v"}`},
+		{"POST", "/sets/s", `{"members": ["m"]}`},
+		{"POST", "/queues/q", `{"value": "job"}`},
+		{"POST", "/series/ts", `{"points": [{"time": "2024-01-01T00:00:00Z", "value": 1}]}`},
+		{"PUT", "/blobs/b", "data"},
+		{"POST", "/locks/cron", `{"owner": "w", "ttl": "10s"}`},
+		{"POST", "/admin/import", `{"bucket":"t","key":"k","type":"string","value":"v"}` + "\n"},
+		// Failed changes are not recorded.
+		{"POST", "/locks/cron", `{"owner": "w", "ttl": "10s"}`},
+		{"POST", "/lists/h/lpush", `{"values": ["a"]}`},
+	} {
+		req := httptest.NewRequest(r.method, r.path, strings.NewReader(r.body))
+		req.Header.Set("X-Client-Id", "svc-1")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries, err := db.AuditTrail("", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range entries {
+		if e.Client != "svc-1" {
+			t.Errorf("Bad client of %+v", e)
+		}
+		keys = append(keys, e.Key)
+	}
+	if got, want := strings.Join(keys, " "), "l h s q ts /blobs/b /locks/cron t/k"; got != want {
+		t.Errorf("Expected entries of %s, got %s", want, got)
+	}
+}
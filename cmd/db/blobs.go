@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+type SizeBody struct {
+	Size int64 `json:"size"`
+}
+
+// handleBlobs serves
+//
+//	PUT    /blobs/<key>  store the request body
+//	GET    /blobs/<key>  stream the blob
+//	DELETE /blobs/<key>
+//
+// Bodies are streamed, blobs are never loaded into memory as a whole.
+func handleBlobs(h *http.ServeMux, db *datastore.Db, trail *auditor) {
+	h.HandleFunc("/blobs/", func(rw http.ResponseWriter, req *http.Request) {
+		key := strings.TrimPrefix(req.URL.Path, "/blobs/")
+		if key == "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.Method {
+		case "PUT":
+			var n int64
+			err := trail.change(req, nil, key, req.URL.Path, func() (err error) {
+				n, err = db.PutBlob(key, req.Body)
+				return err
+			})
+			if err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+			writeJSON(rw, http.StatusCreated, SizeBody{Size: n})
+		case "GET":
+			r, err := db.GetBlob(key)
+			if err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+			defer r.Close()
+			rw.Header().Set("content-type", "application/octet-stream")
+			rw.WriteHeader(http.StatusOK)
+			if _, err := io.Copy(rw, r); err != nil {
+				log.Printf("blob %q: %s", key, err)
+			}
+		case "DELETE":
+			err := trail.change(req, nil, key, req.URL.Path, func() error {
+				return db.DeleteBlob(key)
+			})
+			if err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+type ValuesBody struct {
+	Values []string `json:"values"`
+}
+
+type MembersBody struct {
+	Members []string `json:"members"`
+}
+
+type CountBody struct {
+	Count int `json:"count"`
+}
+
+type MemberBody struct {
+	Member bool `json:"member"`
+}
+
+func writeJSON(rw http.ResponseWriter, status int, body interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+func collectionStatus(err error) int {
+	if errors.Is(err, datastore.ErrWrongType) {
+		return http.StatusConflict
+	}
+	return statusFor(err)
+}
+
+// handleCollections serves
+//
+//	GET  /lists/<key>?start=&stop=  LRANGE
+//	POST /lists/<key>/lpush         LPUSH {"values": [...]}
+//	POST /lists/<key>/rpop          RPOP
+//	GET  /hashes/<key>              HGETALL
+//	GET  /hashes/<key>/<field>      HGET
+//	POST /hashes/<key>/<field>      HSET {"value": ...}
+//	GET  /sets/<key>                SMEMBERS
+//	GET  /sets/<key>/<member>       SISMEMBER
+//	POST /sets/<key>                SADD {"members": [...]}
+func handleCollections(h *http.ServeMux, db *datastore.Db, trail *auditor) {
+	h.HandleFunc("/lists/", func(rw http.ResponseWriter, req *http.Request) {
+		key, op, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/lists/"), "/")
+		switch {
+		case req.Method == "GET" && op == "":
+			start, stop := 0, -1
+			var err error
+			if v := req.URL.Query().Get("start"); v != "" {
+				if start, err = strconv.Atoi(v); err != nil {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			if v := req.URL.Query().Get("stop"); v != "" {
+				if stop, err = strconv.Atoi(v); err != nil {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			values, err := db.LRange(key, start, stop)
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, ValuesBody{Values: values})
+		case req.Method == "POST" && op == "lpush":
+			var body ValuesBody
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var n int
+			err := trail.change(req, db, key, key, func() (err error) {
+				n, err = db.LPush(key, body.Values...)
+				return err
+			})
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, CountBody{Count: n})
+		case req.Method == "POST" && op == "rpop":
+			var value string
+			err := trail.change(req, db, key, key, func() (err error) {
+				value, err = db.RPop(key)
+				return err
+			})
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, RespBody{Key: key, Value: value})
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	h.HandleFunc("/hashes/", func(rw http.ResponseWriter, req *http.Request) {
+		key, field, hasField := strings.Cut(strings.TrimPrefix(req.URL.Path, "/hashes/"), "/")
+		switch {
+		case req.Method == "GET" && !hasField:
+			fields, err := db.HGetAll(key)
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			if fields == nil {
+				fields = map[string]string{}
+			}
+			writeJSON(rw, http.StatusOK, fields)
+		case req.Method == "GET":
+			value, err := db.HGet(key, field)
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, RespBody{Key: field, Value: value})
+		case req.Method == "POST" && hasField:
+			var body ReqBody
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := trail.change(req, db, key, key, func() error {
+				return db.HSet(key, field, body.Value)
+			})
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			rw.WriteHeader(http.StatusCreated)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	h.HandleFunc("/sets/", func(rw http.ResponseWriter, req *http.Request) {
+		key, member, hasMember := strings.Cut(strings.TrimPrefix(req.URL.Path, "/sets/"), "/")
+		switch {
+		case req.Method == "GET" && !hasMember:
+			members, err := db.SMembers(key)
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, MembersBody{Members: members})
+		case req.Method == "GET":
+			ok, err := db.SIsMember(key, member)
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, MemberBody{Member: ok})
+		case req.Method == "POST" && !hasMember:
+			var body MembersBody
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var n int
+			err := trail.change(req, db, key, key, func() (err error) {
+				n, err = db.SAdd(key, body.Members...)
+				return err
+			})
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, CountBody{Count: n})
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
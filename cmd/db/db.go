@@ -1,18 +1,53 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/roman-mazur/design-practice-2-template/datastore"
 	"github.com/roman-mazur/design-practice-2-template/httptools"
 	"github.com/roman-mazur/design-practice-2-template/signal"
 )
 
-var port = flag.Int("port", 8083, "server port")
+var (
+	port       = flag.Int("port", 8083, "server port")
+	dataDir    = flag.String("dir", "", "directory of the database files, a new temporary one when empty")
+	timeoutSec = flag.Int("timeout-sec", 3, "datastore operation timeout in seconds")
+	cacheSize  = flag.Int64("cache-size", 0, "size of the value cache in bytes, 0 disables it")
+	versions   = flag.Int("keep-versions", 0, "number of versions of every key to retain")
+	mergeOp    = flag.String("merge-operator", "", "operator folding PATCH operands: add, append or json-patch")
+	visibility = flag.Duration("queue-visibility", 30*time.Second, "how long a dequeued message is hidden from other consumers")
+	deliveries = flag.Int("queue-max-deliveries", 5, "deliveries after which a message is dead-lettered, 0 for no limit")
+	reapEvery  = flag.Duration("lock-reap-interval", time.Second, "how often expired lock leases are deleted")
+	compress   = flag.Bool("compress", false, "store values deflated when that makes them smaller")
+	scrubEvery = flag.Duration("scrub-interval", 0, "how often sealed segments are verified in the background, 0 disables it")
+	audit      = flag.Bool("audit", false, "record the changes of keys in the audit log")
+	auditID    = flag.String("audit-header", "X-Client-Id", "request header naming the client in the audit log of requests without basic auth")
+	auditSize  = flag.Int64("audit-file-size", 0, "size at which a new audit log file is started, 16MB when 0")
+	auditAge   = flag.Duration("audit-file-age", 24*time.Hour, "age at which a new audit log file is started, 0 for no limit")
+	maxBytes   = flag.Int64("max-bytes", 0, "budget of plain values in bytes, their keys are evicted past it; 0 for no limit")
+	eviction   = flag.String("eviction", "lru", "order keys are evicted in past -max-bytes: lru or lfu")
+	keyFile    = flag.String("key-file", "", "file of id:hex AES-256 keys encrypting the data at rest, the highest id is active; "+keysEnv+" can list them instead")
+)
+
+// keysEnv holds the encryption keys in the key file format when there is no
+// key file.
+const keysEnv = "DB_ENCRYPTION_KEYS"
+
+var mergeOperators = map[string]datastore.MergeOperator{
+	"add":        datastore.Int64Add{},
+	"append":     datastore.StringAppend{},
+	"json-patch": datastore.JSONMergePatch{},
+}
 
 type RespBody struct {
 	Key   string `json:"key"`
@@ -23,24 +58,151 @@ type ReqBody struct {
 	Value string `json:"value"`
 }
 
+type BucketBody struct {
+	Name  string `json:"name"`
+	Keys  int    `json:"keys"`
+	Bytes int64  `json:"bytes"`
+}
+
+type EvictionBody struct {
+	Policy       string `json:"policy"`
+	Keys         int    `json:"keys"`
+	Bytes        int64  `json:"bytes"`
+	MaxBytes     int64  `json:"maxBytes"`
+	Evictions    uint64 `json:"evictions"`
+	EvictedBytes int64  `json:"evictedBytes"`
+}
+
+type CompressionBody struct {
+	Records     int     `json:"records"`
+	Compressed  int     `json:"compressed"`
+	RawBytes    int64   `json:"rawBytes"`
+	StoredBytes int64   `json:"storedBytes"`
+	Ratio       float64 `json:"ratio"`
+}
+
+// store is implemented by the Db itself (the default bucket) and by its
+// buckets.
+type store interface {
+	GetCtx(ctx context.Context, key string) (string, error)
+	GetAt(key string, version uint64) (string, error)
+	LatestVersion(key string) (uint64, error)
+	PutCtx(ctx context.Context, key, value string) error
+	DeleteCtx(ctx context.Context, key string) error
+	DeletePrefix(prefix string) error
+	Merge(key, operand string) error
+}
+
+// statusFor maps datastore errors to responses: a store that does not answer
+// in time is reported as unavailable instead of holding the connection.
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound), errors.Is(err, datastore.ErrBucketDropped):
+		return http.StatusNotFound
+	case errors.Is(err, datastore.ErrNotVersioned), errors.Is(err, datastore.ErrNoMergeOperator),
+		errors.Is(err, datastore.ErrNoAudit):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, datastore.ErrClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func main() {
+	flag.Parse()
 	h := new(http.ServeMux)
-	dir, err := ioutil.TempDir("", "temp-dir")
+	dir := *dataDir
+	if dir == "" {
+		tmp, err := ioutil.TempDir("", "temp-dir")
+		if err != nil {
+			log.Fatal(err)
+		}
+		dir = tmp
+	}
+	var err error
+	op, ok := mergeOperators[*mergeOp]
+	if !ok && *mergeOp != "" {
+		log.Fatalf("unknown merge operator %q", *mergeOp)
+	}
+	var keyring *datastore.Keyring
+	if *keyFile != "" {
+		keyring, err = datastore.LoadKeyring(*keyFile)
+	} else if keys := os.Getenv(keysEnv); keys != "" {
+		keyring, err = datastore.ParseKeyring(keys)
+	}
+	if err != nil {
+		log.Fatalf("encryption keys: %s", err)
+	}
+	policy, err := datastore.ParseEvictionPolicy(*eviction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Db, err := datastore.NewDbWithOptions(dir, 250, datastore.Options{
+		CacheSize:     *cacheSize,
+		KeepVersions:  *versions,
+		MergeOperator: op,
+		Keyring:       keyring,
+		Compression:   *compress,
+		ScrubInterval: *scrubEvery,
+		AuditLog:      *audit,
+		AuditFileSize: *auditSize,
+		AuditFileAge:  *auditAge,
+		MaxBytes:      *maxBytes,
+		Eviction:      policy,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	Db, err := datastore.NewDb(dir, 250)
 	defer Db.Close()
+	var trail *auditor
+	if *audit {
+		trail = &auditor{db: Db, header: *auditID}
+	}
 
 	h.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
-		url := req.URL.String()
-		key := url[4:]
+		// Keys of the default bucket are addressed as /db/<key>, the keys of
+		// other buckets as /db/<bucket>/<key>. DELETE /db/?prefix=<prefix>
+		// deletes all the keys starting with it, /db/<bucket>/?prefix= the
+		// ones of a bucket.
+		var store store = Db
+		key := strings.TrimPrefix(req.URL.Path, "/db/")
+		path := key
+		if name, rest, ok := strings.Cut(key, "/"); ok {
+			lookup := Db.LookupBucket
+			if req.Method == "POST" || req.Method == "PATCH" {
+				lookup = Db.Bucket
+			}
+			b, err := lookup(name)
+			if err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+			store, key = b, rest
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), time.Duration(*timeoutSec)*time.Second)
+		defer cancel()
 
 		switch req.Method {
 		case "GET":
-			value, err := Db.Get(key)
+			var (
+				value string
+				err   error
+			)
+			if v := req.URL.Query().Get("version"); v != "" {
+				version, perr := strconv.ParseUint(v, 10, 64)
+				if perr != nil {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				value, err = store.GetAt(key, version)
+			} else {
+				value, err = store.GetCtx(ctx, key)
+			}
 			if err != nil {
-				rw.WriteHeader(http.StatusNotFound)
+				rw.WriteHeader(statusFor(err))
 				return
 			}
 			rw.WriteHeader(http.StatusOK)
@@ -51,23 +213,140 @@ func main() {
 			})
 		case "POST":
 			var body ReqBody
-
-			err := json.NewDecoder(req.Body).Decode(&body)
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := trail.change(req, store, key, path, func() error {
+				return store.PutCtx(ctx, key, body.Value)
+			})
 			if err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+			rw.WriteHeader(http.StatusCreated)
+		case "PATCH":
+			var body ReqBody
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
 				rw.WriteHeader(http.StatusBadRequest)
+				return
 			}
+			err := trail.change(req, store, key, path, func() error {
+				return store.Merge(key, body.Value)
+			})
+			if err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		case "DELETE":
+			var err error
+			if prefix := req.URL.Query().Get("prefix"); key == "" && prefix != "" {
+				err = trail.change(req, nil, prefix, path+prefix+"*", func() error {
+					return store.DeletePrefix(prefix)
+				})
+			} else if key == "" {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			} else {
+				err = trail.change(req, store, key, path, func() error {
+					return store.DeleteCtx(ctx, key)
+				})
+			}
+			if err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	})
 
-			err = Db.Put(key, body.Value)
+	h.HandleFunc("/buckets/", func(rw http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(req.URL.Path, "/buckets/")
+		switch req.Method {
+		case "GET":
+			b, err := Db.LookupBucket(name)
 			if err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
+				rw.WriteHeader(statusFor(err))
 				return
 			}
-			rw.WriteHeader(http.StatusCreated)
+			stats, err := b.Stats()
+			if err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+			rw.Header().Set("content-type", "application/json")
+			rw.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(rw).Encode(BucketBody{
+				Name:  name,
+				Keys:  stats.Keys,
+				Bytes: stats.Bytes,
+			})
+		case "DELETE":
+			err := trail.change(req, nil, name, name+"/*", func() error {
+				return Db.DropBucket(name)
+			})
+			if err != nil {
+				rw.WriteHeader(statusFor(err))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
 		default:
 			rw.WriteHeader(http.StatusBadRequest)
 		}
 	})
 
+	h.HandleFunc("/compression", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stats, err := Db.CompressionStats()
+		if err != nil {
+			rw.WriteHeader(statusFor(err))
+			return
+		}
+		writeJSON(rw, http.StatusOK, CompressionBody{
+			Records:     stats.Records,
+			Compressed:  stats.Compressed,
+			RawBytes:    stats.RawBytes,
+			StoredBytes: stats.StoredBytes,
+			Ratio:       stats.Ratio(),
+		})
+	})
+
+	h.HandleFunc("/eviction", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		stats := Db.EvictionStats()
+		writeJSON(rw, http.StatusOK, EvictionBody{
+			Policy:       stats.Policy.String(),
+			Keys:         stats.Keys,
+			Bytes:        stats.Bytes,
+			MaxBytes:     stats.MaxBytes,
+			Evictions:    stats.Evictions,
+			EvictedBytes: stats.EvictedBytes,
+		})
+	})
+
+	handleCollections(h, Db, trail)
+	handleSeries(h, Db, trail)
+	handleBlobs(h, Db, trail)
+	handleIndexes(h, Db, trail)
+	handleAdmin(h, Db, trail)
+	handleQueues(h, Db, datastore.QueueOptions{
+		VisibilityTimeout: *visibility,
+		MaxDeliveries:     *deliveries,
+	}, trail)
+
+	locks := newLockManager(Db)
+	go locks.reaper(*reapEvery)
+	handleLocks(h, locks, trail)
+
 	server := httptools.CreateServer(*port, h)
 	server.Start()
 	signal.WaitForTerminationSignal()
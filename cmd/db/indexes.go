@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+type KeysBody struct {
+	Keys []string `json:"keys"`
+}
+
+type IndexBody struct {
+	Path string `json:"path"`
+}
+
+func indexStatus(err error) int {
+	switch {
+	case errors.Is(err, datastore.ErrNoIndex):
+		return http.StatusNotFound
+	case errors.Is(err, datastore.ErrIndexExists):
+		return http.StatusConflict
+	default:
+		return statusFor(err)
+	}
+}
+
+// handleIndexes serves
+//
+//	GET    /db/_index/<name>?eq=<value>  {"keys": [...]}
+//	POST   /db/_index/<name>             create {"path": "$.field"}
+//	DELETE /db/_index/<name>
+//
+// The pattern is more specific than /db/, so it takes precedence over the
+// bucket routing.
+func handleIndexes(h *http.ServeMux, db *datastore.Db, trail *auditor) {
+	h.HandleFunc("/db/_index/", func(rw http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(req.URL.Path, "/db/_index/")
+		if name == "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.Method {
+		case "GET":
+			keys, err := db.QueryIndex(name, req.URL.Query().Get("eq"))
+			if err != nil {
+				rw.WriteHeader(indexStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, KeysBody{Keys: keys})
+		case "POST":
+			var body IndexBody
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Path == "" {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := trail.change(req, nil, name, "_index/"+name, func() error {
+				return db.CreateIndex(name, body.Path)
+			})
+			if err != nil {
+				rw.WriteHeader(indexStatus(err))
+				return
+			}
+			rw.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			err := trail.change(req, nil, name, "_index/"+name, func() error {
+				return db.DropIndex(name)
+			})
+			if err != nil {
+				rw.WriteHeader(indexStatus(err))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
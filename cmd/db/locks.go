@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// The leases are stored under leasePrefix and the fencing counter under
+// fencingCounter in the reserved lock bucket of the Db, out of reach of /db/
+// and /buckets/.
+const (
+	leasePrefix    = "lease/"
+	fencingCounter = "fencing/token"
+)
+
+var errLockHeld = errors.New("lock is held by someone else")
+
+// Lease is a lock held until Expires. Token is the fencing token of the
+// lease: tokens only grow, also across restarts, so a resource can reject
+// writes carrying the token of a lease that was taken over.
+type Lease struct {
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner,omitempty"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type LockBody struct {
+	Owner string `json:"owner"`
+	Token uint64 `json:"token"`
+	TTL   string `json:"ttl"`
+}
+
+// lockManager keeps the leases and the last fencing token handed out in the
+// lock bucket of the Db.
+type lockManager struct {
+	mu     sync.Mutex
+	bucket *datastore.Bucket
+	now    func() time.Time
+
+	// fencingMu guards the read and the increment of the counter.
+	fencingMu sync.Mutex
+}
+
+func newLockManager(db *datastore.Db) *lockManager {
+	return &lockManager{bucket: db.LockBucket(), now: time.Now}
+}
+
+// lease returns the live lease on name, nil when the lock is free.
+func (m *lockManager) lease(name string) (*Lease, error) {
+	value, err := m.bucket.Get(leasePrefix + name)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var l Lease
+	if err := json.Unmarshal([]byte(value), &l); err != nil {
+		return nil, fmt.Errorf("lease %s: %w", name, err)
+	}
+	if !m.now().Before(l.Expires) {
+		return nil, nil
+	}
+	return &l, nil
+}
+
+func (m *lockManager) store(l Lease) error {
+	value, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return m.bucket.Put(leasePrefix+l.Name, string(value))
+}
+
+// nextToken persists the new token before it is handed out.
+func (m *lockManager) nextToken() (uint64, error) {
+	m.fencingMu.Lock()
+	defer m.fencingMu.Unlock()
+	var token uint64
+	value, err := m.bucket.Get(fencingCounter)
+	if err == nil {
+		token, err = strconv.ParseUint(value, 10, 64)
+	} else if errors.Is(err, datastore.ErrNotFound) {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	token++
+	return token, m.bucket.Put(fencingCounter, strconv.FormatUint(token, 10))
+}
+
+// Acquire takes the lock for ttl. A lock held by someone else fails with
+// errLockHeld.
+func (m *lockManager) Acquire(name, owner string, ttl time.Duration) (Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, err := m.lease(name)
+	if err != nil {
+		return Lease{}, err
+	}
+	if current != nil {
+		return Lease{}, errLockHeld
+	}
+	token, err := m.nextToken()
+	if err != nil {
+		return Lease{}, err
+	}
+	l := Lease{Name: name, Owner: owner, Token: token, Expires: m.now().Add(ttl)}
+	return l, m.store(l)
+}
+
+// Renew extends the lease with the given token by ttl from now.
+func (m *lockManager) Renew(name string, token uint64, ttl time.Duration) (Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, err := m.lease(name)
+	if err != nil {
+		return Lease{}, err
+	}
+	if current == nil || current.Token != token {
+		return Lease{}, errLockHeld
+	}
+	current.Expires = m.now().Add(ttl)
+	return *current, m.store(*current)
+}
+
+// Release frees the lock if it is still held with token.
+func (m *lockManager) Release(name string, token uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, err := m.lease(name)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Token != token {
+		return errLockHeld
+	}
+	return m.bucket.Delete(leasePrefix + name)
+}
+
+// reap deletes the expired leases. Expired leases do not hold their lock
+// anyway, the reaper only keeps them from piling up.
+func (m *lockManager) reap() error {
+	keys, err := m.bucket.Keys(leasePrefix)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		l, err := m.lease(strings.TrimPrefix(key, leasePrefix))
+		if err != nil {
+			return err
+		}
+		if l == nil {
+			if err := m.bucket.Delete(key); err != nil && !errors.Is(err, datastore.ErrNotFound) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *lockManager) reaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.reap(); err != nil && !errors.Is(err, datastore.ErrClosed) {
+			log.Printf("lock reaper: %s", err)
+		}
+	}
+}
+
+func lockStatus(err error) int {
+	if errors.Is(err, errLockHeld) {
+		return http.StatusConflict
+	}
+	return statusFor(err)
+}
+
+// handleLocks serves
+//
+//	GET    /locks/<name>           the current lease
+//	POST   /locks/<name>           acquire {"owner": ..., "ttl": "10s"}
+//	POST   /locks/<name>/renew     renew {"token": ..., "ttl": "10s"}
+//	DELETE /locks/<name>?token=    release
+//
+// A lock held by someone else, or no longer held with the token, gives 409.
+func handleLocks(h *http.ServeMux, m *lockManager, trail *auditor) {
+	h.HandleFunc("/locks/", func(rw http.ResponseWriter, req *http.Request) {
+		name, op, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/locks/"), "/")
+		if name == "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case req.Method == "GET" && op == "":
+			m.mu.Lock()
+			l, err := m.lease(name)
+			m.mu.Unlock()
+			if err == nil && l == nil {
+				err = datastore.ErrNotFound
+			}
+			if err != nil {
+				rw.WriteHeader(lockStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, l)
+		case req.Method == "POST" && (op == "" || op == "renew"):
+			var body LockBody
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ttl, err := time.ParseDuration(body.TTL)
+			if err != nil || ttl <= 0 {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var l Lease
+			err = trail.change(req, nil, name, "/locks/"+name, func() (err error) {
+				if op == "" {
+					l, err = m.Acquire(name, body.Owner, ttl)
+				} else {
+					l, err = m.Renew(name, body.Token, ttl)
+				}
+				return err
+			})
+			if err != nil {
+				rw.WriteHeader(lockStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, l)
+		case req.Method == "DELETE" && op == "":
+			token, err := strconv.ParseUint(req.URL.Query().Get("token"), 10, 64)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err = trail.change(req, nil, name, "/locks/"+name, func() error {
+				return m.Release(name, token)
+			})
+			if err != nil {
+				rw.WriteHeader(lockStatus(err))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
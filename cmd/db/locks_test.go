@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestLockManager(t *testing.T) {
+	fs := datastore.NewFaultFS(1)
+	db, err := datastore.NewDbWithOptions("/db", 250, datastore.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	m := newLockManager(db)
+	now := time.Unix(1700000000, 0)
+	m.now = func() time.Time { return now }
+
+	l, err := m.Acquire("cron", "worker-1", time.Minute)
+	if err != nil || l.Token != 1 {
+		t.Fatalf("Bad lease %+v (%v)", l, err)
+	}
+	if _, err := m.Acquire("cron", "worker-2", time.Minute); err != errLockHeld {
+		t.Errorf("Expected errLockHeld, got %v", err)
+	}
+
+	now = now.Add(50 * time.Second)
+	if _, err := m.Renew("cron", l.Token, time.Minute); err != nil {
+		t.Errorf("Renew failed: %v", err)
+	}
+	now = now.Add(50 * time.Second)
+	if _, err := m.Acquire("cron", "worker-2", time.Minute); err != errLockHeld {
+		t.Errorf("Expected the renewed lease to hold the lock, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	l2, err := m.Acquire("cron", "worker-2", time.Minute)
+	if err != nil || l2.Token <= l.Token {
+		t.Fatalf("Expected the expired lock to be taken with a newer token, got %+v (%v)", l2, err)
+	}
+	if err := m.Release("cron", l.Token); err != errLockHeld {
+		t.Errorf("Expected the stale token to be rejected, got %v", err)
+	}
+	if _, err := m.Renew("cron", l.Token, time.Minute); err != errLockHeld {
+		t.Errorf("Expected the stale token to be rejected, got %v", err)
+	}
+	if err := m.Release("cron", l2.Token); err != nil {
+		t.Errorf("Release failed: %v", err)
+	}
+
+	m.Acquire("other", "worker-1", time.Second)
+	now = now.Add(time.Second)
+	if err := m.reap(); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := m.bucket.Keys(leasePrefix); len(names) != 0 {
+		t.Errorf("Expected the expired leases to be reaped, got %v", names)
+	}
+
+	// Tokens keep growing after a restart.
+	db.Close()
+	db, err = datastore.NewDbWithOptions("/db", 250, datastore.Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = newLockManager(db)
+	if l3, err := m.Acquire("cron", "worker-3", time.Minute); err != nil || l3.Token != 4 {
+		t.Errorf("Expected token 4 after reopening, got %+v (%v)", l3, err)
+	}
+
+	// The buckets served by /db/ and /buckets/ do not reach the lock state.
+	for _, name := range []string{"fencing", "locks"} {
+		b, err := db.Bucket(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Put("token", "0")
+		b.Put("cron", "{}")
+		if err := db.DropBucket(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Acquire("cron", "worker-4", time.Minute); err != errLockHeld {
+		t.Errorf("Expected the lease to be kept, got %v", err)
+	}
+	if l4, err := m.Acquire("batch", "worker-4", time.Minute); err != nil || l4.Token != 5 {
+		t.Errorf("Expected token 5, got %+v (%v)", l4, err)
+	}
+}
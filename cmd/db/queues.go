@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+type MessageBody struct {
+	ID         uint64 `json:"id"`
+	Body       string `json:"body,omitempty"`
+	Deliveries int    `json:"deliveries,omitempty"`
+	Receipt    string `json:"receipt,omitempty"`
+}
+
+// handleQueues serves
+//
+//	POST /queues/<name>            enqueue {"value": ...}
+//	POST /queues/<name>/dequeue    next message, 204 when there is none
+//	POST /queues/<name>/ack/<receipt>
+//	POST /queues/<name>/nack/<receipt>
+//	GET  /queues/<name>            {"count": pending messages}
+//
+// Acks and nacks answer 409 unless the delivery of the receipt is in flight.
+// The dead letters of a queue are in the queue <name>.dead.
+func handleQueues(h *http.ServeMux, db *datastore.Db, opts datastore.QueueOptions, trail *auditor) {
+	h.HandleFunc("/queues/", func(rw http.ResponseWriter, req *http.Request) {
+		name, op, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/queues/"), "/")
+		if name == "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q := db.Queue(name, opts)
+		op, arg, _ := strings.Cut(op, "/")
+		switch {
+		case req.Method == "GET" && op == "":
+			n, err := q.Len()
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, CountBody{Count: n})
+		case req.Method == "POST" && op == "":
+			var body ReqBody
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var id uint64
+			err := trail.change(req, db, name, name, func() (err error) {
+				id, err = q.Enqueue(body.Value)
+				return err
+			})
+			if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusCreated, MessageBody{ID: id})
+		case req.Method == "POST" && op == "dequeue":
+			var m datastore.Message
+			err := trail.change(req, db, name, name, func() (err error) {
+				m, err = q.Dequeue()
+				return err
+			})
+			if errors.Is(err, datastore.ErrQueueEmpty) {
+				rw.WriteHeader(http.StatusNoContent)
+				return
+			} else if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			writeJSON(rw, http.StatusOK, MessageBody{ID: m.ID, Body: m.Body, Deliveries: m.Deliveries, Receipt: m.Receipt})
+		case req.Method == "POST" && (op == "ack" || op == "nack"):
+			if arg == "" {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := trail.change(req, db, name, name, func() error {
+				if op == "ack" {
+					return q.Ack(arg)
+				}
+				return q.Nack(arg)
+			})
+			if errors.Is(err, datastore.ErrNotInFlight) {
+				rw.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
+				rw.WriteHeader(collectionStatus(err))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
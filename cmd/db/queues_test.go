@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestHandleQueues(t *testing.T) {
+	db, err := datastore.NewDbWithOptions("/db", 250, datastore.Options{FS: datastore.NewFaultFS(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := new(http.ServeMux)
+	handleQueues(h, db, datastore.QueueOptions{}, nil)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return rw
+	}
+
+	for _, path := range []string{"/queues/", "/queues/jobs/ack/"} {
+		if rw := post(path, `{"value": "job"}`); rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", path, rw.Code)
+		}
+	}
+
+	if rw := post("/queues/jobs", `{"value": "job"}`); rw.Code != http.StatusCreated {
+		t.Fatalf("Bad enqueue status %d", rw.Code)
+	}
+	rw := post("/queues/jobs/dequeue", "")
+	var m MessageBody
+	if err := json.NewDecoder(rw.Body).Decode(&m); err != nil || m.Receipt == "" {
+		t.Fatalf("Bad message %+v (%v)", m, err)
+	}
+	if rw := post("/queues/jobs/ack/"+m.Receipt+"0", ""); rw.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for another receipt, got %d", rw.Code)
+	}
+	if rw := post("/queues/jobs/ack/"+m.Receipt, ""); rw.Code != http.StatusOK {
+		t.Errorf("Bad ack status %d", rw.Code)
+	}
+	if rw := post("/queues/jobs/ack/"+m.Receipt, ""); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a second ack, got %d", rw.Code)
+	}
+}
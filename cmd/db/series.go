@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+type PointBody struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type PointsBody struct {
+	Points []PointBody `json:"points"`
+}
+
+type RetentionBody struct {
+	Retention string `json:"retention"`
+}
+
+var aggregations = map[string]datastore.Aggregation{
+	"avg": datastore.AggAvg,
+	"min": datastore.AggMin,
+	"max": datastore.AggMax,
+}
+
+func seriesStatus(err error) int {
+	if errors.Is(err, datastore.ErrOutOfOrder) {
+		return http.StatusConflict
+	}
+	return collectionStatus(err)
+}
+
+// handleSeries serves
+//
+//	GET  /series/<key>?from=&to=[&step=&agg=]  points, downsampled with step
+//	POST /series/<key>                         append {"points": [...]}
+//	PUT  /series/<key>                         set retention {"retention": "24h"}
+//
+// Times are RFC 3339, from and to default to the whole series and agg to avg.
+func handleSeries(h *http.ServeMux, db *datastore.Db, trail *auditor) {
+	h.HandleFunc("/series/", func(rw http.ResponseWriter, req *http.Request) {
+		key := strings.TrimPrefix(req.URL.Path, "/series/")
+		switch req.Method {
+		case "GET":
+			query := req.URL.Query()
+			from, to := time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64)
+			var err error
+			if v := query.Get("from"); v != "" {
+				if from, err = time.Parse(time.RFC3339Nano, v); err != nil {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			if v := query.Get("to"); v != "" {
+				if to, err = time.Parse(time.RFC3339Nano, v); err != nil {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			var points []datastore.Point
+			if v := query.Get("step"); v != "" {
+				step, perr := time.ParseDuration(v)
+				agg, ok := aggregations[query.Get("agg")]
+				if query.Get("agg") == "" {
+					agg, ok = datastore.AggAvg, true
+				}
+				if perr != nil || step <= 0 || !ok {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				points, err = db.TSDownsample(key, from, to, step, agg)
+			} else {
+				points, err = db.TSRange(key, from, to)
+			}
+			if err != nil {
+				rw.WriteHeader(seriesStatus(err))
+				return
+			}
+			body := PointsBody{Points: make([]PointBody, len(points))}
+			for i, p := range points {
+				body.Points[i] = PointBody{Time: p.Time, Value: p.Value}
+			}
+			writeJSON(rw, http.StatusOK, body)
+		case "POST":
+			var body PointsBody
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			err := trail.change(req, db, key, key, func() error {
+				for _, p := range body.Points {
+					if err := db.TSAdd(key, p.Time, p.Value); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				rw.WriteHeader(seriesStatus(err))
+				return
+			}
+			rw.WriteHeader(http.StatusCreated)
+		case "PUT":
+			var body RetentionBody
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var retention time.Duration
+			if body.Retention != "" {
+				var err error
+				if retention, err = time.ParseDuration(body.Retention); err != nil {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			err := trail.change(req, db, key, key, func() error {
+				return db.TSCreate(key, retention)
+			})
+			if err != nil {
+				rw.WriteHeader(seriesStatus(err))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
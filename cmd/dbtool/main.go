@@ -0,0 +1,72 @@
+// Command dbtool exports the keys of a database directory to stdout and
+// imports them from stdin:
+//
+//	dbtool -dir data export > dump.ndjson
+//	dbtool -dir copy -format csv import < dump.csv
+//
+// Exports open the directory read-only, so they can run next to the server.
+// Imports need the writer lock.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+var (
+	dataDir = flag.String("dir", "", "directory of the database files")
+	format  = flag.String("format", "ndjson", "export format: ndjson or csv")
+	keyFile = flag.String("key-file", "", "file of the id:hex keys the data is encrypted with")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -dir <dir> [flags] export|import\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *dataDir == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	f, err := datastore.ParseFormat(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := datastore.Options{ReadOnly: flag.Arg(0) == "export"}
+	if *keyFile != "" {
+		if opts.Keyring, err = datastore.LoadKeyring(*keyFile); err != nil {
+			log.Fatalf("encryption keys: %s", err)
+		}
+	}
+	db, err := datastore.NewDbWithOptions(*dataDir, 250, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	switch flag.Arg(0) {
+	case "export":
+		out := bufio.NewWriter(os.Stdout)
+		if err := db.Export(out, f); err != nil {
+			log.Fatal(err)
+		}
+		if err := out.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	case "import":
+		n, err := db.Import(bufio.NewReader(os.Stdin), f)
+		if err != nil {
+			log.Fatalf("import stopped after %d records: %s", n, err)
+		}
+		log.Printf("imported %d records", n)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,284 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditFileName        = "audit-log"
+	defaultAuditFileSize = 16 << 20
+)
+
+var ErrNoAudit = fmt.Errorf("audit log is disabled")
+
+// AuditEntry records a change of a key. Client is the name the client gave
+// for itself, it is not verified; Remote is the address the change came
+// from. The versions are zero when versions are not retained, or when the key
+// had none.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client,omitempty"`
+	Remote     string    `json:"remote,omitempty"`
+	Method     string    `json:"method"`
+	Key        string    `json:"key"`
+	OldVersion uint64    `json:"oldVersion,omitempty"`
+	NewVersion uint64    `json:"newVersion,omitempty"`
+}
+
+type auditFile struct {
+	id   int
+	path string
+	file File
+	size int64
+	// first and last are the times of the oldest and of the newest record,
+	// zero for an empty file.
+	first, last int64
+}
+
+// auditLog keeps the audit entries in a series of files of their own, apart
+// from the segments, so that merges never touch them. The files have the
+// segment format, the key of a record is the key changed and its value the
+// JSON of the entry. Entries are only ever appended: the head file is
+// replaced by a new one once it reaches maxSize or gets older than maxAge,
+// the sealed files are kept as they are.
+type auditLog struct {
+	fs      FS
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	noSync  bool
+	packer  packer
+
+	mu     sync.Mutex
+	files  []*auditFile // oldest first, the last one is the head
+	head   *auditFile
+	nextID int
+	closed bool
+}
+
+func openAuditLog(fs FS, dir string, opts Options, p packer) (*auditLog, error) {
+	l := &auditLog{
+		fs:      fs,
+		dir:     dir,
+		maxSize: opts.AuditFileSize,
+		maxAge:  opts.AuditFileAge,
+		noSync:  opts.NoSync,
+		packer:  p,
+	}
+	if l.maxSize <= 0 {
+		l.maxSize = defaultAuditFileSize
+	}
+
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, name := range names {
+		rest, ok := strings.CutPrefix(name, auditFileName)
+		if !ok {
+			continue
+		}
+		if id, err := strconv.Atoi(rest); err == nil && id >= 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for i, id := range ids {
+		flag := os.O_RDONLY
+		isHead := i == len(ids)-1 && !opts.ReadOnly
+		if isHead {
+			flag = os.O_RDWR | os.O_APPEND
+		}
+		af := &auditFile{id: id, path: l.path(id)}
+		if af.file, err = fs.OpenFile(af.path, flag, 0o600); err != nil {
+			l.close()
+			return nil, err
+		}
+		l.files = append(l.files, af)
+		l.nextID = id + 1
+		format, size, err := scanSegment(af.file, func(_ int64, e entry) error {
+			if af.first == 0 {
+				af.first = e.time
+			}
+			af.last = e.time
+			return nil
+		})
+		switch {
+		case isHead && errors.Is(err, errTornRecord):
+			// The entry was never acknowledged.
+			err = af.file.Truncate(size)
+		case !isHead && errors.Is(err, errTornRecord):
+			err = nil
+		}
+		if err == nil && isHead && format != currentFormat {
+			// Older files are left as they are, new entries go to a new file.
+			isHead = false
+		}
+		if err == nil && isHead && size < format.start() {
+			err = writeSegmentHeader(af.file, format)
+			size = format.start()
+		}
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("open %s: %w", af.path, err)
+		}
+		af.size = size
+		if isHead {
+			l.head = af
+		}
+	}
+	return l, nil
+}
+
+func (l *auditLog) path(id int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%d", auditFileName, id))
+}
+
+// rotate starts a new head file. Called with mu held.
+func (l *auditLog) rotate() error {
+	path := l.path(l.nextID)
+	f, err := l.fs.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := writeSegmentHeader(f, currentFormat); err != nil {
+		f.Close()
+		l.fs.Remove(path)
+		return err
+	}
+	l.head = &auditFile{id: l.nextID, path: path, file: f, size: segmentFormat(currentFormat).start()}
+	l.files = append(l.files, l.head)
+	l.nextID++
+	return nil
+}
+
+func (l *auditLog) append(e AuditEntry) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	rec, _ := l.packer.pack(entry{key: e.Key, value: string(value), time: e.Time.UnixNano()})
+	data := segmentFormat(currentFormat).encode(rec)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	head := l.head
+	if head == nil || (head.first != 0 &&
+		(head.size+int64(len(data)) > l.maxSize || (l.maxAge > 0 && rec.time-head.first > int64(l.maxAge)))) {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+		head = l.head
+	}
+	_, err = head.file.Write(data)
+	if err == nil && !l.noSync {
+		err = head.file.Sync()
+	}
+	if err != nil {
+		if terr := head.file.Truncate(head.size); terr != nil {
+			return fmt.Errorf("%w (truncate: %s)", err, terr)
+		}
+		return err
+	}
+	head.size += int64(len(data))
+	if head.first == 0 {
+		head.first = rec.time
+	}
+	head.last = rec.time
+	return nil
+}
+
+// query returns the entries of key, of all keys when it is empty, recorded at
+// or after since, oldest first.
+func (l *auditLog) query(key string, since time.Time) ([]AuditEntry, error) {
+	// Appends wait for the query, the files are small compared to segments.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	// UnixNano is undefined for the zero time.
+	from := int64(math.MinInt64)
+	if !since.IsZero() {
+		from = since.UnixNano()
+	}
+	var res []AuditEntry
+	for _, af := range l.files {
+		if af.last < from {
+			continue
+		}
+		// The head only counts up to the last acknowledged entry.
+		_, _, err := scanSegment(io.NewSectionReader(af.file, 0, af.size), func(_ int64, rec entry) error {
+			if rec.time < from {
+				return nil
+			}
+			rec, _, err := l.packer.unpack(rec)
+			if err != nil || (key != "" && rec.key != key) {
+				return err
+			}
+			var e AuditEntry
+			if err := json.Unmarshal([]byte(rec.value), &e); err != nil {
+				return fmt.Errorf("%w: %s", errCorrupted, err)
+			}
+			res = append(res, e)
+			return nil
+		})
+		if err != nil && !errors.Is(err, errTornRecord) {
+			return nil, fmt.Errorf("read %s: %w", af.path, err)
+		}
+	}
+	return res, nil
+}
+
+func (l *auditLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	var err error
+	for _, af := range l.files {
+		if cerr := af.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Audit appends e to the audit log, with the current time when e has none.
+// It is acknowledged once synced.
+func (db *Db) Audit(e AuditEntry) error {
+	switch {
+	case db.audit == nil:
+		return ErrNoAudit
+	case db.readOnly:
+		return ErrReadOnly
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	return db.audit.append(e)
+}
+
+// AuditTrail returns the audit entries of key, of all keys when key is empty,
+// recorded since the given time, oldest first.
+func (db *Db) AuditTrail(key string, since time.Time) ([]AuditEntry, error) {
+	if db.audit == nil {
+		return nil, ErrNoAudit
+	}
+	return db.audit.query(key, since)
+}
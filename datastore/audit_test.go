@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Audit(t *testing.T) {
+	fs := NewFaultFS(1)
+	opts := Options{FS: fs, AuditLog: true, AuditFileSize: 300}
+	db, err := NewDbWithOptions("/db", 100, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		key := "a"
+		if i%2 == 1 {
+			key = "b"
+		}
+		err := db.Audit(AuditEntry{
+			Time:       start.Add(time.Duration(i) * time.Second),
+			Client:     "alice",
+			Method:     "POST",
+			Key:        key,
+			OldVersion: uint64(i),
+			NewVersion: uint64(i + 1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		all, err := db.AuditTrail("", time.Time{})
+		if err != nil || len(all) != 10 {
+			t.Fatalf("Expected 10 entries, got %d (%v)", len(all), err)
+		}
+		for i, e := range all {
+			if e.NewVersion != uint64(i+1) || !e.Time.Equal(start.Add(time.Duration(i)*time.Second)) || e.Client != "alice" {
+				t.Errorf("Bad entry %d: %+v", i, e)
+			}
+		}
+		since := start.Add(5 * time.Second)
+		entries, err := db.AuditTrail("b", since)
+		if err != nil || len(entries) != 3 {
+			t.Fatalf("Expected 3 entries of b since %s, got %+v (%v)", since, entries, err)
+		}
+		for _, e := range entries {
+			if e.Key != "b" || e.Time.Before(since) {
+				t.Errorf("Bad entry %+v", e)
+			}
+		}
+	}
+
+	t.Run("query", check)
+
+	t.Run("rotation", func(t *testing.T) {
+		names, _ := fs.ReadDir("/db")
+		files := 0
+		for _, name := range names {
+			if strings.HasPrefix(name, auditFileName) {
+				files++
+			}
+		}
+		if files < 2 {
+			t.Errorf("Expected the audit log to be rotated, got %v", names)
+		}
+
+		db.Close()
+		opts.AuditFileSize = 0
+		opts.AuditFileAge = time.Second
+		if db, err = NewDbWithOptions("/db", 100, opts); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		head := db.audit.head
+		db.Audit(AuditEntry{Time: start.Add(time.Minute), Key: "c"})
+		if db.audit.head == head {
+			t.Error("Expected an old head file to be rotated")
+		}
+	})
+
+	t.Run("torn entry", func(t *testing.T) {
+		db.Close()
+		path := db.audit.head.path
+		f, err := fs.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte{1, 2, 3})
+		f.Close()
+		if db, err = NewDbWithOptions("/db", 100, opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Audit(AuditEntry{Time: start.Add(2 * time.Minute), Key: "c"}); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err := db.AuditTrail("c", time.Time{}); err != nil || len(entries) != 2 {
+			t.Errorf("Expected 2 entries of c, got %+v (%v)", entries, err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		db, err := NewDbWithOptions("/other", 100, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Audit(AuditEntry{Key: "k"}); err != ErrNoAudit {
+			t.Errorf("Expected ErrNoAudit, got %v", err)
+		}
+	})
+}
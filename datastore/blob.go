@@ -0,0 +1,324 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Blobs are split into chunks at content-defined boundaries and every chunk
+// is stored once, under its SHA-256, in the reserved blobBucket. A blob key
+// maps to a manifest listing its chunks. The chunks are reference counted in
+// memory, the counts are rebuilt from the manifests on open, and merges drop
+// the chunks no manifest refers to anymore.
+const (
+	blobBucket     = lockBucket - 1
+	manifestPrefix = "m/"
+	chunkPrefix    = "c/"
+	blobTag        = "b"
+
+	minBlobChunk = 2 << 10
+	maxBlobChunk = 64 << 10
+	// The boundary mask gives chunks of about 8KB past the minimum size.
+	blobChunkMask = 1<<13 - 1
+)
+
+// gear is the table of the rolling hash finding chunk boundaries. It is
+// derived from a fixed seed: the boundaries, and so the deduplication of
+// already stored blobs, depend on it.
+var gear = func() (t [256]uint64) {
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+type blobChunk struct {
+	hash string
+	size int64
+}
+
+type chunkRefs struct {
+	refs int
+	size int64
+}
+
+// BlobStats describes the stored blobs.
+type BlobStats struct {
+	// Chunks is the number of distinct chunks referenced by blobs.
+	Chunks int
+	// Bytes is the size of these chunks, every chunk counted once.
+	Bytes int64
+}
+
+func encodeManifest(chunks []blobChunk) string {
+	var sb strings.Builder
+	for i, c := range chunks {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%s/%d", c.hash, c.size)
+	}
+	sb.WriteString(blobTag)
+	return sb.String()
+}
+
+func parseManifest(value string) ([]blobChunk, error) {
+	if value[len(value)-1:] != blobTag {
+		return nil, ErrWrongType
+	}
+	var chunks []blobChunk
+	for _, field := range strings.Fields(value[:len(value)-1]) {
+		hash, size, ok := strings.Cut(field, "/")
+		n, err := strconv.ParseInt(size, 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("bad blob manifest")
+		}
+		chunks = append(chunks, blobChunk{hash: hash, size: n})
+	}
+	return chunks, nil
+}
+
+func manifestKey(key string) recordKey {
+	return recordKey{bucket: blobBucket, key: manifestPrefix + key}
+}
+
+func chunkKey(hash string) recordKey {
+	return recordKey{bucket: blobBucket, key: chunkPrefix + hash}
+}
+
+// loadBlobs counts the references to the chunks. Called before the
+// goroutines are started, once the value log is open.
+func (db *Db) loadBlobs() error {
+	db.blobRefs = make(map[string]*chunkRefs)
+	seen := make(map[recordKey]bool)
+	for _, s := range db.segments {
+		for key := range s.index {
+			if key.bucket != blobBucket || !strings.HasPrefix(key.key, manifestPrefix) || seen[key] {
+				continue
+			}
+			seen[key] = true
+			s, pos, err := db.getSegmentAndPos(key)
+			if err != nil || pos.deleted {
+				continue
+			}
+			value, err := s.getFromSegment(pos.offset)
+			if err == nil && isPointer(value) {
+				value, err = db.vlog.read(decodePointer(value))
+			}
+			if err != nil {
+				return err
+			}
+			chunks, err := parseManifest(value)
+			if err != nil {
+				return fmt.Errorf("blob %s: %w", key.key, err)
+			}
+			db.addRefs(chunks)
+		}
+	}
+	return nil
+}
+
+// addRefs references chunks and returns the ones that were not referenced
+// before. These have to be written, a merge may have dropped them already.
+func (db *Db) addRefs(chunks []blobChunk) []blobChunk {
+	db.blobRefsMu.Lock()
+	defer db.blobRefsMu.Unlock()
+	var added []blobChunk
+	for _, c := range chunks {
+		r := db.blobRefs[c.hash]
+		if r == nil {
+			r = &chunkRefs{size: c.size}
+			db.blobRefs[c.hash] = r
+			added = append(added, c)
+		}
+		r.refs++
+	}
+	return added
+}
+
+func (db *Db) dropRefs(chunks []blobChunk) {
+	db.blobRefsMu.Lock()
+	defer db.blobRefsMu.Unlock()
+	for _, c := range chunks {
+		if r := db.blobRefs[c.hash]; r != nil {
+			if r.refs--; r.refs <= 0 {
+				delete(db.blobRefs, c.hash)
+			}
+		}
+	}
+}
+
+// blobLive tells merges whether a record of the blob bucket is still needed.
+func (db *Db) blobLive(key recordKey) bool {
+	hash, ok := strings.CutPrefix(key.key, chunkPrefix)
+	if key.bucket != blobBucket || !ok {
+		return true
+	}
+	db.blobRefsMu.RLock()
+	defer db.blobRefsMu.RUnlock()
+	return db.blobRefs[hash] != nil
+}
+
+// nextChunk reads the next chunk of r. It ends where the rolling hash of the
+// content matches the boundary mask, so inserting bytes into a blob only
+// changes the chunks around the insertion.
+func nextChunk(r *bufio.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	var h uint64
+	for len(buf) < maxBlobChunk {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+		h = h<<1 + gear[b]
+		if len(buf) >= minBlobChunk && h&blobChunkMask == 0 {
+			break
+		}
+	}
+	return buf, nil
+}
+
+// PutBlob stores the content of r under key, replacing the blob stored there,
+// and returns its size. Chunks already stored by any blob are not written
+// again.
+func (db *Db) PutBlob(key string, r io.Reader) (int64, error) {
+	ctx := context.Background()
+	db.blobsMu.Lock()
+	defer db.blobsMu.Unlock()
+	old, err := db.manifest(ctx, key)
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+
+	var (
+		chunks []blobChunk
+		size   int64
+		buf    = make([]byte, 0, maxBlobChunk)
+		in     = bufio.NewReader(r)
+	)
+	// Chunks are referenced before they are written and released again on
+	// failure, so a merge does not take them away in between.
+	fail := func(err error) (int64, error) {
+		db.dropRefs(chunks)
+		return 0, err
+	}
+	for {
+		data, err := nextChunk(in, buf)
+		if err != nil {
+			return fail(err)
+		}
+		if len(data) == 0 {
+			break
+		}
+		sum := sha256.Sum256(data)
+		c := blobChunk{hash: hex.EncodeToString(sum[:]), size: int64(len(data))}
+		chunks = append(chunks, c)
+		size += c.size
+		if len(db.addRefs([]blobChunk{c})) == 0 {
+			continue
+		}
+		e := entry{key: chunkKey(c.hash).key, bucket: blobBucket, value: string(data) + "s"}
+		if err := db.put(ctx, e); err != nil {
+			return fail(err)
+		}
+	}
+	e := entry{key: manifestKey(key).key, bucket: blobBucket, value: encodeManifest(chunks)}
+	if err := db.put(ctx, e); err != nil {
+		return fail(err)
+	}
+	db.dropRefs(old)
+	return size, nil
+}
+
+func (db *Db) manifest(ctx context.Context, key string) ([]blobChunk, error) {
+	value, err := db.getValue(ctx, manifestKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(value)
+}
+
+// DeleteBlob removes the blob stored under key. Its chunks are dropped by
+// merges unless other blobs share them.
+func (db *Db) DeleteBlob(key string) error {
+	ctx := context.Background()
+	db.blobsMu.Lock()
+	defer db.blobsMu.Unlock()
+	chunks, err := db.manifest(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := db.put(ctx, entry{key: manifestKey(key).key, bucket: blobBucket, value: deleteMarker}); err != nil {
+		return err
+	}
+	db.dropRefs(chunks)
+	return nil
+}
+
+type blobReader struct {
+	db     *Db
+	chunks []blobChunk
+	cur    *strings.Reader
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	for r.cur == nil || r.cur.Len() == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		value, err := r.db.getValue(context.Background(), chunkKey(r.chunks[0].hash))
+		if errors.Is(err, ErrNotFound) {
+			err = fmt.Errorf("blob chunk %s is missing", r.chunks[0].hash)
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.cur = strings.NewReader(value[:len(value)-1])
+		r.chunks = r.chunks[1:]
+	}
+	return r.cur.Read(p)
+}
+
+func (r *blobReader) Close() error {
+	r.chunks = nil
+	return nil
+}
+
+// GetBlob streams the blob stored under key, one chunk in memory at a time.
+// The chunks of a blob deleted or replaced while it is being read may be
+// gone before they are reached.
+func (db *Db) GetBlob(key string) (io.ReadCloser, error) {
+	chunks, err := db.manifest(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{db: db, chunks: chunks}, nil
+}
+
+// BlobStats counts the distinct chunks of all blobs.
+func (db *Db) BlobStats() BlobStats {
+	db.blobRefsMu.RLock()
+	defer db.blobRefsMu.RUnlock()
+	var stats BlobStats
+	for _, r := range db.blobRefs {
+		stats.Chunks++
+		stats.Bytes += r.size
+	}
+	return stats
+}
@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Blobs(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 64<<10, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	data := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	readBlob := func(t *testing.T, key string) []byte {
+		r, err := db.GetBlob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		n, err := db.PutBlob("a", bytes.NewReader(data))
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("Bad PutBlob result %d (%v)", n, err)
+		}
+		if !bytes.Equal(readBlob(t, "a"), data) {
+			t.Error("Blob content differs")
+		}
+		if stats := db.BlobStats(); stats.Bytes != int64(len(data)) || stats.Chunks < 10 {
+			t.Errorf("Bad stats %+v", stats)
+		}
+		if _, err := db.GetBlob("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("dedup", func(t *testing.T) {
+		before := db.BlobStats()
+		db.PutBlob("b", bytes.NewReader(data))
+		if stats := db.BlobStats(); stats != before {
+			t.Errorf("An identical blob added chunks: %+v, was %+v", stats, before)
+		}
+		// Inserting bytes only changes the chunks around the insertion.
+		edited := append(append(append([]byte{}, data[:100<<10]...), "inserted"...), data[100<<10:]...)
+		db.PutBlob("c", bytes.NewReader(edited))
+		if stats := db.BlobStats(); stats.Chunks > before.Chunks+2 {
+			t.Errorf("An edited blob added %d chunks", stats.Chunks-before.Chunks)
+		}
+		if !bytes.Equal(readBlob(t, "c"), edited) {
+			t.Error("Edited blob content differs")
+		}
+	})
+
+	t.Run("garbage collection", func(t *testing.T) {
+		for _, key := range []string{"a", "b"} {
+			if err := db.DeleteBlob(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		shared := db.BlobStats()
+		db.PutBlob("c", strings.NewReader("small"))
+		if stats := db.BlobStats(); stats.Chunks != 1 {
+			t.Errorf("Expected only the chunk of the replaced blob, got %+v (was %+v)", stats, shared)
+		}
+		for i := 0; i < 200 && chunksOnDisk(t, fs) > 1; i++ {
+			db.Put("filler"+strconv.Itoa(i%10), strings.Repeat("x", 8<<10))
+			time.Sleep(time.Millisecond)
+		}
+		if n := chunksOnDisk(t, fs); n != 1 {
+			t.Errorf("Expected the unreferenced chunks to be merged away, %d left", n)
+		}
+		if content := readBlob(t, "c"); string(content) != "small" {
+			t.Errorf("Bad blob content %q", content)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db.PutBlob("d", bytes.NewReader(data))
+		before := db.BlobStats()
+		db.Close()
+		db, err = NewDbWithOptions("/db", 64<<10, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats := db.BlobStats(); stats != before {
+			t.Errorf("Reference counts changed on reopening: %+v, was %+v", stats, before)
+		}
+		if !bytes.Equal(readBlob(t, "d"), data) {
+			t.Error("Blob content differs after reopening")
+		}
+		keys, _ := db.Keys("")
+		for _, key := range keys {
+			if !strings.HasPrefix(key, "filler") {
+				t.Errorf("Blob records leaked into the keys: %v", keys)
+				break
+			}
+		}
+	})
+}
+
+func chunksOnDisk(t *testing.T, fs *FaultFS) int {
+	n := 0
+	forEachRecord(t, fs, "/db", func(e entry) {
+		if e.bucket == blobBucket && strings.HasPrefix(e.key, chunkPrefix) {
+			n++
+		}
+	})
+	return n
+}
@@ -0,0 +1,282 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// metaBucket holds the bucket registry: a record per bucket mapping its
+	// name to its id, and the next id to hand out. Ids are never reused, so
+	// records of a dropped bucket can not reappear in a new one.
+	metaBucket      = math.MaxUint32
+	bucketKeyPrefix = "bucket/"
+	nextBucketKey   = "next-bucket"
+
+	// lockBucket holds the leases and fencing tokens of a lock service. It
+	// has no name, so it is out of reach of Bucket and DropBucket.
+	lockBucket = metaBucket - 1
+)
+
+var ErrBucketDropped = fmt.Errorf("bucket was dropped")
+
+// Bucket is a namespace of keys inside a Db. Buckets share the segment files,
+// every record carries the id of its bucket.
+type Bucket struct {
+	db   *Db
+	name string
+	id   uint32
+}
+
+type BucketStats struct {
+	// Keys is the number of live keys.
+	Keys int
+	// Bytes is the size of their records in the segment files.
+	Bytes int64
+}
+
+// loadBuckets reads the registry from the segments. Called before the
+// goroutines are started.
+func (db *Db) loadBuckets() error {
+	db.buckets = make(map[string]uint32)
+	db.bucketNames = make(map[uint32]string)
+	db.nextBucket = 1
+	seen := make(map[string]bool)
+	for _, s := range db.segments {
+		for key := range s.index {
+			if key.bucket != metaBucket || seen[key.key] ||
+				(key.key != nextBucketKey && !strings.HasPrefix(key.key, bucketKeyPrefix)) {
+				continue
+			}
+			seen[key.key] = true
+			s, pos, err := db.getSegmentAndPos(key)
+			if err != nil || pos.deleted {
+				continue
+			}
+			value, err := s.getFromSegment(pos.offset)
+			if err != nil {
+				return err
+			}
+			id, err := parseBucketID(value)
+			if err != nil {
+				return fmt.Errorf("bucket registry: %s: %w", key.key, err)
+			}
+			if key.key == nextBucketKey {
+				if id > db.nextBucket {
+					db.nextBucket = id
+				}
+				continue
+			}
+			name := strings.TrimPrefix(key.key, bucketKeyPrefix)
+			db.buckets[name] = id
+			db.bucketNames[id] = name
+		}
+	}
+	return nil
+}
+
+func formatBucketID(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10) + "i"
+}
+
+func parseBucketID(value string) (uint32, error) {
+	if value[len(value)-1:] != "i" {
+		return 0, fmt.Errorf("invalid data type")
+	}
+	id, err := strconv.ParseUint(value[:len(value)-1], 10, 32)
+	return uint32(id), err
+}
+
+// bucketLive reports whether records of the bucket id are visible.
+func (db *Db) bucketLive(id uint32) bool {
+	if id == 0 || id >= blobBucket {
+		return true
+	}
+	db.bucketsMu.RLock()
+	defer db.bucketsMu.RUnlock()
+	_, ok := db.bucketNames[id]
+	return ok
+}
+
+// Bucket returns the bucket with the given name, creating it when it does not
+// exist yet.
+func (db *Db) Bucket(name string) (*Bucket, error) {
+	if name == "" {
+		return nil, fmt.Errorf("empty bucket name")
+	}
+	db.bucketsMu.Lock()
+	defer db.bucketsMu.Unlock()
+	if id, ok := db.buckets[name]; ok {
+		return &Bucket{db: db, name: name, id: id}, nil
+	}
+	id := db.nextBucket
+	if id >= blobBucket {
+		return nil, fmt.Errorf("too many buckets")
+	}
+
+	ctx := context.Background()
+	// The counter is stored first, so that a crash in between only wastes
+	// the id.
+	err := db.put(ctx, entry{key: nextBucketKey, value: formatBucketID(id + 1), bucket: metaBucket})
+	if err != nil {
+		return nil, err
+	}
+	db.nextBucket = id + 1
+	err = db.put(ctx, entry{key: bucketKeyPrefix + name, value: formatBucketID(id), bucket: metaBucket})
+	if err != nil {
+		return nil, err
+	}
+	db.buckets[name] = id
+	db.bucketNames[id] = name
+	return &Bucket{db: db, name: name, id: id}, nil
+}
+
+// LookupBucket is Bucket that fails with ErrNotFound instead of creating the
+// bucket.
+func (db *Db) LookupBucket(name string) (*Bucket, error) {
+	db.bucketsMu.RLock()
+	defer db.bucketsMu.RUnlock()
+	id, ok := db.buckets[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &Bucket{db: db, name: name, id: id}, nil
+}
+
+// LockBucket returns the bucket reserved for the state of a lock service,
+// which no named bucket can reach.
+func (db *Db) LockBucket() *Bucket {
+	return &Bucket{db: db, id: lockBucket}
+}
+
+// DropBucket deletes the bucket with all its keys. The space taken by them is
+// reclaimed by the next merge.
+func (db *Db) DropBucket(name string) error {
+	db.bucketsMu.Lock()
+	defer db.bucketsMu.Unlock()
+	id, ok := db.buckets[name]
+	if !ok {
+		return ErrNotFound
+	}
+	err := db.put(context.Background(), entry{key: bucketKeyPrefix + name, value: deleteMarker, bucket: metaBucket})
+	if err != nil {
+		return err
+	}
+	delete(db.buckets, name)
+	delete(db.bucketNames, id)
+	if db.evictor != nil {
+		db.evictor.dropBucket(id)
+	}
+	return nil
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) check() error {
+	if !b.db.bucketLive(b.id) {
+		return ErrBucketDropped
+	}
+	return nil
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	return b.GetCtx(context.Background(), key)
+}
+
+func (b *Bucket) GetCtx(ctx context.Context, key string) (string, error) {
+	if err := b.check(); err != nil {
+		return "", err
+	}
+	return b.db.getString(ctx, recordKey{bucket: b.id, key: key})
+}
+
+func (b *Bucket) Put(key, value string) error {
+	return b.PutCtx(context.Background(), key, value)
+}
+
+func (b *Bucket) PutCtx(ctx context.Context, key, value string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.put(ctx, entry{key: key, value: value + "s", bucket: b.id})
+}
+
+func (b *Bucket) Delete(key string) error {
+	return b.DeleteCtx(context.Background(), key)
+}
+
+func (b *Bucket) DeleteCtx(ctx context.Context, key string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.put(ctx, entry{key: key, value: deleteMarker, bucket: b.id})
+}
+
+// Stats counts the live keys of the bucket.
+func (b *Bucket) Stats() (BucketStats, error) {
+	if err := b.check(); err != nil {
+		return BucketStats{}, err
+	}
+	return b.db.bucketStats(b.id)
+}
+
+// Keys returns the live keys of the bucket starting with prefix, sorted.
+func (b *Bucket) Keys(prefix string) ([]string, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	return b.db.keys(recordKey{bucket: b.id, key: prefix})
+}
+
+func (db *Db) bucketStats(id uint32) (BucketStats, error) {
+	op := indexOp{
+		kind:  opStats,
+		key:   recordKey{bucket: id},
+		stats: make(chan BucketStats, 1),
+	}
+	select {
+	case db.indexOps <- op:
+	case <-db.closed:
+		return BucketStats{}, ErrClosed
+	}
+	return <-op.stats, nil
+}
+
+func (db *Db) keys(prefix recordKey) ([]string, error) {
+	op := indexOp{
+		kind: opKeys,
+		key:  prefix,
+		keys: make(chan []string, 1),
+	}
+	select {
+	case db.indexOps <- op:
+	case <-db.closed:
+		return nil, ErrClosed
+	}
+	keys := <-op.keys
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// scanBucket calls fn with the newest record of every live key and
+// collection element of the bucket. Run by the index goroutine.
+func (db *Db) scanBucket(id uint32, fn func(key recordKey, pos recordPos)) {
+	seen := make(map[recordKey]bool)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		for key, pos := range db.segments[i].index {
+			if key.bucket != id || seen[key] {
+				continue
+			}
+			seen[key] = true
+			if !pos.deleted && !deletedByRange(db.segments, i, key, pos.offset) {
+				fn(key, pos)
+			}
+		}
+	}
+}
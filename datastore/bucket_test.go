@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Buckets(t *testing.T) {
+	fs := NewFaultFS(1)
+	opts := Options{FS: fs}
+	db, err := NewDbWithOptions("/db", 100, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	orders, err := db.Bucket("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("isolation", func(t *testing.T) {
+		pairs := map[*Bucket]string{orders: "order", users: "user"}
+		for b, value := range pairs {
+			if err := b.Put("k", value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Put("k", "default"); err != nil {
+			t.Fatal(err)
+		}
+		for b, want := range pairs {
+			if value, err := b.Get("k"); err != nil || value != want {
+				t.Errorf("Bad value in %s: %q (%v)", b.Name(), value, err)
+			}
+		}
+		if value, err := db.Get("k"); err != nil || value != "default" {
+			t.Errorf("Bad value in the default bucket: %q (%v)", value, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := users.Delete("k"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users.Get("k"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+		if value, err := orders.Get("k"); err != nil || value != "order" {
+			t.Errorf("Delete leaked into another bucket: %q (%v)", value, err)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		orders.Put("k", "order")
+		orders.Put("k2", "order")
+		stats, err := orders.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Keys != 2 || stats.Bytes == 0 {
+			t.Errorf("Bad stats of orders: %+v", stats)
+		}
+		if stats, _ := users.Stats(); stats.Keys != 0 {
+			t.Errorf("Bad stats of users: %+v", stats)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err := db.DropBucket("orders"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := orders.Get("k"); err != ErrBucketDropped {
+			t.Errorf("Expected ErrBucketDropped, got %v", err)
+		}
+		if _, err := db.LookupBucket("orders"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a dropped bucket, got %v", err)
+		}
+		again, err := db.Bucket("orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.id == orders.id {
+			t.Errorf("Bucket id %d was reused", orders.id)
+		}
+		if _, err := again.Get("k"); err != ErrNotFound {
+			t.Errorf("Dropped keys are visible in the new bucket: %v", err)
+		}
+	})
+
+	t.Run("reclaimed at merge", func(t *testing.T) {
+		for i := 0; i < 200 && bucketOnDisk(t, fs, orders.id); i++ {
+			db.Put("filler"+strconv.Itoa(i%10), "value")
+			// Give the merge goroutine a chance to run.
+			time.Sleep(time.Millisecond)
+		}
+		if bucketOnDisk(t, fs, orders.id) {
+			t.Errorf("Records of the dropped bucket were not merged away")
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbWithOptions("/db", 100, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := db.LookupBucket("users")
+		if err != nil || b.id != users.id {
+			t.Fatalf("Bucket users was not recovered: %v", err)
+		}
+		if _, err := b.Get("k"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound after reopen, got %v", err)
+		}
+		fresh, err := db.Bucket("fresh")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fresh.id <= orders.id {
+			t.Errorf("Bucket id %d was handed out again", fresh.id)
+		}
+	})
+}
+
+// bucketOnDisk reports whether a segment file holds records of the bucket.
+func bucketOnDisk(t *testing.T, fs *FaultFS, id uint32) bool {
+	found := false
+	forEachRecord(t, fs, "/db", func(e entry) {
+		found = found || e.bucket == id
+	})
+	return found
+}
+
+// forEachRecord calls fn for every record of the segment files in dir.
+func forEachRecord(t *testing.T, fs *FaultFS, dir string, fn func(e entry)) {
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, outFileName) {
+			continue
+		}
+		f, err := fs.OpenFile(filepath.Join(dir, name), 0, 0)
+		if err != nil {
+			// Merged away in the meantime.
+			continue
+		}
+		scanSegment(f, func(_ int64, e entry) error {
+			fn(e)
+			return nil
+		})
+		f.Close()
+	}
+}
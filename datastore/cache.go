@@ -0,0 +1,141 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// cacheKey locates a record. Records are never changed in place, so a cached
+// value stays valid for as long as its segment exists: a put or delete writes
+// a new record that the index points to instead.
+type cacheKey struct {
+	segment *Segment
+	offset  int64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value string
+}
+
+// valueCache is an LRU cache of the values read from segments, bounded by
+// the total size of the values.
+type valueCache struct {
+	maxBytes int64
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+
+	mu      sync.Mutex
+	bytes   int64
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int64
+}
+
+func newValueCache(maxBytes int64) *valueCache {
+	return &valueCache{
+		maxBytes: maxBytes,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *valueCache) get(key cacheKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return "", false
+	}
+	c.hits.Add(1)
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+func (c *valueCache) add(key cacheKey, value string) {
+	if int64(len(value)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: value})
+	c.bytes += int64(len(value))
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *valueCache) removeElement(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= int64(len(e.value))
+}
+
+// dropSegment evicts the values of a segment that was merged away.
+func (c *valueCache) dropSegment(s *Segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if key.segment == s {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *valueCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: len(c.entries),
+		Bytes:   c.bytes,
+	}
+}
+
+// readSegment reads the value at position, going through the cache when it
+// is enabled. The value of a value-log pointer is read through it and cached
+// in its place.
+func (db *Db) readSegment(s *Segment, position int64) (string, error) {
+	if db.cache == nil {
+		return db.loadValue(s, position)
+	}
+	key := cacheKey{segment: s, offset: position}
+	if value, ok := db.cache.get(key); ok {
+		return value, nil
+	}
+	value, err := db.loadValue(s, position)
+	if err == nil {
+		db.cache.add(key, value)
+	}
+	return value, err
+}
+
+// loadValue reads the value at position, following a value-log pointer.
+func (db *Db) loadValue(s *Segment, position int64) (string, error) {
+	value, err := s.getFromSegment(position)
+	if err == nil && isPointer(value) {
+		value, err = db.vlog.read(decodePointer(value))
+	}
+	return value, err
+}
+
+// CacheStats returns the counters of the value cache, all zero when it is
+// disabled.
+func (db *Db) CacheStats() CacheStats {
+	if db.cache == nil {
+		return CacheStats{}
+	}
+	return db.cache.stats()
+}
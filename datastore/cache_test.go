@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Cache(t *testing.T) {
+	db, err := NewDbWithOptions("/db", 100, Options{FS: NewFaultFS(1), CacheSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	get := func(key, want string) {
+		t.Helper()
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("Cannot get %s: %s", key, err)
+		}
+		if value != want {
+			t.Errorf("Bad value returned for %s: %q", key, value)
+		}
+	}
+
+	t.Run("hits", func(t *testing.T) {
+		db.Put("hot", "v1")
+		get("hot", "v1")
+		get("hot", "v1")
+		get("hot", "v1")
+		if stats := db.CacheStats(); stats.Hits != 2 || stats.Misses != 1 {
+			t.Errorf("Bad counters: %+v", stats)
+		}
+	})
+
+	t.Run("invalidation", func(t *testing.T) {
+		db.Put("hot", "v2")
+		get("hot", "v2")
+		db.Delete("hot")
+		if _, err := db.Get("hot"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			key := "k" + strconv.Itoa(i)
+			db.Put(key, "0123456789")
+			get(key, "0123456789")
+		}
+		if stats := db.CacheStats(); stats.Bytes > 64 {
+			t.Errorf("Cache grew over its size: %+v", stats)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		// Let the merges triggered by the puts finish.
+		time.Sleep(100 * time.Millisecond)
+		for i := 0; i < 20; i++ {
+			get("k"+strconv.Itoa(i), "0123456789")
+		}
+		db.cache.mu.Lock()
+		defer db.cache.mu.Unlock()
+		for key := range db.cache.entries {
+			var b [1]byte
+			if _, err := key.segment.file.ReadAt(b[:], 0); err != nil {
+				t.Errorf("Value of a retired segment is cached: %s (%v)", key.segment.filePath, err)
+			}
+		}
+	})
+}
+
+func TestDb_CacheValueLog(t *testing.T) {
+	db, err := NewDbWithOptions("/db", 250, Options{FS: NewFaultFS(1), CacheSize: 1024, ValueLogThreshold: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	big := strings.Repeat("v", 100)
+	if err := db.Put("big", big); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if value, err := db.Get("big"); err != nil || value != big {
+			t.Fatalf("Bad value %q (%v)", value, err)
+		}
+	}
+	if stats := db.CacheStats(); stats.Hits != 1 || stats.Bytes != int64(len(big)+1) {
+		t.Errorf("Expected the value read through the pointer to be cached, got %+v", stats)
+	}
+}
@@ -0,0 +1,414 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Collections are stored with one record per element, so changing an element
+// does not rewrite the whole collection. The record under the key itself is the
+// head of the collection: its type tag tells the kind of the collection and it
+// names the generation the elements belong to. Deleting or overwriting the
+// head orphans the elements of its generation, merges drop them.
+const (
+	listTag = "l"
+	hashTag = "h"
+	// The elements of a set are its members.
+	setTag = "m"
+	// Queues are numbered like lists, see queue.go.
+	queueTag = "q"
+)
+
+var ErrWrongType = fmt.Errorf("operation against a key holding the wrong kind of value")
+
+type collectionHead struct {
+	tag string
+	gen string
+	// The elements of a list are numbered first to last-1.
+	first, last int64
+	// The messages of a queue from next on were never delivered.
+	next int64
+}
+
+func (h collectionHead) encode() string {
+	if h.tag == queueTag {
+		return fmt.Sprintf("%s %d %d %d%s", h.gen, h.first, h.last, h.next, h.tag)
+	}
+	if h.tag == listTag {
+		return fmt.Sprintf("%s %d %d%s", h.gen, h.first, h.last, h.tag)
+	}
+	return h.gen + h.tag
+}
+
+func parseHead(value string) (collectionHead, error) {
+	h := collectionHead{tag: value[len(value)-1:]}
+	value = value[:len(value)-1]
+	switch h.tag {
+	case hashTag, setTag:
+		h.gen = value
+		return h, nil
+	case listTag:
+		if _, err := fmt.Sscanf(value, "%s %d %d", &h.gen, &h.first, &h.last); err != nil {
+			return h, fmt.Errorf("bad head: %w", err)
+		}
+		return h, nil
+	case queueTag:
+		if _, err := fmt.Sscanf(value, "%s %d %d %d", &h.gen, &h.first, &h.last, &h.next); err != nil {
+			return h, fmt.Errorf("bad head: %w", err)
+		}
+		return h, nil
+	case seriesTag:
+		// Only the generation, for merges. The rest is parsed by
+		// parseSeriesHead.
+		h.gen, _, _ = strings.Cut(value, " ")
+		return h, nil
+	}
+	return h, ErrWrongType
+}
+
+// elementKey is the key of an element record of h. List positions are
+// encoded so that they sort in list order.
+func (h collectionHead) elementKey(key, element string) recordKey {
+	return recordKey{key: key, sub: h.gen + "/" + element}
+}
+
+func (h collectionHead) listKey(key string, pos int64) recordKey {
+	return h.elementKey(key, fmt.Sprintf("%020d", uint64(pos)^1<<63))
+}
+
+// newGeneration names the elements of a new collection, so the elements of a
+// deleted collection under the same key are not taken for its own.
+func newGeneration() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// head returns the head of the collection under key, or a new head when the
+// key does not exist.
+func (db *Db) head(ctx context.Context, key, tag string) (collectionHead, bool, error) {
+	value, err := db.getValue(ctx, recordKey{key: key})
+	if err == ErrNotFound {
+		return collectionHead{tag: tag, gen: newGeneration()}, false, nil
+	} else if err != nil {
+		return collectionHead{}, false, err
+	}
+	h, err := parseHead(value)
+	if err == nil && h.tag != tag {
+		err = ErrWrongType
+	}
+	return h, true, err
+}
+
+func (db *Db) putHead(ctx context.Context, key string, h collectionHead) error {
+	return db.put(ctx, entry{key: key, value: h.encode()})
+}
+
+func (db *Db) putElement(ctx context.Context, key recordKey, value string) error {
+	return db.put(ctx, entry{key: key.key, sub: key.sub, value: value})
+}
+
+// elementLive reports whether the element key belongs to the collection
+// stored under its key according to sealed, and for the chunks of time series
+// whether it is within the retention of the series, see chunkLive. The head
+// values found are remembered in heads. Used by merges: the head of an element
+// is written before it, so it is always found in sealed or in a newer segment.
+func (db *Db) elementLive(sealed []*Segment, key recordKey, heads map[recordKey]string) (bool, error) {
+	if key.sub == "" {
+		return true, nil
+	}
+	headKey := recordKey{bucket: key.bucket, key: key.key}
+	value, ok := heads[headKey]
+	if !ok {
+		var err error
+		if value, err = db.latestValue(sealed, headKey); err != nil {
+			return false, err
+		}
+		heads[headKey] = value
+	}
+	if value == "" {
+		return false, nil
+	}
+	h, err := parseHead(value)
+	if err != nil || h.gen == "" || !strings.HasPrefix(key.sub, h.gen+"/") {
+		return false, nil
+	}
+	if h.tag == seriesTag {
+		return db.chunkLive(sealed, key, value)
+	}
+	return true, nil
+}
+
+// latestValue returns the newest readable value of key in sealed, empty when
+// there is none or it is deleted.
+func (db *Db) latestValue(sealed []*Segment, key recordKey) (string, error) {
+	for i := len(sealed) - 1; i >= 0; i-- {
+		pos, found := sealed[i].index[key]
+		if !found || sealed[i].damageAt(pos.offset) != nil {
+			continue
+		}
+		if pos.deleted || deletedByRange(sealed, i, key, pos.offset) {
+			return "", nil
+		}
+		value, err := sealed[i].getFromSegment(pos.offset)
+		if err == nil && isPointer(value) {
+			value, err = db.vlog.read(decodePointer(value))
+		}
+		return value, err
+	}
+	return "", nil
+}
+
+// elements returns the sorted sub keys of the elements of h.
+func (db *Db) elements(ctx context.Context, key string, h collectionHead) ([]string, error) {
+	op := indexOp{
+		kind: opElements,
+		key:  h.elementKey(key, ""),
+		keys: make(chan []string, 1),
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case db.indexOps <- op:
+	case <-db.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	subs := <-op.keys
+	sort.Strings(subs)
+	return subs, nil
+}
+
+// getElement returns the value of an element without its type tag.
+func (db *Db) getElement(ctx context.Context, key recordKey) (string, error) {
+	value, err := db.getValue(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return value[:len(value)-1], nil
+}
+
+// LPush prepends values to the list under key, so the last one ends up first,
+// and returns the new length of the list.
+func (db *Db) LPush(key string, values ...string) (int, error) {
+	ctx := context.Background()
+	db.collectionsMu.Lock()
+	defer db.collectionsMu.Unlock()
+	h, ok, err := db.head(ctx, key, listTag)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		if err := db.putHead(ctx, key, h); err != nil {
+			return 0, err
+		}
+	}
+	for _, value := range values {
+		// The element is written before the head that makes it part of the
+		// list.
+		if err := db.putElement(ctx, h.listKey(key, h.first-1), value+"s"); err != nil {
+			return 0, err
+		}
+		h.first--
+		if err := db.putHead(ctx, key, h); err != nil {
+			return 0, err
+		}
+	}
+	return int(h.last - h.first), nil
+}
+
+// RPop removes and returns the last element of the list under key. The key is
+// deleted with the last element.
+func (db *Db) RPop(key string) (string, error) {
+	ctx := context.Background()
+	db.collectionsMu.Lock()
+	defer db.collectionsMu.Unlock()
+	h, ok, err := db.head(ctx, key, listTag)
+	if err != nil {
+		return "", err
+	}
+	for ok && h.first < h.last {
+		elementKey := h.listKey(key, h.last-1)
+		value, err := db.getElement(ctx, elementKey)
+		found := err == nil
+		if err != nil && err != ErrNotFound {
+			return "", err
+		}
+		// The element goes first, a crash in between leaves a hole that is
+		// skipped.
+		if found {
+			if err := db.putElement(ctx, elementKey, deleteMarker); err != nil {
+				return "", err
+			}
+		}
+		h.last--
+		if h.first == h.last {
+			err = db.put(ctx, entry{key: key, value: deleteMarker})
+		} else {
+			err = db.putHead(ctx, key, h)
+		}
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return value, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// LRange returns the elements of the list under key from start to stop, both
+// included. Negative positions count from the end of the list, -1 being the
+// last element.
+func (db *Db) LRange(key string, start, stop int) ([]string, error) {
+	ctx := context.Background()
+	h, ok, err := db.head(ctx, key, listTag)
+	if err != nil || !ok {
+		return nil, err
+	}
+	n := int(h.last - h.first)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	var res []string
+	for i := start; i <= stop; i++ {
+		value, err := db.getElement(ctx, h.listKey(key, h.first+int64(i)))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		res = append(res, value)
+	}
+	return res, nil
+}
+
+// HSet sets field of the hash under key.
+func (db *Db) HSet(key, field, value string) error {
+	ctx := context.Background()
+	db.collectionsMu.Lock()
+	defer db.collectionsMu.Unlock()
+	h, ok, err := db.head(ctx, key, hashTag)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := db.putHead(ctx, key, h); err != nil {
+			return err
+		}
+	}
+	return db.putElement(ctx, h.elementKey(key, field), value+"s")
+}
+
+func (db *Db) HGet(key, field string) (string, error) {
+	ctx := context.Background()
+	h, ok, err := db.head(ctx, key, hashTag)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrNotFound
+	}
+	return db.getElement(ctx, h.elementKey(key, field))
+}
+
+// HGetAll returns all fields of the hash under key. It scans the whole index.
+func (db *Db) HGetAll(key string) (map[string]string, error) {
+	ctx := context.Background()
+	h, ok, err := db.head(ctx, key, hashTag)
+	if err != nil || !ok {
+		return nil, err
+	}
+	subs, err := db.elements(ctx, key, h)
+	if err != nil {
+		return nil, err
+	}
+	prefix := h.elementKey(key, "").sub
+	res := make(map[string]string, len(subs))
+	for _, sub := range subs {
+		value, err := db.getElement(ctx, recordKey{key: key, sub: sub})
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		res[strings.TrimPrefix(sub, prefix)] = value
+	}
+	return res, nil
+}
+
+// SAdd adds members to the set under key and returns how many of them were
+// not in it yet.
+func (db *Db) SAdd(key string, members ...string) (int, error) {
+	ctx := context.Background()
+	db.collectionsMu.Lock()
+	defer db.collectionsMu.Unlock()
+	h, ok, err := db.head(ctx, key, setTag)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		if err := db.putHead(ctx, key, h); err != nil {
+			return 0, err
+		}
+	}
+	added := 0
+	for _, member := range members {
+		elementKey := h.elementKey(key, member)
+		if _, err := db.getValue(ctx, elementKey); err == nil {
+			continue
+		} else if err != ErrNotFound {
+			return added, err
+		}
+		if err := db.putElement(ctx, elementKey, "s"); err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+func (db *Db) SIsMember(key, member string) (bool, error) {
+	ctx := context.Background()
+	h, ok, err := db.head(ctx, key, setTag)
+	if err != nil || !ok {
+		return false, err
+	}
+	_, err = db.getValue(ctx, h.elementKey(key, member))
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SMembers returns the members of the set under key, sorted. It scans the
+// whole index.
+func (db *Db) SMembers(key string) ([]string, error) {
+	ctx := context.Background()
+	h, ok, err := db.head(ctx, key, setTag)
+	if err != nil || !ok {
+		return nil, err
+	}
+	subs, err := db.elements(ctx, key, h)
+	if err != nil {
+		return nil, err
+	}
+	prefix := h.elementKey(key, "").sub
+	members := make([]string, len(subs))
+	for i, sub := range subs {
+		members[i] = strings.TrimPrefix(sub, prefix)
+	}
+	return members, nil
+}
@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDb_Collections(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 200, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	t.Run("list", func(t *testing.T) {
+		if n, err := db.LPush("list", "a", "b", "c"); err != nil || n != 3 {
+			t.Fatalf("Bad LPush result %d (%v)", n, err)
+		}
+		if values, err := db.LRange("list", 0, -1); err != nil || !reflect.DeepEqual(values, []string{"c", "b", "a"}) {
+			t.Errorf("Bad list %v (%v)", values, err)
+		}
+		if values, _ := db.LRange("list", -2, 10); !reflect.DeepEqual(values, []string{"b", "a"}) {
+			t.Errorf("Bad range %v", values)
+		}
+		for _, want := range []string{"a", "b", "c"} {
+			if value, err := db.RPop("list"); err != nil || value != want {
+				t.Errorf("Bad RPop result %q (%v), expected %q", value, err, want)
+			}
+		}
+		if _, err := db.RPop("list"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for an empty list, got %v", err)
+		}
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		db.HSet("hash", "f1", "v1")
+		db.HSet("hash", "f2", "v2")
+		db.HSet("hash", "f1", "v3")
+		if value, err := db.HGet("hash", "f1"); err != nil || value != "v3" {
+			t.Errorf("Bad field value %q (%v)", value, err)
+		}
+		if _, err := db.HGet("hash", "f3"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		all, err := db.HGetAll("hash")
+		if err != nil || !reflect.DeepEqual(all, map[string]string{"f1": "v3", "f2": "v2"}) {
+			t.Errorf("Bad hash %v (%v)", all, err)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		if n, err := db.SAdd("set", "x", "y", "x"); err != nil || n != 2 {
+			t.Errorf("Bad SAdd result %d (%v)", n, err)
+		}
+		if ok, err := db.SIsMember("set", "y"); err != nil || !ok {
+			t.Errorf("Expected y to be a member (%v)", err)
+		}
+		if ok, _ := db.SIsMember("set", "z"); ok {
+			t.Errorf("Did not expect z to be a member")
+		}
+		if members, err := db.SMembers("set"); err != nil || !reflect.DeepEqual(members, []string{"x", "y"}) {
+			t.Errorf("Bad members %v (%v)", members, err)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		db.Put("plain", "value")
+		if _, err := db.LPush("plain", "a"); err != ErrWrongType {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+		if _, err := db.SAdd("hash", "a"); err != ErrWrongType {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+		if keys, _ := db.Keys(""); !reflect.DeepEqual(keys, []string{"hash", "plain", "set"}) {
+			t.Errorf("Bad keys %v", keys)
+		}
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		if elementsOnDisk(t, fs, "hash") == 0 {
+			t.Fatal("Expected the fields of the hash on disk")
+		}
+		// Overwriting the hash orphans its fields.
+		db.Put("hash", "plain now")
+		for i := 0; i < 200 && elementsOnDisk(t, fs, "hash") > 0; i++ {
+			db.Put("filler"+strconv.Itoa(i%10), "value")
+			time.Sleep(time.Millisecond)
+		}
+		if n := elementsOnDisk(t, fs, "hash"); n > 0 {
+			t.Errorf("%d orphaned elements were not merged away", n)
+		}
+		if members, _ := db.SMembers("set"); len(members) != 2 {
+			t.Errorf("Set members were lost in merges: %v", members)
+		}
+		db.HSet("hash2", "f", "v")
+		if value, err := db.HGet("hash2", "f"); err != nil || value != "v" {
+			t.Errorf("Bad field value %q (%v)", value, err)
+		}
+	})
+}
+
+func elementsOnDisk(t *testing.T, fs *FaultFS, key string) int {
+	n := 0
+	forEachRecord(t, fs, "/db", func(e entry) {
+		if e.key == key && e.sub != "" {
+			n++
+		}
+	})
+	return n
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Values are compressed one record at a time, so compressed and plaintext
+// records mix freely: the extension marks the compressed ones. A value is
+// only stored compressed when that makes it smaller. Compression comes
+// before encryption, sealed data does not compress.
+const compressMinSize = 64
+
+// CompressionStats describes the values stored in the segment and value-log
+// files, the superseded ones included until merges drop them.
+type CompressionStats struct {
+	// Records counts the records, Compressed the ones stored compressed.
+	Records, Compressed int
+	// RawBytes is the size of the values, StoredBytes the size they take in
+	// the files, encryption aside.
+	RawBytes, StoredBytes int64
+}
+
+// Ratio is RawBytes over StoredBytes, 1 when nothing is stored.
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+func (s *CompressionStats) add(raw, stored int64) {
+	s.Records++
+	if stored != raw {
+		s.Compressed++
+	}
+	s.RawBytes += raw
+	s.StoredBytes += stored
+}
+
+func (s *CompressionStats) merge(other CompressionStats) {
+	s.Records += other.Records
+	s.Compressed += other.Compressed
+	s.RawBytes += other.RawBytes
+	s.StoredBytes += other.StoredBytes
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// deflate returns the compressed value, ok is false when compressing does
+// not pay off.
+func deflate(value string) (string, bool) {
+	if len(value) < compressMinSize {
+		return "", false
+	}
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := io.WriteString(w, value); err != nil {
+		return "", false
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return "", false
+	}
+	return buf.String(), true
+}
+
+func inflate(value string) (string, error) {
+	r := flate.NewReader(strings.NewReader(value))
+	defer r.Close()
+	var sb strings.Builder
+	if _, err := io.Copy(&sb, r); err != nil {
+		return "", errCorrupted
+	}
+	return sb.String(), nil
+}
+
+// packer turns records into the form written to the files and back: the
+// value is compressed first, then the record is sealed.
+type packer struct {
+	compress bool
+	keyring  *Keyring
+}
+
+// pack returns the stored form of e and the size of its value in it,
+// encryption aside.
+func (p packer) pack(e entry) (entry, int64) {
+	if p.compress {
+		if value, ok := deflate(e.value); ok {
+			e.value, e.compressed = value, true
+		}
+	}
+	stored := int64(len(e.value))
+	return p.keyring.sealEntry(e), stored
+}
+
+// unpack reverses pack, it returns the record and the size of the value in
+// the file.
+func (p packer) unpack(e entry) (entry, int64, error) {
+	e, err := p.keyring.openEntry(e)
+	if err != nil {
+		return entry{}, 0, err
+	}
+	stored := int64(len(e.value))
+	if e.compressed {
+		if e.value, err = inflate(e.value); err != nil {
+			return entry{}, 0, err
+		}
+		e.compressed = false
+	}
+	return e, stored, nil
+}
+
+// CompressionStats sums up how the values of the files are stored.
+func (db *Db) CompressionStats() (CompressionStats, error) {
+	op := indexOp{kind: opCompressionStats, compression: make(chan CompressionStats, 1)}
+	select {
+	case db.indexOps <- op:
+	case <-db.closed:
+		return CompressionStats{}, ErrClosed
+	}
+	stats := <-op.compression
+	_, vlogStats, err := db.vlog.info()
+	if err != nil {
+		return CompressionStats{}, err
+	}
+	stats.merge(vlogStats)
+	return stats, nil
+}
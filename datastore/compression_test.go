@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Compression(t *testing.T) {
+	fs := NewFaultFS(1)
+	opts := Options{FS: fs, Compression: true, ValueLogThreshold: 512}
+	db, err := NewDbWithOptions("/db", 1000, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	doc := func(i int) string {
+		items := strings.Repeat(`{"sku": "book", "quantity": 1, "price": 10}, `, 4)
+		return fmt.Sprintf(`{"id": %d, "status": "paid", "items": [%s]}`, i, items[:len(items)-2])
+	}
+	big := strings.Repeat(doc(0), 20)
+
+	t.Run("round trip", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			db.Put("order"+strconv.Itoa(i), doc(i))
+		}
+		db.Put("small", "v")
+		db.Put("big", big)
+		for i := 0; i < 5; i++ {
+			if v, err := db.Get("order" + strconv.Itoa(i)); err != nil || v != doc(i) {
+				t.Errorf("Bad value %q (%v)", v, err)
+			}
+		}
+		if v, err := db.Get("small"); err != nil || v != "v" {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+		if r, err := db.GetReader("big"); err != nil {
+			t.Error(err)
+		} else if data, _ := io.ReadAll(r); string(data) != big {
+			t.Errorf("Bad value log value %q", data)
+		}
+		stats, err := db.CompressionStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The pointer to the big value and the small value stay as they are.
+		if stats.Records != 8 || stats.Compressed != 6 || stats.Ratio() < 1.5 {
+			t.Errorf("Bad stats %+v, ratio %.2f", stats, stats.Ratio())
+		}
+	})
+
+	t.Run("mixed records", func(t *testing.T) {
+		before, _ := db.CompressionStats()
+		db.Close()
+		opts.Compression = false
+		if db, err = NewDbWithOptions("/db", 1000, opts); err != nil {
+			t.Fatal(err)
+		}
+		if stats, _ := db.CompressionStats(); stats != before {
+			t.Errorf("Stats changed on reopening: %+v, was %+v", stats, before)
+		}
+		db.Put("plain", doc(9))
+		if v, err := db.Get("order1"); err != nil || v != doc(1) {
+			t.Errorf("Bad compressed value %q (%v)", v, err)
+		}
+		if stats, _ := db.CompressionStats(); stats.Records != before.Records+1 || stats.Compressed != before.Compressed {
+			t.Errorf("Expected an uncompressed record, got %+v", stats)
+		}
+	})
+
+	t.Run("merges compress", func(t *testing.T) {
+		db.Close()
+		opts.Compression = true
+		if db, err = NewDbWithOptions("/db", 1000, opts); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			if stats, _ := db.CompressionStats(); stats.Compressed == stats.Records-2 && i > 10 {
+				break
+			}
+			db.Put("order"+strconv.Itoa(i%5), doc(i%5))
+			time.Sleep(time.Millisecond)
+		}
+		// All but the pointer to the big value and the small value.
+		if stats, _ := db.CompressionStats(); stats.Compressed != stats.Records-2 {
+			t.Errorf("Expected merges to compress the plain records, got %+v", stats)
+		}
+		if v, err := db.Get("plain"); err != nil || v != doc(9) {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+	})
+
+	t.Run("with encryption", func(t *testing.T) {
+		db.Close()
+		opts.Keyring, _ = ParseKeyring("1:" + strings.Repeat("11", 32))
+		if db, err = NewDbWithOptions("/db", 1000, opts); err != nil {
+			t.Fatal(err)
+		}
+		db.Put("sealed", doc(7))
+		db.Put("big2", big)
+		if v, err := db.Get("sealed"); err != nil || v != doc(7) {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+		if v, err := db.Get("big2"); err != nil || v != big {
+			t.Errorf("Bad value log value %q (%v)", v, err)
+		}
+		db.Close()
+		if db, err = NewDbWithOptions("/db", 1000, opts); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := db.Get("sealed"); err != nil || v != doc(7) {
+			t.Errorf("Bad value after reopening %q (%v)", v, err)
+		}
+	})
+}
@@ -2,266 +2,1067 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	outFileName  = "current-data"
+	lockFileName = "LOCK"
+	mergedSuffix = ".merged"
+	tmpSuffix    = ".tmp"
 	bufSize      = 8192
 	deleteMarker = "DELETE"
 )
 
-type hashIndex map[string]int64
+// recordKey identifies a record, keys are unique within a bucket. The default
+// bucket has id 0.
+type recordKey struct {
+	bucket uint32
+	key    string
+	sub    string
+}
+
+type recordPos struct {
+	offset  int64
+	size    int64
+	deleted bool
+	operand bool
+	// keyID is the key sealing the record, 0 when it is not encrypted.
+	keyID uint32
+}
+
+type hashIndex map[recordKey]recordPos
+
+type indexOpKind int
+
+const (
+	opNone indexOpKind = iota
+	opLookup
+	opSet
+	opAddSegment
+	opMerged
+	opStats
+	opHistory
+	opKeys
+	opElements
+	opKeysInUse
+	opCompressionStats
+	opPinSealed
+	opDeleteRange
+)
 
 type indexOp struct {
-	isWrite bool
-	key     string
-	index   int64
+	kind    indexOpKind
+	key     recordKey
+	pos     recordPos
+	segment *Segment
+	merge   *mergeResult
+	done    chan struct{}
+	resp    chan *keyPosition
+	stats   chan BucketStats
+	history chan []versionRef
+	keys    chan []string
+	keyIDs  chan map[uint32]bool
+	version uint64
+	time    int64
+	// end is the end of the range of an opDeleteRange.
+	end string
+	// raw and stored are the sizes of the value set, see CompressionStats.
+	raw, stored int64
+	compression chan CompressionStats
+	sealed      chan []*Segment
 }
 
-type deleteOp struct {
-	key  string
-	resp chan error
+type putOp struct {
+	entry entry
+	// relocate makes the put conditional: it is skipped unless the key
+	// still refers to this value-log copy.
+	relocate *valuePointer
+	// batch is written in place of entry, with a single sync at the end.
+	batch []entry
+	resp  chan error
 }
 
 type keyPosition struct {
 	segment  *Segment
 	position int64
+	// operands are the merge operands to fold into the value.
+	operands []keyPosition
+	// damaged is set when a newer record of the key is quarantined.
+	damaged *CorruptionError
+}
+
+type mergeResult struct {
+	merged   *Segment
+	replaced []*Segment
+}
+
+// Options tunes a Db. The zero value gives the behaviour of NewDb.
+type Options struct {
+	// FS is the filesystem holding the segment files, the OS one when nil.
+	FS FS
+	// NoSync skips fsync after every put. Acknowledged writes can then be
+	// lost on a crash.
+	NoSync bool
+	// ReadOnly opens the directory without taking the writer lock, so it can
+	// be shared with the single process writing to it. The Db sees the data
+	// present when it was opened and rejects puts with ErrReadOnly.
+	ReadOnly bool
+	// ValueLogThreshold enables the value log: values longer than it are
+	// kept in separate value-log files and segments only store a pointer.
+	// The typed values recording their type stay in the segments.
+	ValueLogThreshold int64
+	// ValueLogFileSize is the size at which a new value-log file is
+	// started, 64MB when zero.
+	ValueLogFileSize int64
+	// KeepVersions makes merges retain the last KeepVersions versions of
+	// every key for History and GetAt, instead of only the current one.
+	KeepVersions int
+	// KeepFor makes merges retain the versions written within this window.
+	// Used together with KeepVersions, a version is kept when either policy
+	// asks for it.
+	KeepFor time.Duration
+	// CacheSize enables an LRU cache of recently read values holding up to
+	// this many bytes of them.
+	CacheSize int64
+	// MergeOperator folds the operands written by Merge into values.
+	MergeOperator MergeOperator
+	// Keyring enables encryption at rest: records are written sealed with
+	// its active key. Plaintext records and the records sealed with the
+	// other keys of the keyring stay readable, merges rewrite them.
+	Keyring *Keyring
+	// Compression stores values deflated when that makes them smaller.
+	// Records written either way stay readable, merges rewrite them.
+	Compression bool
+	// ScrubInterval runs Scrub in the background at this interval, never
+	// when zero.
+	ScrubInterval time.Duration
+	// AuditLog enables the audit log, see Audit. Its files are started anew
+	// once they reach AuditFileSize, 16MB when zero, or once their first
+	// entry is older than AuditFileAge, when set.
+	AuditLog      bool
+	AuditFileSize int64
+	AuditFileAge  time.Duration
+	// MaxBytes turns the Db into a cache: once the live records of plain
+	// values take more than MaxBytes in the segments, their keys are deleted
+	// in the order Eviction ranks them. Collections, queues, time series,
+	// blobs, locks and the value-log copies of values are neither counted
+	// nor evicted. A ShardedDb applies MaxBytes, like CacheSize, to each of
+	// its shards.
+	MaxBytes int64
+	Eviction EvictionPolicy
 }
 
 type Db struct {
-	out              *os.File
-	outPath          string
+	fs               FS
+	noSync           bool
+	batching         bool // syncs deferred to the end of a batch, see writeBatch
+	readOnly         bool
+	lock             io.Closer
+	out              File
 	outOffset        int64
 	dir              string
 	segmentSize      int64
 	lastSegmentIndex int
 	indexOps         chan indexOp
-	keyPositions     chan *keyPosition
-	putOps           chan entry
-	deleteOps        chan deleteOp
-	putDone          chan error
-	index            hashIndex
+	putOps           chan putOp
+	activeSegment    *Segment
 	segments         []*Segment
+	vlog             *valueLog
+	audit            *auditLog
+	evictor          *evictor
+	vlogThreshold    int64
+	cache            *valueCache
+	mergeOp          MergeOperator
+	packer           packer
+	versioned        bool
+	keepVersions     int
+	keepFor          time.Duration
+	lastVersion      uint64
+	collecting       atomic.Bool
+	collectionsMu    sync.Mutex
+	queues           map[string]*flights // guarded by collectionsMu
+	blobsMu          sync.Mutex
+	blobRefsMu       sync.RWMutex
+	blobRefs         map[string]*chunkRefs
+	indexDefsMu      sync.Mutex
+	indexesMu        sync.RWMutex
+	indexes          map[string]*secondaryIndex
+	scrubMu          sync.Mutex
+	scrubStatsMu     sync.Mutex
+	scrubStats       ScrubStats
+	bucketsMu        sync.RWMutex
+	buckets          map[string]uint32
+	bucketNames      map[uint32]string
+	nextBucket       uint32
+	merging          bool
+	closeOnce        sync.Once
+	closed           chan struct{}
+	stopIndex        chan struct{}
+	putStopped       chan struct{}
+	indexStopped     chan struct{}
+	background       sync.WaitGroup
 }
 
 type Segment struct {
-	outOffset int64
-	index     hashIndex
-	filePath  string
+	id       int
+	merged   bool
+	format   segmentFormat
+	file     File
+	index    hashIndex
+	versions versionIndex
+	chains   map[recordKey]*operandChain
+	// ranges lists the range tombstones of the segment in file order.
+	ranges []rangeTombstone
+	packer packer
+	// sealedWith tells the keys sealing the records of the file, 0 for
+	// plaintext records.
+	sealedWith  map[uint32]bool
+	compression CompressionStats
+	filePath    string
+	readers     sync.WaitGroup
+	// damaged lists the ranges found corrupted by the scrubber.
+	damagedMu sync.RWMutex
+	damaged   []DamagedRange
 }
 
 var (
 	ErrNotFound = fmt.Errorf("record does not exist")
+	ErrClosed   = fmt.Errorf("database is closed")
+	ErrLocked   = fmt.Errorf("database directory is locked by another process")
+	ErrReadOnly = fmt.Errorf("database is opened read-only")
+
+	errTornRecord = errors.New("torn record")
 )
 
 func NewDb(dir string, segmentSize int64) (*Db, error) {
+	return NewDbWithOptions(dir, segmentSize, Options{})
+}
+
+func NewDbWithOptions(dir string, segmentSize int64, opts Options) (*Db, error) {
+	fs := opts.FS
+	if fs == nil {
+		fs = osFS{}
+	}
 	db := &Db{
-		segments:     make([]*Segment, 0),
-		dir:          dir,
-		segmentSize:  segmentSize,
-		indexOps:     make(chan indexOp),
-		keyPositions: make(chan *keyPosition),
-		putOps:       make(chan entry),
-		putDone:      make(chan error),
-		deleteOps:    make(chan deleteOp),
+		fs:            fs,
+		noSync:        opts.NoSync,
+		readOnly:      opts.ReadOnly,
+		vlogThreshold: opts.ValueLogThreshold,
+		versioned:     opts.KeepVersions > 0 || opts.KeepFor > 0,
+		keepVersions:  opts.KeepVersions,
+		keepFor:       opts.KeepFor,
+		mergeOp:       opts.MergeOperator,
+		packer:        packer{compress: opts.Compression, keyring: opts.Keyring},
+		segments:      make([]*Segment, 0),
+		dir:           dir,
+		segmentSize:   segmentSize,
+		indexOps:      make(chan indexOp),
+		putOps:        make(chan putOp),
+		closed:        make(chan struct{}),
+		stopIndex:     make(chan struct{}),
+		putStopped:    make(chan struct{}),
+		indexStopped:  make(chan struct{}),
 	}
 
-	if err := db.createNewSegment(); err != nil {
-		return nil, err
+	if opts.CacheSize > 0 {
+		db.cache = newValueCache(opts.CacheSize)
+	}
+
+	if !db.readOnly {
+		lock, err := fs.Lock(filepath.Join(dir, lockFileName))
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", dir, err)
+		}
+		db.lock = lock
 	}
 
-	if err := db.recover(); err != nil && err != io.EOF {
+	err := db.recover()
+	if err == nil {
+		err = db.loadBuckets()
+	}
+	if err == nil {
+		err = db.loadIndexes()
+	}
+	if err == nil {
+		db.vlog, err = openValueLog(fs, dir, opts.ValueLogFileSize, opts.NoSync, opts.ReadOnly, db.packer)
+	}
+	if err == nil {
+		err = db.loadBlobs()
+	}
+	if err == nil && opts.AuditLog {
+		db.audit, err = openAuditLog(fs, dir, opts, db.packer)
+	}
+	if err == nil && opts.MaxBytes > 0 && !db.readOnly {
+		err = db.loadEvictor(opts.Eviction, opts.MaxBytes)
+	}
+	if err != nil {
+		if db.audit != nil {
+			db.audit.close()
+		}
+		if db.vlog != nil {
+			db.vlog.close()
+		}
+		for _, s := range db.segments {
+			s.file.Close()
+		}
+		if db.lock != nil {
+			db.lock.Close()
+		}
 		return nil, err
 	}
 
 	db.IndexGoroutine()
 	db.PutGoroutine()
+	if opts.ScrubInterval > 0 {
+		db.scrubber(opts.ScrubInterval)
+	}
 
+	indexes := make([]*secondaryIndex, 0, len(db.indexes))
+	for _, idx := range db.indexes {
+		indexes = append(indexes, idx)
+	}
+	if err := db.fillIndexes(indexes...); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("rebuild indexes: %w", err)
+	}
 	return db, nil
 }
 
+// Close lets in-flight puts finish, cancels a running merge, stops the
+// background goroutines and closes all segment files. Any call made after
+// Close returns ErrClosed.
 func (db *Db) Close() error {
-	return db.out.Close()
+	err := ErrClosed
+	db.closeOnce.Do(func() {
+		close(db.closed)
+		<-db.putStopped
+		close(db.stopIndex)
+		<-db.indexStopped
+		db.background.Wait()
+
+		err = nil
+		for _, s := range db.segments {
+			s.readers.Wait()
+			if cerr := s.file.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		if cerr := db.vlog.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if db.audit != nil {
+			if cerr := db.audit.close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		if db.lock != nil {
+			if cerr := db.lock.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (db *Db) isClosed() bool {
+	select {
+	case <-db.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 func (db *Db) IndexGoroutine() {
 	go func() {
-		for op := range db.indexOps {
-			if op.isWrite {
-				db.setKey(op.key, op.index)
-			} else {
-				s, p, err := db.getSegmentAndPos(op.key)
-				if err != nil {
-					db.keyPositions <- nil
-				} else {
-					db.keyPositions <- &keyPosition{s, p}
-				}
+		defer close(db.indexStopped)
+		stop, stopping := db.stopIndex, false
+		for {
+			var op indexOp
+			select {
+			case op = <-db.indexOps:
+			case <-stop:
+				stop, stopping = nil, true
+			}
+			if op.kind != opNone {
+				db.handleIndexOp(op)
+			}
+			// A running merge still has to report back, it notices the
+			// close and gives up quickly.
+			if stopping && !db.merging {
+				return
 			}
 		}
 	}()
 }
 
+func (db *Db) handleIndexOp(op indexOp) {
+	switch op.kind {
+	case opLookup:
+		kp := findChain(db.segments, op.key)
+		if kp != nil {
+			kp.pin()
+		}
+		op.resp <- kp
+	case opSet:
+		op.segment.addRecord(op.key, versionPos{op.pos, op.version, op.time})
+		op.segment.compression.add(op.raw, op.stored)
+	case opDeleteRange:
+		op.segment.addRange(rangeTombstone{
+			bucket:     op.key.bucket,
+			start:      op.key.key,
+			end:        op.end,
+			versionPos: versionPos{op.pos, op.version, op.time},
+		})
+		op.segment.compression.add(op.raw, op.stored)
+	case opAddSegment:
+		db.segments = append(db.segments, op.segment)
+		close(op.done)
+		db.maybeMerge()
+	case opMerged:
+		// A failed merge is retried with the next new segment.
+		db.merging = false
+		if op.merge != nil {
+			db.applyMerge(op.merge)
+			db.maybeMerge()
+		}
+		close(op.done)
+	case opStats:
+		var stats BucketStats
+		db.scanBucket(op.key.bucket, func(key recordKey, pos recordPos) {
+			if key.sub == "" {
+				stats.Keys++
+			}
+			stats.Bytes += pos.size
+		})
+		op.stats <- stats
+	case opKeys:
+		var keys []string
+		db.scanBucket(op.key.bucket, func(key recordKey, _ recordPos) {
+			if key.sub == "" && strings.HasPrefix(key.key, op.key.key) {
+				keys = append(keys, key.key)
+			}
+		})
+		op.keys <- keys
+	case opElements:
+		var subs []string
+		db.scanBucket(op.key.bucket, func(key recordKey, _ recordPos) {
+			if key.key == op.key.key && key.sub != "" && strings.HasPrefix(key.sub, op.key.sub) {
+				subs = append(subs, key.sub)
+			}
+		})
+		op.keys <- subs
+	case opHistory:
+		op.history <- db.versionRefs(op.key)
+	case opKeysInUse:
+		inUse := make(map[uint32]bool)
+		for _, s := range db.segments {
+			for id := range s.sealedWith {
+				inUse[id] = true
+			}
+		}
+		op.keyIDs <- inUse
+	case opCompressionStats:
+		var stats CompressionStats
+		for _, s := range db.segments {
+			stats.merge(s.compression)
+		}
+		op.compression <- stats
+	case opPinSealed:
+		// The last segment is the one written to, by this Db or by the
+		// writer of a read-only one.
+		var sealed []*Segment
+		if n := len(db.segments); n > 1 {
+			sealed = append(sealed, db.segments[:n-1]...)
+		}
+		for _, s := range sealed {
+			s.readers.Add(1)
+		}
+		op.sealed <- sealed
+	}
+}
+
 func (db *Db) PutGoroutine() {
 	go func() {
+		defer close(db.putStopped)
 		for {
-			e := <-db.putOps
-			length := e.GetLength()
-			stat, err := db.out.Stat()
-			if err != nil {
-				db.putDone <- err
-				continue
-			}
-			if stat.Size()+length > db.segmentSize {
-				err := db.createNewSegment()
-				if err != nil {
-					db.putDone <- err
-					continue
-				}
-			}
-			n, err := db.out.Write(e.Encode())
-			if err == nil {
-				db.indexOps <- indexOp{
-					isWrite: true,
-					key:     e.key,
-					index:   int64(n),
+			select {
+			case op := <-db.putOps:
+				err := db.handlePut(op)
+				if err == nil {
+					db.evict()
 				}
+				op.resp <- err
+			case <-db.closed:
+				return
 			}
-			db.putDone <- nil
 		}
 	}()
 }
 
-func (db *Db) createNewSegment() error {
-	filePath := db.generateNewFileName()
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0777)
+func (db *Db) handlePut(op putOp) error {
+	if op.relocate != nil {
+		current, operands, err := db.getRaw(context.Background(), op.entry.recordKey(), (*Segment).getFromSegment)
+		if err == ErrNotFound || (err == nil && current != op.relocate.encode()) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := db.write(op.entry); err != nil {
+			return err
+		}
+		// The operands merged into the value stay on top of it.
+		for _, operand := range operands {
+			e := op.entry
+			e.value, e.version, e.time = operand, 0, 0
+			if err := db.write(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if op.batch != nil {
+		return db.writeBatch(op.batch)
+	}
+	return db.write(op.entry)
+}
+
+// writeBatch writes the entries in order and syncs once. The entries written
+// before a failure stay written.
+func (db *Db) writeBatch(entries []entry) error {
+	db.batching = true
+	defer func() { db.batching = false }()
+	for _, e := range entries {
+		if err := db.write(e); err != nil {
+			return err
+		}
+	}
+	if db.noSync {
+		return nil
+	}
+	return db.out.Sync()
+}
+
+func (db *Db) write(e entry) error {
+	value := e.value
+	// Relocated values keep their version.
+	if db.versioned && e.version == 0 {
+		db.lastVersion++
+		e.version, e.time = db.lastVersion, time.Now().UnixNano()
+	}
+	if db.vlogThreshold > 0 && int64(len(e.value)) > db.vlogThreshold && e.bucket != metaBucket && !isOperand(e.value) && !e.deleteRange && e.typ == "" {
+		p, rotated, err := db.vlog.append(e)
+		if err != nil {
+			return err
+		}
+		if rotated {
+			db.maybeCollectValueLog()
+		}
+		e.value = p.encode()
+	}
+
+	rec, stored := db.packer.pack(e)
+	format := db.activeSegment.format
+	if db.outOffset > format.start() && db.outOffset+rec.GetLength()+format.trailer() > db.segmentSize {
+		// The batch written so far is synced before its segment is left.
+		if db.batching && !db.noSync {
+			if err := db.out.Sync(); err != nil {
+				return err
+			}
+		}
+		s, err := db.createNewSegment()
+		if err != nil {
+			return err
+		}
+		// Registered once the first record is written, so the merge it may
+		// trigger starts after the put is durable.
+		defer func() {
+			done := make(chan struct{})
+			db.indexOps <- indexOp{kind: opAddSegment, segment: s, done: done}
+			<-done
+		}()
+	}
+
+	n, err := db.out.Write(db.activeSegment.format.encode(rec))
+	if err == nil && !db.noSync && !db.batching {
+		err = db.out.Sync()
+	}
 	if err != nil {
+		// Cut off whatever part of the record reached the file, otherwise the
+		// records appended after it could not be read back on recovery.
+		if terr := db.out.Truncate(db.outOffset); terr != nil {
+			return fmt.Errorf("%w (truncate: %s)", err, terr)
+		}
 		return err
 	}
 
+	op := indexOp{
+		kind: opSet,
+		key:  e.recordKey(),
+		pos: recordPos{
+			offset:  db.outOffset,
+			size:    int64(n),
+			deleted: e.value == deleteMarker,
+			operand: isOperand(e.value),
+			keyID:   rec.keyID(),
+		},
+		version: e.version,
+		time:    e.time,
+		segment: db.activeSegment,
+		raw:     int64(len(e.value)),
+		stored:  stored,
+	}
+	if e.deleteRange {
+		op.kind, op.end = opDeleteRange, e.value
+		op.pos.deleted, op.pos.operand = false, false
+	}
+	db.indexOps <- op
+	db.outOffset += int64(n)
+	db.updateIndexes(e, value)
+	if db.evictor != nil {
+		db.evictor.written(e, int64(n))
+	}
+	return nil
+}
+
+func (db *Db) createNewSegment() (*Segment, error) {
+	id := db.lastSegmentIndex
+	filePath := db.segmentPath(id, "")
+	f, err := db.fs.OpenFile(filePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSegmentHeader(f, currentFormat); err != nil {
+		f.Close()
+		db.fs.Remove(filePath)
+		return nil, err
+	}
+	db.lastSegmentIndex++
+
 	newSegment := &Segment{
+		id:       id,
+		format:   currentFormat,
+		file:     f,
 		filePath: filePath,
 		index:    make(hashIndex),
+		versions: db.newVersionIndex(),
+		packer:   db.packer,
 	}
 
 	db.out = f
-	db.outOffset = 0
-	db.outPath = filePath
-	db.segments = append(db.segments, newSegment)
-	if len(db.segments) >= 3 {
-		db.mergeOldSegments()
-	}
+	db.outOffset = newSegment.format.start()
+	db.activeSegment = newSegment
+	return newSegment, nil
+}
 
-	return nil
+func (db *Db) segmentPath(id int, suffix string) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%s%d%s", outFileName, id, suffix))
 }
 
-func (db *Db) generateNewFileName() string {
-	result := filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, db.lastSegmentIndex))
-	db.lastSegmentIndex++
-	return result
+func (db *Db) maybeMerge() {
+	if db.merging || len(db.segments) < 3 || db.isClosed() {
+		return
+	}
+	db.merging = true
+	sealed := make([]*Segment, len(db.segments)-1)
+	copy(sealed, db.segments)
+	db.mergeOldSegments(sealed)
 }
 
-func (db *Db) mergeOldSegments() {
+func (db *Db) mergeOldSegments(sealed []*Segment) {
+	db.background.Add(1)
 	go func() {
-		filePath := db.generateNewFileName()
-		newSegment := &Segment{
-			filePath: filePath,
-			index:    make(hashIndex),
+		defer db.background.Done()
+		// Let the put that sealed the segments complete first.
+		runtime.Gosched()
+		op := indexOp{kind: opMerged, done: make(chan struct{})}
+		if merged, err := db.mergeSegments(sealed); err == nil {
+			op.merge = &mergeResult{merged: merged, replaced: sealed}
 		}
-		var offset int64
-		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+		db.indexOps <- op
+		<-op.done
+	}()
+}
+
+// mergeSegments writes the live records of sealed into a single segment that
+// takes the place of the newest of them. Deleted keys, the keys of dropped
+// buckets, unreferenced blob chunks and versions past the retention policy
+// are left out. The rename of
+// the output to its final name is the commit point: on recovery a merged
+// segment supersedes every segment with a lower or equal id.
+func (db *Db) mergeSegments(sealed []*Segment) (*Segment, error) {
+	last := sealed[len(sealed)-1]
+	tmpPath := db.segmentPath(last.id, mergedSuffix+tmpSuffix)
+	f, err := db.fs.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*Segment, error) {
+		f.Close()
+		db.fs.Remove(tmpPath)
+		return nil, err
+	}
+
+	newSegment := &Segment{
+		id:       last.id,
+		merged:   true,
+		format:   currentFormat,
+		file:     f,
+		filePath: db.segmentPath(last.id, mergedSuffix),
+		index:    make(hashIndex),
+		versions: db.newVersionIndex(),
+		packer:   db.packer,
+	}
+	if _, err := f.Write(segmentHeader(newSegment.format)); err != nil {
+		return fail(err)
+	}
+	offset := newSegment.format.start()
+	// The records are packed anew, sealed with the active key, in the
+	// current format.
+	add := func(e entry) error {
+		rec, stored := db.packer.pack(e)
+		n, err := f.Write(newSegment.format.encode(rec))
 		if err != nil {
-			return
-		}
-		lastSegmentIndex := len(db.segments) - 2
-		for i := 0; i <= lastSegmentIndex; i++ {
-			s := db.segments[i]
-			for key, index := range s.index {
-				if i < lastSegmentIndex {
-					isInNewerSegments := findKeyInSegments(db.segments[i+1:lastSegmentIndex+1], key)
-					if isInNewerSegments {
-						continue
-					}
-				}
-				value, _ := s.getFromSegment(index)
-				if value == deleteMarker {
-					continue
-				}
-				e := entry{
-					key:   key,
-					value: value,
-				}
-				n, err := f.Write(e.Encode())
-				if err == nil {
-					newSegment.index[key] = offset
-					offset += int64(n)
+			return err
+		}
+		pos := recordPos{
+			offset:  offset,
+			size:    int64(n),
+			deleted: e.value == deleteMarker,
+			operand: isOperand(e.value),
+			keyID:   rec.keyID(),
+		}
+		newSegment.addRecord(e.recordKey(), versionPos{pos, e.version, e.time})
+		newSegment.compression.add(int64(len(e.value)), stored)
+		offset += int64(n)
+		return nil
+	}
+
+	if db.versioned {
+		err = db.mergeVersions(sealed, add)
+	} else {
+		err = db.mergeLatest(sealed, add)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := db.fs.Rename(tmpPath, newSegment.filePath); err != nil {
+		return fail(err)
+	}
+	return newSegment, nil
+}
+
+// mergeLatest passes the newest value of every live key of sealed to add.
+func (db *Db) mergeLatest(sealed []*Segment, add func(entry) error) error {
+	heads := make(map[recordKey]string)
+	for i, s := range sealed {
+		for key, pos := range s.index {
+			if db.isClosed() {
+				return ErrClosed
+			}
+			// Damaged records are dropped, older copies take their place.
+			if pos.deleted || s.damageAt(pos.offset) != nil || !db.bucketLive(key.bucket) || !db.blobLive(key) ||
+				findKeyInSegments(sealed[i+1:], key) || deletedByRange(sealed, i, key, pos.offset) {
+				continue
+			}
+			if live, err := db.elementLive(sealed, key, heads); err != nil {
+				return err
+			} else if !live {
+				continue
+			}
+			if pos.operand {
+				if err := db.mergeChain(sealed[:i+1], key, add); err != nil {
+					return err
 				}
+				continue
+			}
+			stored, err := s.readRecord(pos.offset)
+			if err != nil {
+				return err
+			}
+			e := entry{
+				key:    key.key,
+				sub:    key.sub,
+				value:  stored.value,
+				bucket: key.bucket,
+				typ:    stored.typ,
+			}
+			if err := add(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *Db) applyMerge(m *mergeResult) {
+	replaced := make(map[*Segment]bool, len(m.replaced))
+	for _, s := range m.replaced {
+		replaced[s] = true
+	}
+	segments := []*Segment{m.merged}
+	for _, s := range db.segments {
+		if !replaced[s] {
+			segments = append(segments, s)
+		}
+	}
+	db.segments = segments
+
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		for _, s := range m.replaced {
+			s.readers.Wait()
+			s.file.Close()
+			if db.cache != nil {
+				db.cache.dropSegment(s)
+			}
+			if s.filePath != m.merged.filePath {
+				db.fs.Remove(s.filePath)
 			}
 		}
-		db.segments = []*Segment{newSegment, db.getLastSegment()}
 	}()
 }
 
-func findKeyInSegments(segments []*Segment, key string) bool {
+func findKeyInSegments(segments []*Segment, key recordKey) bool {
 	for _, s := range segments {
-		if _, ok := s.index[key]; ok {
+		if pos, ok := s.index[key]; ok && s.damageAt(pos.offset) == nil {
 			return true
 		}
 	}
 	return false
 }
 
+type segmentFile struct {
+	id     int
+	merged bool
+	name   string
+}
+
+func parseSegmentName(name string) (segmentFile, bool) {
+	rest, ok := strings.CutPrefix(name, outFileName)
+	if !ok {
+		return segmentFile{}, false
+	}
+	rest, merged := strings.CutSuffix(rest, mergedSuffix)
+	id, err := strconv.Atoi(rest)
+	if err != nil || id < 0 {
+		return segmentFile{}, false
+	}
+	return segmentFile{id: id, merged: merged, name: name}, true
+}
+
+// recover loads every segment of the directory. Leftovers of interrupted
+// merges are removed and a torn record at the end of the last segment is cut
+// off. A read-only Db leaves the files alone, they belong to the writer.
 func (db *Db) recover() error {
+	if !db.readOnly {
+		return db.loadSegments()
+	}
+	// The writer may merge segments away while they are being opened.
 	var err error
-	var buf [bufSize]byte
-
-	in := bufio.NewReaderSize(db.out, bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
-		} else if err != nil {
+	for attempt := 0; attempt < 5; attempt++ {
+		if err = db.loadSegments(); !errors.Is(err, os.ErrNotExist) {
 			return err
 		}
-		size := binary.LittleEndian.Uint32(header)
+		for _, s := range db.segments {
+			s.file.Close()
+		}
+		db.segments = db.segments[:0]
+	}
+	return err
+}
 
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
+func (db *Db) loadSegments() error {
+	names, err := db.fs.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+
+	var files []segmentFile
+	base := -1
+	for _, name := range names {
+		if strings.HasPrefix(name, outFileName) && strings.HasSuffix(name, tmpSuffix) {
+			if err := db.removeStale(name); err != nil {
+				return err
+			}
+			continue
+		}
+		sf, ok := parseSegmentName(name)
+		if !ok {
+			continue
+		}
+		if sf.merged && sf.id > base {
+			base = sf.id
 		}
-		n, err = in.Read(data)
+		files = append(files, sf)
+	}
 
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
+	live := files[:0]
+	for _, sf := range files {
+		if sf.id < base || (sf.id == base && !sf.merged) {
+			if err := db.removeStale(sf.name); err != nil {
+				return err
 			}
+			continue
+		}
+		live = append(live, sf)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].id < live[j].id })
 
-			var e entry
-			e.Decode(data)
-			db.setKey(e.key, int64(n))
+	for i, sf := range live {
+		isLast := i == len(live)-1
+		flag := os.O_RDONLY
+		if isLast && !sf.merged && !db.readOnly {
+			flag = os.O_RDWR | os.O_APPEND
+		}
+		filePath := filepath.Join(db.dir, sf.name)
+		f, err := db.fs.OpenFile(filePath, flag, 0o600)
+		if err != nil {
+			return err
+		}
+		s := &Segment{
+			id:       sf.id,
+			merged:   sf.merged,
+			file:     f,
+			filePath: filePath,
+			index:    make(hashIndex),
+			versions: db.newVersionIndex(),
+			packer:   db.packer,
+		}
+		// The last segment of a read-only Db may still be written to by
+		// another process, its torn tail is no damage.
+		sealed := flag == os.O_RDONLY && !(db.readOnly && isLast && !sf.merged)
+		size, lastVersion, err := s.load(sealed)
+		if errors.Is(err, errTornRecord) && db.readOnly && isLast {
+			err = nil
+		} else if errors.Is(err, errTornRecord) && flag != os.O_RDONLY {
+			err = f.Truncate(size)
+		}
+		if err == nil && size < s.format.start() && flag != os.O_RDONLY {
+			// Nothing but a part of the header made it to the file.
+			size, err = s.format.start(), writeSegmentHeader(f, s.format)
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("recover %s: %w", sf.name, err)
+		}
+		db.segments = append(db.segments, s)
+		db.lastSegmentIndex = sf.id + 1
+		if lastVersion > db.lastVersion {
+			db.lastVersion = lastVersion
+		}
+		if flag != os.O_RDONLY {
+			db.out = f
+			db.outOffset = size
+			db.activeSegment = s
 		}
 	}
-	return err
+
+	if db.out == nil && !db.readOnly {
+		s, err := db.createNewSegment()
+		if err != nil {
+			return err
+		}
+		db.segments = append(db.segments, s)
+	}
+	return nil
 }
 
-func (db *Db) setKey(key string, n int64) {
-	db.getLastSegment().index[key] = db.outOffset
-	db.outOffset += n
+func (db *Db) removeStale(name string) error {
+	if db.readOnly {
+		return nil
+	}
+	return db.fs.Remove(filepath.Join(db.dir, name))
 }
 
-func (db *Db) getSegmentAndPos(key string) (*Segment, int64, error) {
+// load fills the segment index from its file and returns the size of the
+// readable part of it and the highest version found. Records failing their
+// checksum are indexed all the same and quarantined, see scrub.go. In a
+// sealed segment, a broken frame quarantines the rest of the file as well.
+func (s *Segment) load(sealed bool) (int64, uint64, error) {
+	format, empty, err := readSegmentHeader(s.file)
+	s.format = format
+	if err != nil || empty {
+		return 0, 0, err
+	}
+	var (
+		lastVersion uint64
+		damaged     []DamagedRange
+		offset      = format.start()
+		in          = bufio.NewReaderSize(io.NewSectionReader(s.file, offset, math.MaxInt64-offset), bufSize)
+	)
+	for {
+		e, size, err := format.next(in)
+		if err == io.EOF {
+			break
+		} else if errors.Is(err, errChecksum) {
+			damaged = append(damaged, DamagedRange{Segment: filepath.Base(s.filePath), Offset: offset, End: offset + size})
+		} else if sealed && (errors.Is(err, errCorrupted) || errors.Is(err, errTornRecord)) {
+			r, err := damagedRest(filepath.Base(s.filePath), in, offset, size)
+			if err != nil {
+				return offset, lastVersion, err
+			}
+			damaged = append(damaged, r)
+			offset = r.End
+			break
+		} else if err != nil {
+			return offset, lastVersion, err
+		}
+		keyID := e.keyID()
+		e, stored, err := s.packer.unpack(e)
+		if err != nil && len(damaged) > 0 && damaged[len(damaged)-1].Offset == offset {
+			// Damaged beyond opening, only the key is lost.
+			offset += size
+			continue
+		} else if err != nil {
+			return offset, lastVersion, err
+		}
+		s.compression.add(int64(len(e.value)), stored)
+		pos := recordPos{
+			offset:  offset,
+			size:    size,
+			deleted: e.value == deleteMarker,
+			operand: isOperand(e.value),
+			keyID:   keyID,
+		}
+		if e.deleteRange {
+			pos.deleted, pos.operand = false, false
+			s.addRange(rangeTombstone{bucket: e.bucket, start: e.key, end: e.value, versionPos: versionPos{pos, e.version, e.time}})
+		} else {
+			s.addRecord(e.recordKey(), versionPos{pos, e.version, e.time})
+		}
+		if e.version > lastVersion {
+			lastVersion = e.version
+		}
+		offset += size
+	}
+	for _, r := range damaged {
+		log.Printf("%s: damaged records at bytes %d-%d, quarantined", r.Segment, r.Offset, r.End)
+	}
+	s.damaged = damaged
+	return offset, lastVersion, nil
+}
+
+func (db *Db) getSegmentAndPos(key recordKey) (*Segment, recordPos, error) {
 	for i := range db.segments {
 		s := db.segments[len(db.segments)-i-1]
 		pos, ok := s.index[key]
@@ -270,24 +1071,90 @@ func (db *Db) getSegmentAndPos(key string) (*Segment, int64, error) {
 		}
 	}
 
-	return nil, 0, ErrNotFound
+	return nil, recordPos{}, ErrNotFound
 }
 
-func (db *Db) getPos(key string) *keyPosition {
+func (db *Db) getPos(ctx context.Context, key recordKey) (*keyPosition, error) {
 	op := indexOp{
-		isWrite: false,
-		key:     key,
+		kind: opLookup,
+		key:  key,
+		resp: make(chan *keyPosition, 1),
 	}
-	db.indexOps <- op
-	return <-db.keyPositions
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case db.indexOps <- op:
+	case <-db.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// A lookup is answered right away once the index goroutine took it.
+	return <-op.resp, nil
 }
 
-func (db *Db) Get(key string) (string, error) {
-	keyPos := db.getPos(key)
+// getValue returns the type tagged value of key, following value-log
+// pointers and folding merge operands.
+func (db *Db) getValue(ctx context.Context, key recordKey) (string, error) {
+	for attempt := 0; ; attempt++ {
+		value, operands, err := db.getRaw(ctx, key, db.readSegment)
+		// The value was moved by a collection in the meantime.
+		if err == errVlogGone && attempt < 3 {
+			continue
+		}
+		if err == nil && len(operands) > 0 {
+			value, err = db.fold(key.key, value, operands)
+		}
+		if err == nil && db.evictor != nil {
+			db.evictor.touch(key)
+		}
+		return value, err
+	}
+}
+
+// getRaw returns the value of key and the merge operands written on top of
+// it, both read with read. The value is empty when there are only operands.
+func (db *Db) getRaw(ctx context.Context, key recordKey, read func(*Segment, int64) (string, error)) (string, []string, error) {
+	keyPos, err := db.getPos(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
 	if keyPos == nil {
-		return "", ErrNotFound
+		return "", nil, ErrNotFound
+	}
+	defer keyPos.release()
+	if keyPos.segment == nil && len(keyPos.operands) == 0 {
+		return "", nil, keyPos.damaged
 	}
-	value, err := keyPos.segment.getFromSegment(keyPos.position)
+	var value string
+	if keyPos.segment != nil {
+		if value, err = read(keyPos.segment, keyPos.position); err != nil {
+			return "", nil, err
+		}
+	}
+	var operands []string
+	for _, op := range keyPos.operands {
+		operand, err := read(op.segment, op.position)
+		if err != nil {
+			return "", nil, err
+		}
+		operands = append(operands, operand)
+	}
+	return value, operands, nil
+}
+
+func (db *Db) Get(key string) (string, error) {
+	return db.GetCtx(context.Background(), key)
+}
+
+// GetCtx is Get that gives up with the context error once ctx is done.
+func (db *Db) GetCtx(ctx context.Context, key string) (string, error) {
+	return db.getString(ctx, recordKey{key: key})
+}
+
+func (db *Db) getString(ctx context.Context, key recordKey) (string, error) {
+	value, err := db.getValue(ctx, key)
 	if err != nil {
 		return "", err
 	}
@@ -299,20 +1166,71 @@ func (db *Db) Get(key string) (string, error) {
 }
 
 func (db *Db) Put(key, value string) error {
+	return db.PutCtx(context.Background(), key, value)
+}
+
+// PutCtx is Put that gives up with the context error once ctx is done. When
+// that happens after the writer picked the value up, the value may still
+// get stored.
+func (db *Db) PutCtx(ctx context.Context, key, value string) error {
 	e := entry{
 		key:   key,
 		value: value + "s",
 	}
-	db.putOps <- e
-	return <-db.putDone
+	return db.put(ctx, e)
 }
 
-func (db *Db) GetInt64(key string) (int64, error) {
-	keyPos := db.getPos(key)
-	if keyPos == nil {
-		return int64(0), ErrNotFound
+// Keys returns the keys starting with prefix, sorted.
+func (db *Db) Keys(prefix string) ([]string, error) {
+	return db.keys(recordKey{key: prefix})
+}
+
+// Stats counts the keys outside of buckets.
+func (db *Db) Stats() (BucketStats, error) {
+	return db.bucketStats(0)
+}
+
+func (db *Db) Delete(key string) error {
+	return db.DeleteCtx(context.Background(), key)
+}
+
+func (db *Db) DeleteCtx(ctx context.Context, key string) error {
+	return db.put(ctx, entry{key: key, value: deleteMarker})
+}
+
+func (db *Db) put(ctx context.Context, e entry) error {
+	return db.submit(ctx, putOp{entry: e})
+}
+
+func (db *Db) putBatch(ctx context.Context, entries []entry) error {
+	return db.submit(ctx, putOp{batch: entries})
+}
+
+func (db *Db) submit(ctx context.Context, op putOp) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	op.resp = make(chan error, 1)
+	select {
+	case db.putOps <- op:
+	case <-db.closed:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	valueStr, err := keyPos.segment.getFromSegment(keyPos.position)
+	select {
+	case err := <-op.resp:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db *Db) GetInt64(key string) (int64, error) {
+	valueStr, err := db.getValue(context.Background(), recordKey{key: key})
 	if err != nil {
 		return int64(0), err
 	}
@@ -336,30 +1254,28 @@ func (db *Db) PutInt64(key string, value int64) error {
 		key:   key,
 		value: valueStr + "i",
 	}
-	db.putOps <- e
-	return <-db.putDone
-}
-
-func (db *Db) getLastSegment() *Segment {
-	return db.segments[len(db.segments)-1]
+	return db.put(context.Background(), e)
 }
 
+// getFromSegment returns the value at position, typed values with their
+// type joined to it, see typed.go.
 func (s *Segment) getFromSegment(position int64) (string, error) {
-	file, err := os.Open(s.filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	_, err = file.Seek(position, 0)
+	e, err := s.readRecord(position)
 	if err != nil {
 		return "", err
 	}
+	return joinType(e.value, e.typ), nil
+}
 
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+// readRecord returns the unpacked value at position with the fields of the
+// extension of its record, merges copy them to the records they write.
+func (s *Segment) readRecord(position int64) (entry, error) {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, position, math.MaxInt64-position))
+	value, ext, err := readValue(reader)
 	if err != nil {
-		return "", err
+		return entry{}, err
 	}
-	return value, nil
+	ext.value = value
+	e, _, err := s.packer.unpack(ext)
+	return e, err
 }
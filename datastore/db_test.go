@@ -1,9 +1,14 @@
 package datastore
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -131,7 +136,7 @@ func TestDb_Segmentation(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	db, err := NewDb(dir, 35)
+	db, err := NewDb(dir, 50)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -183,8 +188,197 @@ func TestDb_Segmentation(t *testing.T) {
 		inf, _ := file.Stat()
 		actual := inf.Size()
 
-		if actual != int64(45) {
-			t.Errorf("Bad segmentation. Expected size %d, Actual one: %d", int64(45), actual)
+		if actual != int64(65) {
+			t.Errorf("Bad segmentation. Expected size %d, Actual one: %d", int64(65), actual)
+		}
+	})
+}
+
+func TestDb_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	goroutines := runtime.NumGoroutine()
+
+	db, err := NewDb(dir, 35)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("drain puts", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 50)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- db.Put(strconv.Itoa(i), "v")
+			}(i)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil && err != ErrClosed {
+				t.Errorf("Unexpected put error: %s", err)
+			}
+		}
+	})
+
+	t.Run("calls after close", func(t *testing.T) {
+		if err := db.Put("1", "a"); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Put, got %v", err)
+		}
+		if _, err := db.Get("1"); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Get, got %v", err)
+		}
+		if err := db.Close(); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from second Close, got %v", err)
+		}
+	})
+
+	// Checked outside of t.Run, a running subtest has a goroutine of its own.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("Goroutines leaked: %d before, %d after Close", goroutines, n)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		db, err := NewDb(dir, 35)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Get("0"); err != nil && err != ErrNotFound {
+			t.Errorf("Cannot read after reopen: %s", err)
+		}
+	})
+}
+
+func TestDb_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("1", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("second writer", func(t *testing.T) {
+		if _, err := NewDb(dir, 100); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected ErrLocked, got %v", err)
+		}
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		ro, err := NewDbWithOptions(dir, 100, Options{ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+
+		value, err := ro.Get("1")
+		if err != nil || value != "a" {
+			t.Errorf("Bad value returned expected a, got %s (%v)", value, err)
+		}
+		if err := ro.Put("2", "b"); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly, got %v", err)
+		}
+		if err := db.Put("2", "b"); err != nil {
+			t.Errorf("Writer cannot put next to a reader: %s", err)
+		}
+	})
+
+	t.Run("released on close", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	})
+}
+
+// stallFS blocks the creation of new files until release is closed.
+type stallFS struct {
+	*FaultFS
+	stall   bool
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (fs *stallFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fs.stall && flag&os.O_CREATE != 0 {
+		close(fs.stalled)
+		<-fs.release
+	}
+	return fs.FaultFS.OpenFile(name, flag, perm)
+}
+
+func TestDb_Context(t *testing.T) {
+	fs := &stallFS{
+		FaultFS: NewFaultFS(1),
+		stalled: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	db, err := NewDbWithOptions("/db", 50, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("2", "b"); err != nil {
+		t.Fatal(err)
+	}
+	fs.stall = true
+
+	// The segment is full, the writer gets stuck creating the next one.
+	stuck := make(chan error, 1)
+	go func() { stuck <- db.Put("3", "c") }()
+	<-fs.stalled
+
+	t.Run("put deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := db.PutCtx(ctx, "4", "d"); err != context.DeadlineExceeded {
+			t.Errorf("Expected deadline error, got %v", err)
 		}
 	})
+
+	t.Run("get cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := db.GetCtx(ctx, "1"); err != context.Canceled {
+			t.Errorf("Expected cancel error, got %v", err)
+		}
+		value, err := db.GetCtx(context.Background(), "1")
+		if err != nil || value != "a" {
+			t.Errorf("Bad value returned expected a, got %s (%v)", value, err)
+		}
+	})
+
+	close(fs.release)
+	if err := <-stuck; err != nil {
+		t.Errorf("Stalled put failed: %s", err)
+	}
 }
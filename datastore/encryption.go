@@ -0,0 +1,255 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Encrypted records keep their bucket, version and time in the clear and
+// carry the key, sub key, value type and value sealed together in the value:
+//
+//	key id uint32 | nonce | AES-256-GCM(key length uint32 | sub length uint32 | type length uint32 | key | sub | type | value)
+//
+// The extension marks these records. The key id and the extension are
+// authenticated with the rest, so the fields kept in the clear cannot be
+// altered either. Any key of the keyring can open the records sealed with it
+// and merges rewrite them with the active one. The key id is recorded with
+// every record rather than once per file: the active segment is appended to
+// across restarts with another active key, and value-log files have no
+// header.
+const (
+	encryptionKeySize = 32
+	sealedHeaderSize  = 4
+)
+
+var ErrUnknownKey = fmt.Errorf("record is encrypted with an unknown key")
+
+// Keyring holds the keys used to encrypt records at rest. Records are sealed
+// with the active key and opened with the key they name, so a new key can be
+// made active while the data sealed with the older ones stays readable.
+type Keyring struct {
+	active uint32
+	aeads  map[uint32]cipher.AEAD
+}
+
+// NewKeyring makes a keyring of 32 byte AES-256 keys by id. Ids must not be
+// 0, the active one must be among the keys.
+func NewKeyring(keys map[uint32][]byte, active uint32) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %d is missing", active)
+	}
+	k := &Keyring{active: active, aeads: make(map[uint32]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == 0 {
+			return nil, fmt.Errorf("key id 0 is reserved")
+		}
+		if len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("key %d has %d bytes, not %d", id, len(key), encryptionKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// ParseKeyring reads keys written as id:hex, separated by new lines or
+// commas. Lines starting with # are skipped. The key with the highest id is
+// the active one, so rotating is adding a key.
+func ParseKeyring(s string) (*Keyring, error) {
+	keys := make(map[uint32][]byte)
+	var active uint32
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			idStr, keyStr, ok := strings.Cut(strings.TrimSpace(field), ":")
+			id, err := strconv.ParseUint(idStr, 10, 32)
+			if !ok || err != nil {
+				return nil, fmt.Errorf("bad key %q, expected id:hex", field)
+			}
+			key, err := hex.DecodeString(keyStr)
+			if err != nil {
+				return nil, fmt.Errorf("key %d: %w", id, err)
+			}
+			if _, ok := keys[uint32(id)]; ok {
+				return nil, fmt.Errorf("key %d is listed twice", id)
+			}
+			keys[uint32(id)] = key
+			if uint32(id) > active {
+				active = uint32(id)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return NewKeyring(keys, active)
+}
+
+// LoadKeyring parses the key file at path, see ParseKeyring.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(data))
+}
+
+// Active returns the id of the key new records are sealed with.
+func (k *Keyring) Active() uint32 {
+	return k.active
+}
+
+// activeID is Active that gives 0, plaintext, without a keyring.
+func (k *Keyring) activeID() uint32 {
+	if k == nil {
+		return 0
+	}
+	return k.active
+}
+
+// seal encrypts plain with the active key, ext is the extension of the
+// record it is stored in.
+func (k *Keyring) seal(plain, ext []byte) []byte {
+	aead := k.aeads[k.active]
+	out := make([]byte, sealedHeaderSize+aead.NonceSize(), sealedHeaderSize+aead.NonceSize()+len(plain)+aead.Overhead())
+	binary.LittleEndian.PutUint32(out, k.active)
+	if _, err := rand.Read(out[sealedHeaderSize:]); err != nil {
+		panic(fmt.Errorf("read random nonce: %w", err))
+	}
+	return aead.Seal(out, out[sealedHeaderSize:], plain, additionalData(out, ext))
+}
+
+// additionalData is what is authenticated along with a sealed value: its
+// key id and the extension of its record.
+func additionalData(sealed, ext []byte) []byte {
+	return append(append([]byte(nil), sealed[:sealedHeaderSize]...), ext...)
+}
+
+func (k *Keyring) open(sealed string, ext []byte) ([]byte, error) {
+	if len(sealed) < sealedHeaderSize {
+		return nil, errCorrupted
+	}
+	id := sealedKeyID(sealed)
+	var aead cipher.AEAD
+	if k != nil {
+		aead = k.aeads[id]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+	data := []byte(sealed)
+	if len(data) < sealedHeaderSize+aead.NonceSize() {
+		return nil, errCorrupted
+	}
+	nonce := data[sealedHeaderSize : sealedHeaderSize+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[sealedHeaderSize+aead.NonceSize():], additionalData(data, ext))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errCorrupted, err)
+	}
+	return plain, nil
+}
+
+// sealedKeyID returns the id of the key a sealed value was encrypted with.
+func sealedKeyID(sealed string) uint32 {
+	if len(sealed) < sealedHeaderSize {
+		return 0
+	}
+	return binary.LittleEndian.Uint32([]byte(sealed[:sealedHeaderSize]))
+}
+
+// sealEntry returns the form of e written to the files, e itself without a
+// keyring.
+func (k *Keyring) sealEntry(e entry) entry {
+	if k == nil {
+		return e
+	}
+	plain := make([]byte, 12, 12+len(e.key)+len(e.sub)+len(e.typ)+len(e.value))
+	binary.LittleEndian.PutUint32(plain, uint32(len(e.key)))
+	binary.LittleEndian.PutUint32(plain[4:], uint32(len(e.sub)))
+	binary.LittleEndian.PutUint32(plain[8:], uint32(len(e.typ)))
+	plain = append(append(append(append(plain, e.key...), e.sub...), e.typ...), e.value...)
+	rec := entry{
+		sealed:      true,
+		compressed:  e.compressed,
+		deleteRange: e.deleteRange,
+		bucket:      e.bucket,
+		version:     e.version,
+		time:        e.time,
+	}
+	rec.value = string(k.seal(plain, rec.extension()))
+	return rec
+}
+
+// openEntry reverses sealEntry.
+func (k *Keyring) openEntry(e entry) (entry, error) {
+	if !e.sealed {
+		return e, nil
+	}
+	plain, err := k.open(e.value, e.extension())
+	if err != nil {
+		return entry{}, err
+	}
+	if len(plain) < 12 {
+		return entry{}, errCorrupted
+	}
+	kl := uint64(binary.LittleEndian.Uint32(plain))
+	sl := uint64(binary.LittleEndian.Uint32(plain[4:]))
+	tl := uint64(binary.LittleEndian.Uint32(plain[8:]))
+	if 12+kl+sl+tl > uint64(len(plain)) {
+		return entry{}, errCorrupted
+	}
+	rest := string(plain[12:])
+	e.key, e.sub, e.typ = rest[:kl], rest[kl:kl+sl], rest[kl+sl:kl+sl+tl]
+	e.value, e.sealed = rest[kl+sl+tl:], false
+	return e, nil
+}
+
+// keyID returns the id of the key sealing the record, 0 for plaintext.
+func (e *entry) keyID() uint32 {
+	if !e.sealed {
+		return 0
+	}
+	return sealedKeyID(e.value)
+}
+
+// KeysInUse lists the ids of the keys the records of the segments and of the
+// value log are sealed with, 0 standing for plaintext records. An old key
+// can be dropped from the keyring once merges and value-log collections
+// took it out of this list.
+func (db *Db) KeysInUse() ([]uint32, error) {
+	op := indexOp{kind: opKeysInUse, keyIDs: make(chan map[uint32]bool, 1)}
+	select {
+	case db.indexOps <- op:
+	case <-db.closed:
+		return nil, ErrClosed
+	}
+	inUse := <-op.keyIDs
+	vlogKeys, _, err := db.vlog.info()
+	if err != nil {
+		return nil, err
+	}
+	for id := range vlogKeys {
+		inUse[id] = true
+	}
+	ids := make([]uint32, 0, len(inUse))
+	for id := range inUse {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
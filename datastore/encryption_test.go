@@ -0,0 +1,190 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyring(t *testing.T) {
+	key1, key2 := strings.Repeat("11", 32), strings.Repeat("22", 32)
+	k, err := ParseKeyring("# rotated in May\n1:" + key1 + "\n2:" + key2 + "\n")
+	if err != nil || k.Active() != 2 {
+		t.Fatalf("Bad keyring %+v (%v)", k, err)
+	}
+	if k, err := ParseKeyring("2:" + key2 + ", 1:" + key1); err != nil || k.Active() != 2 {
+		t.Errorf("Bad comma separated keyring %+v (%v)", k, err)
+	}
+	for _, bad := range []string{"", "1:abc", "x:" + key1, "0:" + key1, "1:" + key1 + ",1:" + key2} {
+		if _, err := ParseKeyring(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestKeyring_SealEntry(t *testing.T) {
+	k, _ := ParseKeyring("1:" + strings.Repeat("11", 32))
+	e := entry{key: "order", value: "{}c", typ: "json:main.Order", bucket: 3, version: 7, time: 42}
+	rec := k.sealEntry(e)
+	if rec.typ != "" || strings.Contains(rec.value, e.typ) {
+		t.Errorf("Expected the type to be sealed, got %+v", rec)
+	}
+	var stored entry
+	if err := stored.decode(rec.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := k.openEntry(stored); err != nil || opened != e {
+		t.Errorf("Bad opened entry %+v (%v)", opened, err)
+	}
+
+	for name, alter := range map[string]func(e *entry){
+		"bucket":     func(e *entry) { e.bucket++ },
+		"version":    func(e *entry) { e.version++ },
+		"time":       func(e *entry) { e.time++ },
+		"compressed": func(e *entry) { e.compressed = true },
+		"range":      func(e *entry) { e.deleteRange = true },
+	} {
+		altered := stored
+		alter(&altered)
+		if _, err := k.openEntry(altered); !errors.Is(err, errCorrupted) {
+			t.Errorf("Expected a record with another %s to be rejected, got %v", name, err)
+		}
+	}
+}
+
+func TestDb_Encryption(t *testing.T) {
+	fs := NewFaultFS(1)
+	key1, _ := ParseKeyring("1:" + strings.Repeat("11", 32))
+	both, _ := ParseKeyring("1:" + strings.Repeat("11", 32) + ",2:" + strings.Repeat("22", 32))
+	opts := Options{FS: fs, ValueLogThreshold: 64, Keyring: key1}
+	db, err := NewDbWithOptions("/db", 250, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	secret := "card-4111-1111"
+	big := strings.Repeat(secret+" ", 20)
+
+	check := func(t *testing.T) {
+		t.Helper()
+		if v, err := db.Get("plain"); err != nil || v != secret {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+		if v, err := db.Get("big"); err != nil || v != big {
+			t.Errorf("Bad value log value %q (%v)", v, err)
+		}
+		if r, err := db.GetReader("big"); err != nil {
+			t.Error(err)
+		} else if data, _ := io.ReadAll(r); string(data) != big {
+			t.Errorf("Bad streamed value %q", data)
+		}
+		if v, err := db.LRange("list", 0, -1); err != nil || !reflect.DeepEqual(v, []string{secret}) {
+			t.Errorf("Bad list %v (%v)", v, err)
+		}
+		if keys, _ := db.Keys("secret-"); !reflect.DeepEqual(keys, []string{"secret-key"}) {
+			t.Errorf("Bad keys %v", keys)
+		}
+	}
+
+	t.Run("sealed", func(t *testing.T) {
+		db.Put("plain", secret)
+		db.Put("big", big)
+		db.LPush("list", secret)
+		db.Put("secret-key", "v")
+		check(t)
+		if name, ok := plaintextIn(t, fs, "/db", secret, "secret-key"); ok {
+			t.Errorf("Found plaintext in %s", name)
+		}
+		if ids, err := db.KeysInUse(); err != nil || !reflect.DeepEqual(ids, []uint32{1}) {
+			t.Errorf("Expected only key 1 in use, got %v (%v)", ids, err)
+		}
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		db.Close()
+		_, err := NewDbWithOptions("/db", 250, Options{FS: fs, ValueLogThreshold: 64})
+		if !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("Expected ErrUnknownKey without a keyring, got %v", err)
+		}
+		opts.Keyring = both
+		if db, err = NewDbWithOptions("/db", 250, opts); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			if ids, _ := db.KeysInUse(); !reflect.DeepEqual(ids, []uint32{1}) && !reflect.DeepEqual(ids, []uint32{1, 2}) {
+				break
+			}
+			db.Put("filler"+strconv.Itoa(i%5), strings.Repeat("x", 40))
+			if err := db.CollectValueLog(); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if ids, err := db.KeysInUse(); err != nil || !reflect.DeepEqual(ids, []uint32{2}) {
+			t.Errorf("Expected merges to re-encrypt with key 2, got %v (%v)", ids, err)
+		}
+		check(t)
+		key2, _ := ParseKeyring("2:" + strings.Repeat("22", 32))
+		db.Close()
+		opts.Keyring = key2
+		if db, err = NewDbWithOptions("/db", 250, opts); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("enable on plaintext data", func(t *testing.T) {
+		db.Close()
+		fs := NewFaultFS(1)
+		plain, err := NewDbWithOptions("/db", 250, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain.Put("old", secret)
+		plain.Close()
+		if db, err = NewDbWithOptions("/db", 250, Options{FS: fs, Keyring: key1}); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := db.Get("old"); err != nil || v != secret {
+			t.Errorf("Bad plaintext value %q (%v)", v, err)
+		}
+		db.Put("new", secret)
+		if ids, _ := db.KeysInUse(); !reflect.DeepEqual(ids, []uint32{0, 1}) {
+			t.Errorf("Expected plaintext and key 1 records, got %v", ids)
+		}
+	})
+}
+
+// plaintextIn returns the first file of dir containing one of the strings.
+func plaintextIn(t *testing.T, fs *FaultFS, dir string, strs ...string) (string, bool) {
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		f, err := fs.OpenFile(filepath.Join(dir, name), os.O_RDONLY, 0)
+		if err != nil {
+			continue
+		}
+		data, _ := io.ReadAll(f)
+		f.Close()
+		for _, s := range strs {
+			if bytes.Contains(data, []byte(s)) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
@@ -4,10 +4,96 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
+// Records are laid out as
+//
+//	size uint32 | [extension] | key length uint32 | key | value length uint32 | value
+//
+// The extension is only present when the top bit of size is set. It starts
+// with its own uint16 length followed by fields of the form tag uint8 |
+// length uint8 | data. Records without extra fields are encoded without it.
+// Segment files frame the records further, see format.go.
+const (
+	extFlag    = 1 << 31
+	extBucket  = 1
+	extVersion = 2
+	extTime    = 3
+	extSub     = 4
+	// extSealed has no data, it marks encrypted records, see encryption.go.
+	extSealed = 5
+	// extCompressed has no data, it marks records whose value is
+	// compressed, see compression.go.
+	extCompressed = 6
+	// extRange has no data, it marks range tombstones, see ranges.go.
+	extRange = 7
+	// extType names the codec of a typed value, see typed.go.
+	extType = 8
+)
+
+var errCorrupted = fmt.Errorf("corrupted file")
+
 type entry struct {
 	key, value string
+	// sub names an element of the collection stored under key. It is empty
+	// for plain values. On disk it is appended to the key, the extension
+	// records where the key ends.
+	sub    string
+	bucket uint32
+	// version and time (unix nanoseconds) are only set when versions are
+	// retained.
+	version uint64
+	time    int64
+	// sealed is set for the encrypted form of a record: the key and the
+	// sub key are empty and the value holds all three.
+	sealed bool
+	// compressed is set when the value is stored deflated.
+	compressed bool
+	// deleteRange is set for range tombstones: the value is the end of the
+	// range of keys deleted, see ranges.go.
+	deleteRange bool
+	// typ is the type of a typed value, whose value then holds the data and
+	// typedTag only.
+	typ string
+}
+
+func (e *entry) extension() []byte {
+	if e.bucket == 0 && e.version == 0 && e.time == 0 && e.sub == "" && !e.sealed && !e.compressed && !e.deleteRange && e.typ == "" {
+		return nil
+	}
+	ext := make([]byte, 2, 36)
+	if e.bucket != 0 {
+		ext = append(ext, extBucket, 4)
+		ext = binary.LittleEndian.AppendUint32(ext, e.bucket)
+	}
+	if e.version != 0 {
+		ext = append(ext, extVersion, 8)
+		ext = binary.LittleEndian.AppendUint64(ext, e.version)
+	}
+	if e.time != 0 {
+		ext = append(ext, extTime, 8)
+		ext = binary.LittleEndian.AppendUint64(ext, uint64(e.time))
+	}
+	if e.sub != "" {
+		ext = append(ext, extSub, 4)
+		ext = binary.LittleEndian.AppendUint32(ext, uint32(len(e.key)))
+	}
+	if e.sealed {
+		ext = append(ext, extSealed, 0)
+	}
+	if e.compressed {
+		ext = append(ext, extCompressed, 0)
+	}
+	if e.deleteRange {
+		ext = append(ext, extRange, 0)
+	}
+	if e.typ != "" {
+		ext = append(ext, extType, byte(len(e.typ)))
+		ext = append(ext, e.typ...)
+	}
+	binary.LittleEndian.PutUint16(ext, uint16(len(ext)-2))
+	return ext
 }
 
 func getLength(key string, value string) int64 {
@@ -15,63 +101,171 @@ func getLength(key string, value string) int64 {
 }
 
 func (e *entry) GetLength() int64 {
-	return getLength(e.key, e.value)
+	return getLength(e.key+e.sub, e.value) + int64(len(e.extension()))
+}
+
+func (e *entry) recordKey() recordKey {
+	return recordKey{bucket: e.bucket, key: e.key, sub: e.sub}
 }
 
 func (e *entry) Encode() []byte {
-	kl := len(e.key)
+	ext := e.extension()
+	key := e.key + e.sub
+	kl := len(key)
 	vl := len(e.value)
-	size := kl + vl + 12
+	size := kl + vl + 12 + len(ext)
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
+	if len(ext) > 0 {
+		res[3] |= extFlag >> 24
+	}
+	p := 4 + copy(res[4:], ext)
+	binary.LittleEndian.PutUint32(res[p:], uint32(kl))
+	copy(res[p+4:], key)
+	binary.LittleEndian.PutUint32(res[p+kl+4:], uint32(vl))
+	copy(res[p+kl+8:], e.value)
 	return res
 }
 
 func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
+	_ = e.decode(input)
+}
+
+// decode is Decode that validates the framing of the record.
+func (e *entry) decode(input []byte) error {
+	if len(input) < 12 {
+		return errCorrupted
+	}
+	size := binary.LittleEndian.Uint32(input)
+	p := uint32(4)
+	e.bucket, e.version, e.time, e.sub = 0, 0, 0, ""
+	e.sealed, e.compressed, e.deleteRange, e.typ = false, false, false, ""
+	split := -1
+	if size&extFlag != 0 {
+		size &^= extFlag
+		if len(input) < 6 {
+			return errCorrupted
+		}
+		extLen := uint32(binary.LittleEndian.Uint16(input[4:]))
+		if 6+extLen+8 > uint32(len(input)) {
+			return errCorrupted
+		}
+		var err error
+		if split, err = e.decodeExtension(input[6 : 6+extLen]); err != nil {
+			return err
+		}
+		p = 6 + extLen
+	}
+	if size != uint32(len(input)) {
+		return errCorrupted
+	}
+
+	kl := binary.LittleEndian.Uint32(input[p:])
+	if uint64(p)+uint64(kl)+8 > uint64(size) {
+		return errCorrupted
+	}
 	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
+	copy(keyBuf, input[p+4:p+4+kl])
 	e.key = string(keyBuf)
+	if split > int(kl) {
+		return errCorrupted
+	} else if split >= 0 {
+		e.key, e.sub = e.key[:split], e.key[split:]
+	}
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
+	vl := binary.LittleEndian.Uint32(input[p+kl+4:])
+	if uint64(p)+uint64(kl)+8+uint64(vl) > uint64(size) {
+		return errCorrupted
+	}
 	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
+	copy(valBuf, input[p+kl+8:p+kl+8+vl])
 	e.value = string(valBuf)
+	return nil
 }
 
-func readValue(in *bufio.Reader) (string, error) {
+// decodeExtension sets the fields found in ext and returns where the key ends
+// when it is followed by a sub key, -1 otherwise.
+func (e *entry) decodeExtension(ext []byte) (int, error) {
+	split := -1
+	for len(ext) > 0 {
+		if len(ext) < 2 || len(ext) < 2+int(ext[1]) {
+			return 0, errCorrupted
+		}
+		tag, data := ext[0], ext[2:2+ext[1]]
+		// Unknown fields are skipped, they only add information.
+		switch {
+		case tag == extBucket && len(data) == 4:
+			e.bucket = binary.LittleEndian.Uint32(data)
+		case tag == extVersion && len(data) == 8:
+			e.version = binary.LittleEndian.Uint64(data)
+		case tag == extTime && len(data) == 8:
+			e.time = int64(binary.LittleEndian.Uint64(data))
+		case tag == extSub && len(data) == 4:
+			split = int(binary.LittleEndian.Uint32(data))
+		case tag == extSealed:
+			e.sealed = true
+		case tag == extCompressed:
+			e.compressed = true
+		case tag == extRange:
+			e.deleteRange = true
+		case tag == extType && len(data) > 0:
+			e.typ = string(data)
+		}
+		ext = ext[2+len(data):]
+	}
+	return split, nil
+}
+
+// readValue reads the value of the record. The extension fields are set in
+// the returned entry, they tell how to unpack the value.
+func readValue(in *bufio.Reader) (string, entry, error) {
 	header, err := in.Peek(8)
 	if err != nil {
-		return "", err
+		return "", entry{}, err
+	}
+	var e entry
+	if binary.LittleEndian.Uint32(header)&extFlag != 0 {
+		extLen := int(binary.LittleEndian.Uint16(header[4:]))
+		ext, err := in.Peek(6 + extLen)
+		if err != nil {
+			return "", entry{}, err
+		}
+		if _, err := e.decodeExtension(ext[6:]); err != nil {
+			return "", entry{}, err
+		}
+		// Skip to where the key length is preceded by four bytes, just like
+		// in a record without extension.
+		if _, err := in.Discard(2 + extLen); err != nil {
+			return "", entry{}, err
+		}
+		if header, err = in.Peek(8); err != nil {
+			return "", entry{}, err
+		}
 	}
 	keySize := int(binary.LittleEndian.Uint32(header[4:]))
 	_, err = in.Discard(keySize + 8)
 	if err != nil {
-		return "", err
+		return "", entry{}, err
 	}
 
 	header, err = in.Peek(4)
 	if err != nil {
-		return "", err
+		return "", entry{}, err
 	}
 	valSize := int(binary.LittleEndian.Uint32(header))
 	_, err = in.Discard(4)
 	if err != nil {
-		return "", err
+		return "", entry{}, err
 	}
 
 	data := make([]byte, valSize)
-	n, err := in.Read(data)
+	n, err := io.ReadFull(in, data)
 	if err != nil {
-		return "", err
+		return "", entry{}, err
 	}
 	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+		return "", entry{}, fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
 	}
 
-	return string(data), nil
+	return string(data), e, nil
 }
@@ -7,7 +7,7 @@ import (
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -18,9 +18,9 @@ func TestEntry_Encode(t *testing.T) {
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
-	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	v, _, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -28,3 +28,25 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Got bat value [%s]", v)
 	}
 }
+
+func TestEntry_Extension(t *testing.T) {
+	e := entry{key: "key", value: "test-value", sub: "field", bucket: 7, version: 42, time: 1e18, typ: "json:order"}
+	data := e.Encode()
+	if int64(len(data)) != e.GetLength() {
+		t.Errorf("Bad length %d, encoded %d bytes", e.GetLength(), len(data))
+	}
+	var d entry
+	if err := d.decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if d != e {
+		t.Errorf("Bad decoded entry %+v", d)
+	}
+	v, ext, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "test-value" || ext.typ != e.typ {
+		t.Errorf("Got bad value [%s] of type %q", v, ext.typ)
+	}
+}
@@ -0,0 +1,314 @@
+package datastore
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EvictionPolicy picks the keys evicted once the live data of a Db exceeds
+// Options.MaxBytes. Only plain values are evicted, see evictable.
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently read or written keys first.
+	LRU EvictionPolicy = iota
+	// LFU evicts the least frequently read or written keys first, the least
+	// recently used among them.
+	LFU
+)
+
+// ParseEvictionPolicy reads "lru", the default when empty, or "lfu".
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "lru":
+		return LRU, nil
+	case "lfu":
+		return LFU, nil
+	}
+	return 0, fmt.Errorf("unknown eviction policy %q", s)
+}
+
+func (p EvictionPolicy) String() string {
+	if p == LFU {
+		return "lfu"
+	}
+	return "lru"
+}
+
+// EvictionStats describes the live data tracked for eviction.
+type EvictionStats struct {
+	Policy EvictionPolicy
+	// Keys and Bytes count the live keys holding plain values and the bytes
+	// of their records in the segments.
+	Keys     int
+	Bytes    int64
+	MaxBytes int64
+	// Evictions counts the keys evicted since the Db was opened and
+	// EvictedBytes their size.
+	Evictions    uint64
+	EvictedBytes int64
+}
+
+// usage is what the evictor knows of a key.
+type usage struct {
+	key   recordKey
+	size  int64
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+// evictor tracks the live keys holding plain values with their sizes and
+// their use, in memory only: after a restart the keys are ranked by
+// the order they were written in. The keys form a heap with the next victim
+// on top.
+type evictor struct {
+	policy   EvictionPolicy
+	maxBytes int64
+
+	mu      sync.Mutex
+	keys    map[recordKey]*usage
+	heap    []*usage
+	bytes   int64
+	tick    uint64
+	evicted uint64
+	evBytes int64
+}
+
+func newEvictor(policy EvictionPolicy, maxBytes int64) *evictor {
+	return &evictor{policy: policy, maxBytes: maxBytes, keys: make(map[recordKey]*usage)}
+}
+
+func (ev *evictor) Len() int { return len(ev.heap) }
+
+func (ev *evictor) Less(i, j int) bool {
+	a, b := ev.heap[i], ev.heap[j]
+	if ev.policy == LFU && a.freq != b.freq {
+		return a.freq < b.freq
+	}
+	return a.tick < b.tick
+}
+
+func (ev *evictor) Swap(i, j int) {
+	ev.heap[i], ev.heap[j] = ev.heap[j], ev.heap[i]
+	ev.heap[i].index, ev.heap[j].index = i, j
+}
+
+func (ev *evictor) Push(x any) {
+	u := x.(*usage)
+	u.index = len(ev.heap)
+	ev.heap = append(ev.heap, u)
+}
+
+func (ev *evictor) Pop() any {
+	n := len(ev.heap)
+	u := ev.heap[n-1]
+	ev.heap[n-1] = nil
+	ev.heap = ev.heap[:n-1]
+	return u
+}
+
+// tracked reports whether key may hold an evictable value: the internal
+// buckets and the elements of collections are never evicted.
+func tracked(key recordKey) bool {
+	return key.bucket < blobBucket && key.sub == ""
+}
+
+// evictable reports whether value, as stored under a tracked key, is a plain
+// value. Collections, queues and time series are structured state: evicting
+// their heads would orphan the elements.
+func evictable(value string) bool {
+	switch value[len(value)-1:] {
+	case listTag, hashTag, setTag, queueTag, seriesTag:
+		return false
+	}
+	return true
+}
+
+// use records an access of key, with its size set when size is not negative.
+// Called with mu held.
+func (ev *evictor) use(key recordKey, size int64) {
+	u := ev.keys[key]
+	if u == nil {
+		if size < 0 {
+			return
+		}
+		u = &usage{key: key}
+		ev.keys[key] = u
+		heap.Push(ev, u)
+	}
+	if size >= 0 {
+		ev.bytes += size - u.size
+		u.size = size
+	}
+	ev.tick++
+	u.tick = ev.tick
+	u.freq++
+	heap.Fix(ev, u.index)
+}
+
+// remove forgets the key. Called with mu held.
+func (ev *evictor) remove(key recordKey) {
+	u := ev.keys[key]
+	if u == nil {
+		return
+	}
+	ev.bytes -= u.size
+	delete(ev.keys, key)
+	heap.Remove(ev, u.index)
+}
+
+// dropBucket forgets the keys of the bucket id.
+func (ev *evictor) dropBucket(id uint32) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	for key := range ev.keys {
+		if key.bucket == id {
+			ev.remove(key)
+		}
+	}
+}
+
+// touch records a read of key.
+func (ev *evictor) touch(key recordKey) {
+	if !tracked(key) {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.use(key, -1)
+}
+
+// written accounts for a record of size bytes written for e.
+func (ev *evictor) written(e entry, size int64) {
+	if !tracked(e.recordKey()) {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	key := e.recordKey()
+	switch {
+	case e.deleteRange:
+		t := rangeTombstone{bucket: e.bucket, start: e.key, end: e.value}
+		for key := range ev.keys {
+			if t.covers(key) {
+				ev.remove(key)
+			}
+		}
+	case e.value == deleteMarker || !evictable(e.value):
+		ev.remove(key)
+	case isOperand(e.value):
+		// Operands pile up on top of the value until a merge of segments.
+		var prev int64
+		if u := ev.keys[key]; u != nil {
+			prev = u.size
+		}
+		ev.use(key, prev+size)
+	default:
+		ev.use(key, size)
+	}
+}
+
+// victim returns the next key to evict and its size while the live data
+// exceeds the budget.
+func (ev *evictor) victim() (recordKey, int64, bool) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if ev.bytes <= ev.maxBytes || len(ev.heap) == 0 {
+		return recordKey{}, 0, false
+	}
+	return ev.heap[0].key, ev.heap[0].size, true
+}
+
+func (ev *evictor) stats() EvictionStats {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return EvictionStats{
+		Policy:       ev.policy,
+		Keys:         len(ev.keys),
+		Bytes:        ev.bytes,
+		MaxBytes:     ev.maxBytes,
+		Evictions:    ev.evicted,
+		EvictedBytes: ev.evBytes,
+	}
+}
+
+// loadEvictor tracks the live keys of the segments, ranked by the order they
+// were written in. Called before the goroutines are started.
+func (db *Db) loadEvictor(policy EvictionPolicy, maxBytes int64) error {
+	ev := newEvictor(policy, maxBytes)
+	type record struct {
+		key     recordKey
+		segment int
+		pos     recordPos
+	}
+	var records []record
+	seen := make(map[recordKey]bool)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		s := db.segments[i]
+		for key, pos := range s.index {
+			if !tracked(key) || seen[key] || !db.bucketLive(key.bucket) {
+				continue
+			}
+			seen[key] = true
+			if pos.deleted || s.damageAt(pos.offset) != nil || deletedByRange(db.segments, i, key, pos.offset) {
+				continue
+			}
+			if !pos.operand {
+				value, err := s.getFromSegment(pos.offset)
+				if err != nil {
+					return err
+				} else if !evictable(value) {
+					continue
+				}
+			}
+			records = append(records, record{key, i, pos})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		return a.segment < b.segment || (a.segment == b.segment && a.pos.offset < b.pos.offset)
+	})
+	for _, r := range records {
+		ev.use(r.key, r.pos.size)
+	}
+	db.evictor = ev
+	return nil
+}
+
+// evict deletes keys while the live data exceeds the budget. Called by the
+// writer goroutine after every put; a failed eviction is retried after the
+// next one.
+func (db *Db) evict() {
+	if db.evictor == nil {
+		return
+	}
+	for {
+		key, size, ok := db.evictor.victim()
+		if !ok {
+			return
+		}
+		// The tombstone takes the key out of the evictor.
+		if err := db.write(entry{key: key.key, bucket: key.bucket, value: deleteMarker}); err != nil {
+			log.Printf("evict %s: %s", key.key, err)
+			return
+		}
+		db.evictor.mu.Lock()
+		db.evictor.evicted++
+		db.evictor.evBytes += size
+		db.evictor.mu.Unlock()
+	}
+}
+
+// EvictionStats reports the live data tracked against Options.MaxBytes and
+// the evictions made. It is zero when MaxBytes is not set.
+func (db *Db) EvictionStats() EvictionStats {
+	if db.evictor == nil {
+		return EvictionStats{}
+	}
+	return db.evictor.stats()
+}
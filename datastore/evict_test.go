@@ -0,0 +1,154 @@
+package datastore
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDb_Eviction(t *testing.T) {
+	open := func(t *testing.T, fs *FaultFS, policy EvictionPolicy) *Db {
+		t.Helper()
+		db, err := NewDbWithOptions("/db", 500, Options{FS: fs, MaxBytes: 200, Eviction: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	checkBudget := func(t *testing.T, db *Db) EvictionStats {
+		t.Helper()
+		stats := db.EvictionStats()
+		if stats.Bytes > stats.MaxBytes || stats.Evictions == 0 {
+			t.Errorf("Expected evictions to keep the data within the budget, got %+v", stats)
+		}
+		if dbStats, _ := db.Stats(); dbStats.Keys != stats.Keys || dbStats.Bytes != stats.Bytes {
+			t.Errorf("Tracked %d keys of %d bytes, the index has %+v", stats.Keys, stats.Bytes, dbStats)
+		}
+		return stats
+	}
+
+	t.Run("lru", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		db := open(t, fs, LRU)
+		defer func() { db.Close() }()
+		for i := 0; i < 20; i++ {
+			if err := db.Put("k"+strconv.Itoa(i), "value-"+strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+			// k0 is read all the time, k1 never.
+			if _, err := db.Get("k0"); err != nil {
+				t.Errorf("Expected the key in use to stay, got %v", err)
+			}
+		}
+		if _, err := db.Get("k1"); err != ErrNotFound {
+			t.Errorf("Expected the least recently used key to be evicted, got %v", err)
+		}
+		if v, err := db.Get("k19"); err != nil || v != "value-19" {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+		stats := checkBudget(t, db)
+
+		db.Close()
+		db = open(t, fs, LRU)
+		if reopened := db.EvictionStats(); reopened.Keys != stats.Keys || reopened.Bytes != stats.Bytes {
+			t.Errorf("Expected %d keys of %d bytes after reopening, got %+v", stats.Keys, stats.Bytes, reopened)
+		}
+	})
+
+	t.Run("lfu", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		db := open(t, fs, LFU)
+		defer db.Close()
+		db.Put("hot", "v")
+		for i := 0; i < 5; i++ {
+			db.Get("hot")
+		}
+		for i := 0; i < 20; i++ {
+			db.Put("k"+strconv.Itoa(i), "value-"+strconv.Itoa(i))
+		}
+		if v, err := db.Get("hot"); err != nil || v != "v" {
+			t.Errorf("Expected the frequently used key to stay, got %q (%v)", v, err)
+		}
+		if _, err := db.Get("k0"); err != ErrNotFound {
+			t.Errorf("Expected a rarely used key to be evicted, got %v", err)
+		}
+		checkBudget(t, db)
+	})
+
+	t.Run("structured state", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		db := open(t, fs, LRU)
+		defer func() { db.Close() }()
+		db.LPush("list", "a", "b", "c")
+		q := db.Queue("jobs", QueueOptions{})
+		q.Enqueue("job-1")
+		q.Enqueue("job-2")
+		db.LockBucket().Put("lease/cron", "worker-1")
+		for i := 0; i < 20; i++ {
+			db.Put("k"+strconv.Itoa(i), "value-"+strconv.Itoa(i))
+		}
+		check := func(t *testing.T) {
+			t.Helper()
+			if values, _ := db.LRange("list", 0, -1); len(values) != 3 {
+				t.Errorf("Expected the list to be kept, got %v", values)
+			}
+			if v, err := db.LockBucket().Get("lease/cron"); err != nil || v != "worker-1" {
+				t.Errorf("Expected the lease to be kept, got %q (%v)", v, err)
+			}
+			if stats := db.EvictionStats(); stats.Bytes > stats.MaxBytes || stats.Evictions == 0 {
+				t.Errorf("Expected the plain values within the budget, got %+v", stats)
+			}
+		}
+		check(t)
+
+		db.Close()
+		db = open(t, fs, LRU)
+		for i := 20; i < 40; i++ {
+			db.Put("k"+strconv.Itoa(i), "value-"+strconv.Itoa(i))
+		}
+		check(t)
+		for _, body := range []string{"job-1", "job-2"} {
+			if m, err := db.Queue("jobs", QueueOptions{}).Dequeue(); err != nil || m.Body != body {
+				t.Errorf("Expected %s to be kept, got %+v (%v)", body, m, err)
+			}
+		}
+	})
+
+	t.Run("dropped bucket", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		db := open(t, fs, LRU)
+		defer func() { db.Close() }()
+		b, err := db.Bucket("tmp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Put("k", "value")
+		kept := db.EvictionStats()
+		for i := 0; i < 5; i++ {
+			b.Put("k"+strconv.Itoa(i), "value-"+strconv.Itoa(i))
+		}
+		if err := db.DropBucket("tmp"); err != nil {
+			t.Fatal(err)
+		}
+		if stats := db.EvictionStats(); stats.Keys != kept.Keys || stats.Bytes != kept.Bytes {
+			t.Errorf("Expected %d keys of %d bytes once the bucket is dropped, got %+v", kept.Keys, kept.Bytes, stats)
+		}
+
+		db.Close()
+		db = open(t, fs, LRU)
+		if stats := db.EvictionStats(); stats.Keys != kept.Keys || stats.Bytes != kept.Bytes {
+			t.Errorf("Expected %d keys of %d bytes after reopening, got %+v", kept.Keys, kept.Bytes, stats)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		db, err := NewDbWithOptions("/db", 500, Options{FS: NewFaultFS(1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		db.Put("k", "v")
+		if stats := db.EvictionStats(); stats != (EvictionStats{}) {
+			t.Errorf("Expected no stats without a budget, got %+v", stats)
+		}
+	})
+}
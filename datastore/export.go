@@ -0,0 +1,583 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// An export holds one record per live key: its bucket, empty for the default
+// one, the key, the type and the content as JSON.
+//
+//	string  "text"                   bytes  "base64", strings that are not UTF-8
+//	int64   42                       typed  {"type": "json:main.T", "data": "base64"}
+//	list    ["a", "b"]               set    ["a", "b"]
+//	hash    {"field": "value"}       queue  ["body", ...], the pending messages
+//	series  {"retention": ns, "points": [[unix ns, value], ...]}
+//	blob    "base64"
+//
+// CSV exports have the columns bucket, key, type and value, the value of
+// strings written as is and the other ones as their JSON.
+type Format int
+
+const (
+	NDJSON Format = iota
+	CSV
+)
+
+// importBatchSize is the number of records Import writes with one sync.
+const importBatchSize = 256
+
+var ErrBadImport = fmt.Errorf("malformed import record")
+
+var csvHeader = []string{"bucket", "key", "type", "value"}
+
+// ParseFormat reads "ndjson", the default when empty, or "csv".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "", "ndjson", "json":
+		return NDJSON, nil
+	case "csv":
+		return CSV, nil
+	}
+	return 0, fmt.Errorf("unknown export format %q", s)
+}
+
+func (f Format) String() string {
+	if f == CSV {
+		return "csv"
+	}
+	return "ndjson"
+}
+
+type dumpRecord struct {
+	Bucket string          `json:"bucket,omitempty"`
+	Key    string          `json:"key"`
+	Type   string          `json:"type"`
+	Value  json.RawMessage `json:"value"`
+}
+
+type dumpTyped struct {
+	Type string `json:"type"`
+	Data []byte `json:"data"`
+}
+
+type dumpSeries struct {
+	Retention time.Duration `json:"retention"`
+	Points    []dumpPoint   `json:"points"`
+}
+
+// dumpPoint is written as [unix ns, value], the time as an integer so that it
+// stays exact.
+type dumpPoint struct {
+	time  int64
+	value float64
+}
+
+func (p dumpPoint) MarshalJSON() ([]byte, error) {
+	v, err := json.Marshal(p.value)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("[%d,%s]", p.time, v)), nil
+}
+
+func (p *dumpPoint) UnmarshalJSON(data []byte) error {
+	var pair [2]json.Number
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	t, err := pair[0].Int64()
+	if err != nil {
+		return err
+	}
+	p.time = t
+	p.value, err = pair[1].Float64()
+	return err
+}
+
+type recordWriter interface {
+	write(r dumpRecord) error
+	flush() error
+}
+
+type ndjsonWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w ndjsonWriter) write(r dumpRecord) error { return w.enc.Encode(r) }
+func (w ndjsonWriter) flush() error             { return w.w.Flush() }
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (w csvWriter) write(r dumpRecord) error {
+	value := string(r.Value)
+	if r.Type == "string" {
+		if err := json.Unmarshal(r.Value, &value); err != nil {
+			return err
+		}
+	}
+	return w.w.Write([]string{r.Bucket, r.Key, r.Type, value})
+}
+
+func (w csvWriter) flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// Export writes all live keys of all buckets, and the blobs, to w in format.
+// Keys are read one at a time, so the export is not a snapshot: writes made
+// meanwhile may or may not be part of it. Blobs are held in memory whole
+// while they are written.
+func (db *Db) Export(w io.Writer, format Format) error {
+	var out recordWriter
+	if format == CSV {
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return err
+		}
+		out = csvWriter{w: cw}
+	} else {
+		bw := bufio.NewWriter(w)
+		out = ndjsonWriter{w: bw, enc: json.NewEncoder(bw)}
+	}
+
+	db.bucketsMu.RLock()
+	names := make([]string, 0, len(db.buckets))
+	for name := range db.buckets {
+		names = append(names, name)
+	}
+	ids := make(map[string]uint32, len(db.buckets))
+	for name, id := range db.buckets {
+		ids[name] = id
+	}
+	db.bucketsMu.RUnlock()
+	sort.Strings(names)
+
+	ctx := context.Background()
+	for _, name := range append([]string{""}, names...) {
+		id := ids[name]
+		keys, err := db.keys(recordKey{bucket: id})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			r, err := db.exportKey(ctx, recordKey{bucket: id, key: key})
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("export %q: %w", key, err)
+			}
+			r.Bucket = name
+			if err := out.write(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	blobs, err := db.keys(recordKey{bucket: blobBucket, key: manifestPrefix})
+	if err != nil {
+		return err
+	}
+	for _, key := range blobs {
+		key = strings.TrimPrefix(key, manifestPrefix)
+		r, err := db.exportBlob(key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("export blob %q: %w", key, err)
+		}
+		if err := out.write(r); err != nil {
+			return err
+		}
+	}
+	return out.flush()
+}
+
+func (db *Db) exportKey(ctx context.Context, key recordKey) (dumpRecord, error) {
+	value, err := db.getValue(ctx, key)
+	if err != nil {
+		return dumpRecord{}, err
+	}
+	tag := value[len(value)-1:]
+	if key.bucket != 0 && tag != "s" && tag != "i" && tag != typedTag {
+		return dumpRecord{}, fmt.Errorf("%w: %s in a bucket", ErrWrongType, storedType(value))
+	}
+	var (
+		typ     string
+		content interface{}
+	)
+	switch tag {
+	case "s":
+		if s := value[:len(value)-1]; utf8.ValidString(s) {
+			typ, content = "string", s
+		} else {
+			typ, content = "bytes", []byte(s)
+		}
+	case "i":
+		typ, content = "int64", json.RawMessage(value[:len(value)-1])
+	case typedTag:
+		t, data, ok := splitTyped(value)
+		if !ok {
+			return dumpRecord{}, errCorrupted
+		}
+		typ, content = "typed", dumpTyped{Type: t, Data: []byte(data)}
+	case listTag:
+		typ = "list"
+		content, err = orEmpty(db.LRange(key.key, 0, -1))
+	case setTag:
+		typ = "set"
+		content, err = orEmpty(db.SMembers(key.key))
+	case queueTag:
+		typ = "queue"
+		content, err = orEmpty(db.queueBodies(ctx, key.key))
+	case hashTag:
+		typ = "hash"
+		content, err = db.HGetAll(key.key)
+	case seriesTag:
+		typ = "series"
+		content, err = db.exportSeries(key.key, value)
+	default:
+		return dumpRecord{}, fmt.Errorf("%w: %s", ErrWrongType, storedType(value))
+	}
+	if err != nil {
+		return dumpRecord{}, err
+	}
+	data, err := json.Marshal(content)
+	return dumpRecord{Key: key.key, Type: typ, Value: data}, err
+}
+
+// orEmpty makes empty collections export as [] rather than null.
+func orEmpty(values []string, err error) ([]string, error) {
+	if values == nil {
+		values = []string{}
+	}
+	return values, err
+}
+
+func (db *Db) exportSeries(key, head string) (dumpSeries, error) {
+	h, err := parseSeriesHead(head)
+	if err != nil {
+		return dumpSeries{}, err
+	}
+	points, err := db.TSRange(key, time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64))
+	if err != nil {
+		return dumpSeries{}, err
+	}
+	s := dumpSeries{Retention: h.retention, Points: make([]dumpPoint, len(points))}
+	for i, p := range points {
+		s.Points[i] = dumpPoint{time: p.Time.UnixNano(), value: p.Value}
+	}
+	return s, nil
+}
+
+// queueBodies returns the bodies of the messages of the queue under name, in
+// flight ones included.
+func (db *Db) queueBodies(ctx context.Context, name string) ([]string, error) {
+	h, ok, err := db.head(ctx, name, queueTag)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var bodies []string
+	for id := h.first; id < h.last; id++ {
+		m, err := db.message(ctx, h.listKey(name, id))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, m.body)
+	}
+	return bodies, nil
+}
+
+func (db *Db) exportBlob(key string) (dumpRecord, error) {
+	r, err := db.GetBlob(key)
+	if err != nil {
+		return dumpRecord{}, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return dumpRecord{}, err
+	}
+	value, err := json.Marshal(data)
+	return dumpRecord{Key: key, Type: "blob", Value: value}, err
+}
+
+type recordReader interface {
+	read() (dumpRecord, error)
+}
+
+type ndjsonReader struct {
+	dec *json.Decoder
+}
+
+func (r ndjsonReader) read() (dumpRecord, error) {
+	var rec dumpRecord
+	if err := r.dec.Decode(&rec); err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("%w: %s", ErrBadImport, err)
+		}
+		return rec, err
+	}
+	return rec, nil
+}
+
+type csvReader struct {
+	r *csv.Reader
+}
+
+func (r csvReader) read() (dumpRecord, error) {
+	fields, err := r.r.Read()
+	if err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("%w: %s", ErrBadImport, err)
+		}
+		return dumpRecord{}, err
+	}
+	rec := dumpRecord{Bucket: fields[0], Key: fields[1], Type: fields[2], Value: json.RawMessage(fields[3])}
+	if rec.Type == "string" {
+		rec.Value, err = json.Marshal(fields[3])
+	}
+	return rec, err
+}
+
+// Import writes the records of an export read from r in format and returns
+// their number. Imported keys replace the stored ones, buckets are created as
+// needed. Records are written in batches synced once; a failed import keeps
+// the batches written before it. Queued messages are imported as new ones,
+// without their deliveries.
+func (db *Db) Import(r io.Reader, format Format) (int, error) {
+	return db.ImportFunc(r, format, nil)
+}
+
+// ImportFunc is Import calling fn, when not nil, with the bucket, key and type
+// of every record once it is written, in the order of the records. An error
+// of fn stops the import.
+func (db *Db) ImportFunc(r io.Reader, format Format, fn func(bucket, key, typ string) error) (int, error) {
+	var in recordReader
+	if format == CSV {
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(csvHeader)
+		header, err := cr.Read()
+		if err == io.EOF {
+			return 0, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("%w: %s", ErrBadImport, err)
+		}
+		if strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+			return 0, fmt.Errorf("%w: bad header %q", ErrBadImport, header)
+		}
+		in = csvReader{r: cr}
+	} else {
+		in = ndjsonReader{dec: json.NewDecoder(r)}
+	}
+
+	ctx := context.Background()
+	// Collections are written directly, other writes to them wait.
+	db.collectionsMu.Lock()
+	defer db.collectionsMu.Unlock()
+	var (
+		batch   []entry
+		written []dumpRecord
+		buckets = make(map[string]uint32)
+		n       int
+	)
+	done := func(recs ...dumpRecord) error {
+		if fn == nil {
+			return nil
+		}
+		for _, rec := range recs {
+			if err := fn(rec.Bucket, rec.Key, rec.Type); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := db.putBatch(ctx, batch)
+		if err == nil {
+			err = done(written...)
+		}
+		batch, written = batch[:0], written[:0]
+		return err
+	}
+	for {
+		rec, err := in.read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		if rec.Key == "" {
+			return n, fmt.Errorf("%w: empty key", ErrBadImport)
+		}
+		if rec.Type == "blob" {
+			var data []byte
+			if err := json.Unmarshal(rec.Value, &data); err != nil {
+				return n, fmt.Errorf("%w: blob %q: %s", ErrBadImport, rec.Key, err)
+			}
+			if err := flush(); err != nil {
+				return n, err
+			}
+			if _, err := db.PutBlob(rec.Key, bytes.NewReader(data)); err != nil {
+				return n, err
+			}
+			if err := done(rec); err != nil {
+				return n, err
+			}
+			n++
+			continue
+		}
+		id, ok := buckets[rec.Bucket]
+		if !ok && rec.Bucket != "" {
+			b, err := db.Bucket(rec.Bucket)
+			if err != nil {
+				return n, err
+			}
+			id, buckets[rec.Bucket] = b.id, b.id
+		}
+		entries, err := importEntries(rec, id)
+		if err != nil {
+			return n, fmt.Errorf("%w: %q: %s", ErrBadImport, rec.Key, err)
+		}
+		batch = append(batch, entries...)
+		written = append(written, dumpRecord{Bucket: rec.Bucket, Key: rec.Key, Type: rec.Type})
+		n++
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush()
+}
+
+// importEntries gives the records storing rec, the head of a collection
+// before its elements.
+func importEntries(rec dumpRecord, bucket uint32) ([]entry, error) {
+	key := rec.Key
+	single := func(value string) []entry {
+		return []entry{{key: key, bucket: bucket, value: value}}
+	}
+	switch rec.Type {
+	case "string":
+		var s string
+		err := json.Unmarshal(rec.Value, &s)
+		return single(s + "s"), err
+	case "bytes":
+		var data []byte
+		err := json.Unmarshal(rec.Value, &data)
+		return single(string(data) + "s"), err
+	case "int64":
+		var n int64
+		err := json.Unmarshal(rec.Value, &n)
+		return single(strconv.FormatInt(n, 10) + "i"), err
+	case "typed":
+		var t dumpTyped
+		if err := json.Unmarshal(rec.Value, &t); err != nil {
+			return nil, err
+		}
+		value, typ, err := typedValue(t.Data, t.Type)
+		return []entry{{key: key, bucket: bucket, value: value, typ: typ}}, err
+	}
+	if bucket != 0 {
+		return nil, fmt.Errorf("%s in a bucket", rec.Type)
+	}
+
+	elements := func(h collectionHead, values []string, element func(i int, v string) (recordKey, string)) []entry {
+		entries := []entry{{key: key, value: h.encode()}}
+		for i, v := range values {
+			k, value := element(i, v)
+			entries = append(entries, entry{key: key, sub: k.sub, value: value})
+		}
+		return entries
+	}
+	switch rec.Type {
+	case "list", "queue":
+		var values []string
+		if err := json.Unmarshal(rec.Value, &values); err != nil {
+			return nil, err
+		}
+		h := collectionHead{tag: listTag, gen: newGeneration(), last: int64(len(values))}
+		if rec.Type == "queue" {
+			h.tag = queueTag
+		}
+		return elements(h, values, func(i int, v string) (recordKey, string) {
+			if h.tag == queueTag {
+				return h.listKey(key, int64(i)), queuedMessage{body: v}.encode()
+			}
+			return h.listKey(key, int64(i)), v + "s"
+		}), nil
+	case "set":
+		var members []string
+		if err := json.Unmarshal(rec.Value, &members); err != nil {
+			return nil, err
+		}
+		h := collectionHead{tag: setTag, gen: newGeneration()}
+		return elements(h, members, func(_ int, v string) (recordKey, string) {
+			return h.elementKey(key, v), "s"
+		}), nil
+	case "hash":
+		var fields map[string]string
+		if err := json.Unmarshal(rec.Value, &fields); err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		h := collectionHead{tag: hashTag, gen: newGeneration()}
+		return elements(h, names, func(_ int, name string) (recordKey, string) {
+			return h.elementKey(key, name), fields[name] + "s"
+		}), nil
+	case "series":
+		var s dumpSeries
+		if err := json.Unmarshal(rec.Value, &s); err != nil {
+			return nil, err
+		}
+		return seriesEntries(key, s.Retention, s.Points)
+	}
+	return nil, fmt.Errorf("unknown type %q", rec.Type)
+}
+
+// seriesEntries splits the points into chunks like TSAdd fills them.
+func seriesEntries(key string, retention time.Duration, points []dumpPoint) ([]entry, error) {
+	h := seriesHead{gen: newGeneration(), retention: retention}
+	var chunks []entry
+	for start := 0; start < len(points); start += maxChunkPoints {
+		end := start + maxChunkPoints
+		if end > len(points) {
+			end = len(points)
+		}
+		chunk := make([]Point, 0, end-start)
+		for i := start; i < end; i++ {
+			if i > 0 && points[i].time <= points[i-1].time {
+				return nil, ErrOutOfOrder
+			}
+			chunk = append(chunk, Point{Time: time.Unix(0, points[i].time), Value: points[i].value})
+		}
+		h.open = points[start].time
+		k := h.chunkKey(key, h.open)
+		chunks = append(chunks, entry{key: key, sub: k.sub, value: string(encodeChunk(chunk)) + "s"})
+	}
+	return append([]entry{{key: key, value: h.encode()}}, chunks...), nil
+}
@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_ExportImport(t *testing.T) {
+	src, err := NewDbWithOptions("/db", 250, Options{FS: NewFaultFS(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	type order struct {
+		ID    int
+		Items []string
+	}
+	src.Put("greeting", "hello, \"world\"\nbye")
+	src.Put("raw", "\xff\xfe")
+	src.PutInt64("counter", 42)
+	NewTyped[order](src, JSONCodec[order]{}).Put("order", order{ID: 7, Items: []string{"tea"}})
+	src.LPush("list", "c", "b", "a")
+	src.HSet("hash", "f1", "v1")
+	src.HSet("hash", "f2", "v2")
+	src.SAdd("set", "x", "y")
+	q := src.Queue("jobs", QueueOptions{})
+	q.Enqueue("first")
+	q.Enqueue("second")
+	q.Dequeue()
+	src.TSCreate("temp", time.Hour)
+	for i := 0; i < 5; i++ {
+		src.TSAdd("temp", time.Unix(0, int64(i)*int64(time.Minute)+1), float64(i)/2)
+	}
+	users, _ := src.Bucket("users")
+	users.Put("alice", "admin")
+	blob := strings.Repeat("blob data ", 1000)
+	src.PutBlob("file", strings.NewReader(blob))
+
+	for _, format := range []Format{NDJSON, CSV} {
+		format := format
+		t.Run(format.String(), func(t *testing.T) {
+			var out bytes.Buffer
+			if err := src.Export(&out, format); err != nil {
+				t.Fatal(err)
+			}
+			dst, err := NewDbWithOptions("/db", 250, Options{FS: NewFaultFS(1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+			n, err := dst.Import(bytes.NewReader(out.Bytes()), format)
+			if err != nil || n != 11 {
+				t.Fatalf("Imported %d records (%v)", n, err)
+			}
+
+			if v, err := dst.Get("greeting"); err != nil || v != "hello, \"world\"\nbye" {
+				t.Errorf("Bad string %q (%v)", v, err)
+			}
+			if v, err := dst.Get("raw"); err != nil || v != "\xff\xfe" {
+				t.Errorf("Bad bytes %q (%v)", v, err)
+			}
+			if v, err := dst.GetInt64("counter"); err != nil || v != 42 {
+				t.Errorf("Bad int64 %d (%v)", v, err)
+			}
+			if v, err := NewTyped[order](dst, JSONCodec[order]{}).Get("order"); err != nil || v.ID != 7 {
+				t.Errorf("Bad typed value %+v (%v)", v, err)
+			}
+			if v, _ := dst.LRange("list", 0, -1); !reflect.DeepEqual(v, []string{"a", "b", "c"}) {
+				t.Errorf("Bad list %v", v)
+			}
+			if v, _ := dst.HGetAll("hash"); !reflect.DeepEqual(v, map[string]string{"f1": "v1", "f2": "v2"}) {
+				t.Errorf("Bad hash %v", v)
+			}
+			if v, _ := dst.SMembers("set"); !reflect.DeepEqual(v, []string{"x", "y"}) {
+				t.Errorf("Bad set %v", v)
+			}
+			if n, _ := dst.Queue("jobs", QueueOptions{}).Len(); n != 2 {
+				t.Errorf("Expected both messages to be queued again, got %d", n)
+			}
+			points, _ := dst.TSRange("temp", time.Unix(0, 0), time.Unix(0, int64(time.Hour)))
+			if len(points) != 5 || points[4].Value != 2 || points[4].Time.UnixNano() != 4*int64(time.Minute)+1 {
+				t.Errorf("Bad series %v", points)
+			}
+			if b, err := dst.LookupBucket("users"); err != nil {
+				t.Error(err)
+			} else if v, err := b.Get("alice"); err != nil || v != "admin" {
+				t.Errorf("Bad bucket value %q (%v)", v, err)
+			}
+			if r, err := dst.GetBlob("file"); err != nil {
+				t.Error(err)
+			} else if data, _ := io.ReadAll(r); string(data) != blob {
+				t.Errorf("Bad blob of %d bytes", len(data))
+			}
+
+			var again bytes.Buffer
+			if err := dst.Export(&again, format); err != nil {
+				t.Fatal(err)
+			}
+			if again.String() != out.String() {
+				t.Errorf("Export of the import differs:\n%s\n%s", out.String(), again.String())
+			}
+		})
+	}
+}
+
+func TestDb_ImportBatches(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 1000, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	var in strings.Builder
+	for i := 0; i < 2*importBatchSize+10; i++ {
+		in.WriteString(`{"key":"k` + strconv.Itoa(i) + `","type":"int64","value":` + strconv.Itoa(i) + "}\n")
+	}
+	var keys []string
+	n, err := db.ImportFunc(strings.NewReader(in.String()), NDJSON, func(bucket, key, typ string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || n != 2*importBatchSize+10 {
+		t.Fatalf("Imported %d records (%v)", n, err)
+	}
+	if len(keys) != n || keys[n-1] != "k"+strconv.Itoa(n-1) {
+		t.Errorf("Expected every written key to be reported in order, got %d", len(keys))
+	}
+	db.Close()
+	if db, err = NewDbWithOptions("/db", 1000, Options{FS: fs}); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, importBatchSize, 2*importBatchSize + 9} {
+		if v, err := db.GetInt64("k" + strconv.Itoa(i)); err != nil || v != int64(i) {
+			t.Errorf("Bad value of k%d: %d (%v)", i, v, err)
+		}
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, bad := range []string{
+			`{"key":"x","type":"int64","value":"nan"}`,
+			`{"key":"x","type":"car","value":1}`,
+			`{"key":"","type":"string","value":"v"}`,
+			`{"key":"x"`,
+		} {
+			if _, err := db.Import(strings.NewReader(bad), NDJSON); !errors.Is(err, ErrBadImport) {
+				t.Errorf("Expected ErrBadImport for %s, got %v", bad, err)
+			}
+		}
+		if _, err := db.Import(strings.NewReader("key,value\n"), CSV); !errors.Is(err, ErrBadImport) {
+			t.Errorf("Expected a bad CSV header to be rejected, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,309 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+var ErrCrashed = errors.New("filesystem crashed")
+
+// FaultFS is an in-memory FS for crash-consistency tests. It can fail a chosen
+// write, leave torn (partially applied) writes behind and simulate a crash that
+// drops everything which was not synced. Directory operations (create, rename,
+// remove) are treated as immediately durable.
+type FaultFS struct {
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	nodes   map[string]*memNode
+	locks   map[string]bool
+	crashed bool
+	torn    bool
+	failIn  int
+	failErr error
+}
+
+type memNode struct {
+	data    []byte
+	durable []byte
+}
+
+type memFile struct {
+	fs       *FaultFS
+	node     *memNode
+	name     string
+	pos      int64
+	readOnly bool
+	append   bool
+	closed   bool
+}
+
+func NewFaultFS(seed int64) *FaultFS {
+	return &FaultFS{
+		rnd:   rand.New(rand.NewSource(seed)),
+		nodes: make(map[string]*memNode),
+		locks: make(map[string]bool),
+	}
+}
+
+// FailWrite makes the n-th write from now fail with err (ENOSPC when err is nil).
+func (fs *FaultFS) FailWrite(n int, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err == nil {
+		err = syscall.ENOSPC
+	}
+	fs.failIn = n
+	fs.failErr = err
+}
+
+// SetTornWrites controls whether failed writes and crashes keep a random prefix
+// of the bytes that were being written instead of none of them.
+func (fs *FaultFS) SetTornWrites(torn bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.torn = torn
+}
+
+// Crash simulates a power loss. The receiver and every file opened through it
+// stop working, and the returned FS holds only what had been synced (plus torn
+// tails of unsynced data when torn writes are enabled).
+func (fs *FaultFS) Crash() *FaultFS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crashed = true
+
+	after := &FaultFS{
+		rnd:   fs.rnd,
+		nodes: make(map[string]*memNode, len(fs.nodes)),
+		locks: make(map[string]bool),
+		torn:  fs.torn,
+	}
+	for name, n := range fs.nodes {
+		data := append([]byte(nil), n.durable...)
+		if fs.torn && len(n.data) > len(n.durable) && string(n.data[:len(n.durable)]) == string(n.durable) {
+			tail := n.data[len(n.durable):]
+			data = append(data, tail[:fs.rnd.Intn(len(tail)+1)]...)
+		}
+		after.nodes[name] = &memNode{data: data, durable: append([]byte(nil), data...)}
+	}
+	return after
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, _ os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrCrashed}
+	}
+	name = filepath.Clean(name)
+	n, ok := fs.nodes[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		n = &memNode{}
+		fs.nodes[name] = n
+	}
+	readOnly := flag&(os.O_WRONLY|os.O_RDWR) == 0
+	if flag&os.O_TRUNC != 0 && !readOnly {
+		n.data = n.data[:0]
+	}
+	return &memFile{
+		fs:       fs,
+		node:     n,
+		name:     name,
+		readOnly: readOnly,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return &os.PathError{Op: "remove", Path: name, Err: ErrCrashed}
+	}
+	name = filepath.Clean(name)
+	if _, ok := fs.nodes[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.nodes, name)
+	return nil
+}
+
+func (fs *FaultFS) Rename(oldPath, newPath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: ErrCrashed}
+	}
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	n, ok := fs.nodes[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist}
+	}
+	delete(fs.nodes, oldPath)
+	fs.nodes[newPath] = n
+	return nil
+}
+
+func (fs *FaultFS) ReadDir(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: ErrCrashed}
+	}
+	dir = filepath.Clean(dir)
+	var names []string
+	for name := range fs.nodes {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+type memLock struct {
+	fs   *FaultFS
+	name string
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: ErrCrashed}
+	}
+	name = filepath.Clean(name)
+	if fs.locks[name] {
+		return nil, ErrLocked
+	}
+	if _, ok := fs.nodes[name]; !ok {
+		fs.nodes[name] = &memNode{}
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	delete(l.fs.locks, l.name)
+	return nil
+}
+
+func (f *memFile) check(op string) error {
+	if f.fs.crashed {
+		return &os.PathError{Op: op, Path: f.name, Err: ErrCrashed}
+	}
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if f.pos >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	if f.readOnly {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if f.append {
+		f.pos = int64(len(f.node.data))
+	}
+
+	n, err := len(p), error(nil)
+	if f.fs.failIn > 0 {
+		f.fs.failIn--
+		if f.fs.failIn == 0 {
+			n, err = 0, &os.PathError{Op: "write", Path: f.name, Err: f.fs.failErr}
+			if f.fs.torn && len(p) > 0 {
+				n = f.fs.rnd.Intn(len(p))
+			}
+		}
+	}
+
+	end := f.pos + int64(n)
+	if end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.pos:end], p[:n])
+	f.pos = end
+	return n, err
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("sync"); err != nil {
+		return err
+	}
+	f.node.durable = append(f.node.durable[:0], f.node.data...)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,192 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Segment files start with a header naming the format of their records:
+//
+//	magic "KVS\xff" | format version uint16 | reserved uint16
+//
+// Files written before the header was introduced have none, their records
+// start right away; they are read as format 0. Taken for the size of a
+// record, the magic gives over 2GB, so no headerless segment starts with it.
+//
+// Readers handle all the formats below. New segments and the output of merges
+// use the newest one, so merges upgrade a store progressively; an active
+// segment of an older format is appended to in its own format until it is
+// sealed.
+const (
+	segmentMagic      = "KVS\xff"
+	segmentHeaderSize = 8
+
+	// formatV0 segments hold records only.
+	formatV0 = 0
+	// formatV1 records are followed by the CRC-32C of their bytes.
+	formatV1 = 1
+
+	currentFormat = formatV1
+)
+
+var (
+	ErrUnsupportedFormat = fmt.Errorf("unsupported segment format")
+
+	errChecksum = fmt.Errorf("%w: record checksum mismatch", errCorrupted)
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// segmentFormat is the version of a segment file.
+type segmentFormat uint16
+
+// start is the offset of the first record.
+func (f segmentFormat) start() int64 {
+	if f == formatV0 {
+		return 0
+	}
+	return segmentHeaderSize
+}
+
+// trailer is the number of bytes following every record.
+func (f segmentFormat) trailer() int64 {
+	if f == formatV0 {
+		return 0
+	}
+	return crc32.Size
+}
+
+// encode returns the bytes of the record in the file.
+func (f segmentFormat) encode(rec entry) []byte {
+	data := rec.Encode()
+	if f == formatV0 {
+		return data
+	}
+	return binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, crcTable))
+}
+
+func segmentHeader(f segmentFormat) []byte {
+	return binary.LittleEndian.AppendUint32([]byte(segmentMagic), uint32(f))
+}
+
+// readSegmentHeader returns the format of the segment file. empty is set for
+// files without records: files of no bytes and files cut off within the
+// header, whose writer crashed before it synced anything.
+func readSegmentHeader(f io.ReaderAt) (format segmentFormat, empty bool, err error) {
+	var header [segmentHeaderSize]byte
+	n, err := f.ReadAt(header[:], 0)
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	if n == 0 {
+		return currentFormat, true, nil
+	}
+	m := n
+	if m > len(segmentMagic) {
+		m = len(segmentMagic)
+	}
+	if string(header[:m]) != segmentMagic[:m] {
+		return formatV0, false, nil
+	}
+	if n < segmentHeaderSize {
+		return currentFormat, true, nil
+	}
+	version := binary.LittleEndian.Uint16(header[len(segmentMagic):])
+	if version > currentFormat {
+		return 0, false, fmt.Errorf("%w %d", ErrUnsupportedFormat, version)
+	}
+	return segmentFormat(version), false, nil
+}
+
+// scanSegment calls fn for every complete record of the segment file f and
+// returns its format and the size of the readable part of the file.
+func scanSegment(f io.ReaderAt, fn func(offset int64, e entry) error) (segmentFormat, int64, error) {
+	format, empty, err := readSegmentHeader(f)
+	if err != nil || empty {
+		return format, 0, err
+	}
+	size, err := format.scan(f, fn)
+	return format, size, err
+}
+
+// scanRecords calls fn for every complete record of f, a file of format 0
+// records like the value-log files, and returns the size of the readable
+// part of the file.
+func scanRecords(f io.ReaderAt, fn func(offset int64, e entry) error) (int64, error) {
+	return segmentFormat(formatV0).scan(f, fn)
+}
+
+func (format segmentFormat) scan(f io.ReaderAt, fn func(offset int64, e entry) error) (int64, error) {
+	offset := format.start()
+	in := bufio.NewReaderSize(io.NewSectionReader(f, offset, math.MaxInt64-offset), bufSize)
+	for {
+		e, n, err := format.next(in)
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+		if err := fn(offset, e); err != nil {
+			return offset, err
+		}
+		offset += n
+	}
+}
+
+// next reads the record in front of in and returns it with the number of
+// bytes it takes in the file. It fails with io.EOF at the end of the file and
+// with errTornRecord for a record cut short. With errChecksum the framing of
+// the record is fine and it is returned as decoded.
+func (format segmentFormat) next(in *bufio.Reader) (entry, int64, error) {
+	var header [4]byte
+	if n, err := io.ReadFull(in, header[:]); err == io.ErrUnexpectedEOF {
+		return entry{}, int64(n), errTornRecord
+	} else if err != nil {
+		return entry{}, 0, err
+	}
+	size := binary.LittleEndian.Uint32(header[:]) &^ extFlag
+	if size < 12 {
+		return entry{}, 4, errCorrupted
+	}
+	// The record is read as its bytes come, so that a corrupted size cannot
+	// allocate more than the rest of the file holds.
+	n := int64(size) + format.trailer()
+	capacity := n
+	if capacity > bufSize {
+		capacity = bufSize
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, capacity))
+	buf.Write(header[:])
+	if read, err := io.CopyN(buf, in, n-4); err == io.EOF {
+		return entry{}, 4 + read, errTornRecord
+	} else if err != nil {
+		return entry{}, 4 + read, err
+	}
+	data := buf.Bytes()
+	var sumErr error
+	if format.trailer() > 0 {
+		sum := binary.LittleEndian.Uint32(data[size:])
+		if data = data[:size]; crc32.Checksum(data, crcTable) != sum {
+			sumErr = errChecksum
+		}
+	}
+	var e entry
+	if err := e.decode(data); err != nil {
+		return entry{}, n, err
+	}
+	return e, n, sumErr
+}
+
+// writeSegmentHeader starts the empty segment file f.
+func writeSegmentHeader(f File, format segmentFormat) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Write(segmentHeader(format))
+	return err
+}
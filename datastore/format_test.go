@@ -0,0 +1,152 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile stores data as the synced content of name.
+func writeFile(t *testing.T, fs *FaultFS, name string, data []byte) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDb_SegmentFormat(t *testing.T) {
+	t.Run("headerless segments", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		var old []byte
+		for i := 0; i < 3; i++ {
+			e := entry{key: "k" + strconv.Itoa(i), value: "old" + strconv.Itoa(i) + "s"}
+			old = append(old, e.Encode()...)
+		}
+		writeFile(t, fs, "/db/current-data0", old[:len(old)/3])
+		writeFile(t, fs, "/db/current-data1", old)
+
+		db, err := NewDbWithOptions("/db", 60, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { db.Close() }()
+		if v, err := db.Get("k2"); err != nil || v != "old2" {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+		if f := db.activeSegment.format; f != formatV0 {
+			t.Errorf("Expected the active headerless segment to keep format 0, got %d", f)
+		}
+
+		for i := 0; i < 20; i++ {
+			if err := db.Put("new"+strconv.Itoa(i%4), "v"+strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		upgraded := func() bool {
+			names, _ := fs.ReadDir("/db")
+			for _, name := range names {
+				f, err := fs.OpenFile("/db/"+name, os.O_RDONLY, 0)
+				if err != nil || !strings.HasPrefix(name, outFileName) {
+					continue
+				}
+				format, _, _ := readSegmentHeader(f)
+				f.Close()
+				if format != currentFormat {
+					return false
+				}
+			}
+			return true
+		}
+		for i := 0; i < 100 && !upgraded(); i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if !upgraded() {
+			t.Error("Expected merges to rewrite the headerless segments")
+		}
+
+		db.Close()
+		if db, err = NewDbWithOptions("/db", 60, Options{FS: fs}); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]string{"k0": "old0", "k2": "old2", "new3": "v19"} {
+			if v, err := db.Get(key); err != nil || v != want {
+				t.Errorf("Bad value of %s %q (%v)", key, v, err)
+			}
+		}
+	})
+
+	t.Run("torn header", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		writeFile(t, fs, "/db/current-data0", []byte(segmentMagic[:3]))
+		db, err := NewDbWithOptions("/db", 60, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Put("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := db.Get("k"); err != nil || v != "v" {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+	})
+
+	t.Run("newer format", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		writeFile(t, fs, "/db/current-data0", segmentHeader(currentFormat+1))
+		if _, err := NewDbWithOptions("/db", 60, Options{FS: fs}); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+		}
+	})
+
+	t.Run("corrupted size", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		data := append(segmentHeader(currentFormat), segmentFormat(currentFormat).encode(entry{key: "k", value: "vs"})...)
+		// A size of almost 2GB in front of a few bytes.
+		data = append(data, 0xf0, 0xff, 0xff, 0x7f, 1, 2, 3)
+		writeFile(t, fs, "/db/current-data0", data)
+		writeFile(t, fs, "/db/current-data1", segmentHeader(currentFormat))
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		db, err := NewDbWithOptions("/db", 60, Options{FS: fs})
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if n := after.TotalAlloc - before.TotalAlloc; n > 64<<20 {
+			t.Errorf("Expected the size to allocate no more than the file holds, allocated %d bytes", n)
+		}
+		if v, err := db.Get("k"); err != nil || v != "v" {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		data := append(segmentHeader(currentFormat), segmentFormat(currentFormat).encode(entry{key: "k", value: "vs"})...)
+		data[len(data)-6] ^= 1
+		writeFile(t, fs, "/db/current-data0", data)
+		db, err := NewDbWithOptions("/db", 60, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Get("k"); !errors.Is(err, errCorrupted) {
+			t.Errorf("Expected the corrupted record to be detected, got %v", err)
+		}
+	})
+}
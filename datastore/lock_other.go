@@ -0,0 +1,11 @@
+//go:build !unix
+
+package datastore
+
+import "os"
+
+// lockFile is a no-op where flock is not available, the directory is then not
+// protected against a second writer.
+func lockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,312 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// operandTag marks merge operand records. They are kept in the segments and
+// folded into the value of their key when it is read; merges of segments
+// collapse them into a single value.
+const operandTag = "o"
+
+var ErrNoMergeOperator = fmt.Errorf("no merge operator configured")
+
+// MergeOperator folds merge operands into the value of a key, see Db.Merge.
+type MergeOperator interface {
+	// Merge applies operands, oldest first, to the existing value of key,
+	// which is nil when the key has no value. It must be deterministic, the
+	// same operands are folded again on every read until a merge of
+	// segments stores the result.
+	Merge(key string, existing *string, operands []string) (string, error)
+}
+
+// Int64Add adds the operands to the existing value as decimal integers.
+type Int64Add struct{}
+
+func (Int64Add) Merge(_ string, existing *string, operands []string) (string, error) {
+	var sum int64
+	if existing != nil {
+		v, err := strconv.ParseInt(*existing, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		sum = v
+	}
+	for _, op := range operands {
+		v, err := strconv.ParseInt(op, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		sum += v
+	}
+	return strconv.FormatInt(sum, 10), nil
+}
+
+// StringAppend appends the operands to the existing value, separated by
+// Separator.
+type StringAppend struct {
+	Separator string
+}
+
+func (a StringAppend) Merge(_ string, existing *string, operands []string) (string, error) {
+	var res string
+	first := existing == nil
+	if existing != nil {
+		res = *existing
+	}
+	for _, op := range operands {
+		if !first {
+			res += a.Separator
+		}
+		res += op
+		first = false
+	}
+	return res, nil
+}
+
+// JSONMergePatch applies the operands as JSON merge patches (RFC 7386) to the
+// existing JSON document.
+type JSONMergePatch struct{}
+
+func (JSONMergePatch) Merge(_ string, existing *string, operands []string) (string, error) {
+	var doc interface{}
+	if existing != nil {
+		if err := json.Unmarshal([]byte(*existing), &doc); err != nil {
+			return "", err
+		}
+	}
+	for _, op := range operands {
+		var patch interface{}
+		if err := json.Unmarshal([]byte(op), &patch); err != nil {
+			return "", err
+		}
+		doc = mergePatch(doc, patch)
+	}
+	res, err := json.Marshal(doc)
+	return string(res), err
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	doc, ok := target.(map[string]interface{})
+	if !ok {
+		doc = make(map[string]interface{})
+	}
+	for k, v := range fields {
+		if v == nil {
+			delete(doc, k)
+		} else {
+			doc[k] = mergePatch(doc[k], v)
+		}
+	}
+	return doc
+}
+
+func isOperand(value string) bool {
+	return strings.HasSuffix(value, operandTag)
+}
+
+// operandChain tracks the operands a segment holds for a key on top of the
+// newest other record of the key in the segment, if there is one.
+type operandChain struct {
+	base     *recordPos
+	operands []int64
+}
+
+// Merge records operand for key without reading its value. Reads fold the
+// operands written since the last Put into the value with the merge operator
+// of the Db. The result has the type of the value the operands were merged
+// into, it is a string when there was none.
+func (db *Db) Merge(key, operand string) error {
+	return db.MergeCtx(context.Background(), key, operand)
+}
+
+func (db *Db) MergeCtx(ctx context.Context, key, operand string) error {
+	return db.merge(ctx, recordKey{key: key}, operand)
+}
+
+func (b *Bucket) Merge(key, operand string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.merge(context.Background(), recordKey{bucket: b.id, key: key}, operand)
+}
+
+func (db *Db) merge(ctx context.Context, key recordKey, operand string) error {
+	if db.mergeOp == nil {
+		return ErrNoMergeOperator
+	}
+	return db.put(ctx, entry{key: key.key, bucket: key.bucket, value: operand + operandTag})
+}
+
+// fold applies the operands to base, a type tagged value or "" when the key
+// has none. Only strings and integers take operands.
+func (db *Db) fold(key, base string, operands []string) (string, error) {
+	if db.mergeOp == nil {
+		return "", ErrNoMergeOperator
+	}
+	tag := "s"
+	var existing *string
+	if base != "" {
+		tag = base[len(base)-1:]
+		if tag != "s" && tag != "i" {
+			return "", ErrWrongType
+		}
+		value := base[:len(base)-1]
+		existing = &value
+	}
+	ops := make([]string, len(operands))
+	for i, op := range operands {
+		ops[i] = op[:len(op)-1]
+	}
+	value, err := db.mergeOp.Merge(key, existing, ops)
+	if err != nil {
+		return "", err
+	}
+	return value + tag, nil
+}
+
+// findChain returns the position of the newest record of key in segments
+// that is not a merge operand, with the operands written on top of it, oldest
+// first. The segment is nil when there is no such record or it is a deletion,
+// the result is nil when the key has no operands either. The chain has to be
+// looked up in every segment holding the key, down to the newest range
+// tombstone covering it.
+func findChain(segments []*Segment, key recordKey) *keyPosition {
+	var res keyPosition
+	ti, toff := lastRangeDelete(segments, key)
+	for i := len(segments) - 1; i >= 0 && i >= ti; i-- {
+		s := segments[i]
+		pos, ok := s.index[key]
+		if !ok || (i == ti && pos.offset < toff) {
+			continue
+		}
+		if r := s.damageAt(pos.offset); r != nil {
+			// Older copies are served in place of a damaged record.
+			if res.damaged == nil {
+				res.damaged = &CorruptionError{*r}
+			}
+			continue
+		}
+		base := &pos
+		if pos.operand {
+			c := s.chains[key]
+			ops := make([]keyPosition, 0, len(c.operands)+len(res.operands))
+			for _, offset := range c.operands {
+				if i != ti || offset > toff {
+					ops = append(ops, keyPosition{segment: s, position: offset})
+				}
+			}
+			res.operands = append(ops, res.operands...)
+			if base = c.base; base == nil || (i == ti && base.offset < toff) {
+				continue
+			}
+		}
+		if !base.deleted {
+			res.segment, res.position = s, base.offset
+		}
+		break
+	}
+	if res.segment == nil && len(res.operands) == 0 && res.damaged == nil {
+		return nil
+	}
+	return &res
+}
+
+// addRecord puts a record written at pos into the indexes of s.
+func (s *Segment) addRecord(key recordKey, pos versionPos) {
+	prev, found := s.index[key]
+	s.index[key] = pos.recordPos
+	if s.sealedWith == nil {
+		s.sealedWith = make(map[uint32]bool)
+	}
+	s.sealedWith[pos.keyID] = true
+	if s.versions != nil {
+		s.versions[key] = append(s.versions[key], pos)
+	}
+	if !pos.operand {
+		delete(s.chains, key)
+		return
+	}
+	if s.chains == nil {
+		s.chains = make(map[recordKey]*operandChain)
+	}
+	c := s.chains[key]
+	if c == nil {
+		c = &operandChain{}
+		if found {
+			c.base = &prev
+		}
+		s.chains[key] = c
+	}
+	c.operands = append(c.operands, pos.offset)
+}
+
+// pin keeps the segments of the positions from being closed until release.
+func (kp *keyPosition) pin() {
+	if kp.segment != nil {
+		kp.segment.readers.Add(1)
+	}
+	for _, op := range kp.operands {
+		op.segment.readers.Add(1)
+	}
+}
+
+func (kp *keyPosition) release() {
+	if kp.segment != nil {
+		kp.segment.readers.Done()
+	}
+	for _, op := range kp.operands {
+		op.segment.readers.Done()
+	}
+}
+
+// mergeChain passes the value of key with the merge operands of sealed folded
+// into it to add. The chain is copied as it is when it cannot be folded:
+// without an operator, over a value kept in the value log or when the
+// operator fails, reads report the error then.
+func (db *Db) mergeChain(sealed []*Segment, key recordKey, add func(entry) error) error {
+	kp := findChain(sealed, key)
+	var (
+		base entry
+		err  error
+	)
+	if kp.segment != nil {
+		if base, err = kp.segment.readRecord(kp.position); err != nil {
+			return err
+		}
+	}
+	operands := make([]string, len(kp.operands))
+	for i, op := range kp.operands {
+		if operands[i], err = op.segment.getFromSegment(op.position); err != nil {
+			return err
+		}
+	}
+	e := entry{key: key.key, sub: key.sub, bucket: key.bucket}
+	if db.mergeOp != nil && !isPointer(base.value) {
+		if e.value, err = db.fold(key.key, joinType(base.value, base.typ), operands); err == nil {
+			return add(e)
+		}
+	}
+	if base.value != "" {
+		e.value, e.typ = base.value, base.typ
+		if err := add(e); err != nil {
+			return err
+		}
+	}
+	e.typ = ""
+	for _, operand := range operands {
+		e.value = operand
+		if err := add(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
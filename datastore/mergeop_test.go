@@ -0,0 +1,151 @@
+package datastore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDb_Merge(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 200, Options{FS: fs, MergeOperator: Int64Add{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	t.Run("counter", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			if err := db.Merge("counter", "2"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if value, err := db.Get("counter"); err != nil || value != "10" {
+			t.Errorf("Bad counter value %q (%v)", value, err)
+		}
+	})
+
+	t.Run("base value", func(t *testing.T) {
+		db.PutInt64("int", 40)
+		db.Merge("int", "2")
+		if value, err := db.GetInt64("int"); err != nil || value != 42 {
+			t.Errorf("Bad value %d (%v)", value, err)
+		}
+		db.Delete("int")
+		db.Merge("int", "1")
+		if value, err := db.GetInt64("int"); err == nil {
+			t.Errorf("Expected the deleted value to be gone, got %d", value)
+		}
+		if value, err := db.Get("int"); err != nil || value != "1" {
+			t.Errorf("Bad value after deletion %q (%v)", value, err)
+		}
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			db.Merge("hits", "1")
+		}
+		for i := 0; i < 200 && recordsOnDisk(t, fs, "hits") > 1; i++ {
+			db.Put("filler"+strconv.Itoa(i%10), "value")
+			time.Sleep(time.Millisecond)
+		}
+		if n := recordsOnDisk(t, fs, "hits"); n != 1 {
+			t.Errorf("Expected the operands to be collapsed into one record, found %d", n)
+		}
+		if value, err := db.Get("hits"); err != nil || value != "20" {
+			t.Errorf("Bad value after compaction %q (%v)", value, err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db.Merge("counter", "5")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbWithOptions("/db", 200, Options{FS: fs, MergeOperator: Int64Add{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("counter"); err != nil || value != "15" {
+			t.Errorf("Bad counter value after reopening %q (%v)", value, err)
+		}
+		db.Merge("pending", "1")
+	})
+
+	t.Run("no operator", func(t *testing.T) {
+		db.Close()
+		db, err = NewDbWithOptions("/db", 200, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Merge("counter", "1"); err != ErrNoMergeOperator {
+			t.Errorf("Expected ErrNoMergeOperator, got %v", err)
+		}
+		if _, err := db.Get("pending"); err != ErrNoMergeOperator {
+			t.Errorf("Expected ErrNoMergeOperator for a key with operands, got %v", err)
+		}
+	})
+}
+
+func TestMergeOperators(t *testing.T) {
+	base := `{"a":1,"b":{"c":2}}`
+	for _, tc := range []struct {
+		name     string
+		op       MergeOperator
+		existing *string
+		operands []string
+		want     string
+	}{
+		{"add", Int64Add{}, nil, []string{"1", "-3"}, "-2"},
+		{"append", StringAppend{Separator: ","}, nil, []string{"a", "b"}, "a,b"},
+		{"append to value", StringAppend{Separator: ","}, &base, []string{"x"}, base + ",x"},
+		{"json patch", JSONMergePatch{}, &base, []string{`{"b":{"c":null,"d":3}}`, `{"e":[1]}`}, `{"a":1,"b":{"d":3},"e":[1]}`},
+		{"json patch replaces", JSONMergePatch{}, &base, []string{`[1]`}, `[1]`},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := tc.op.Merge("key", tc.existing, tc.operands)
+			if err != nil || value != tc.want {
+				t.Errorf("Got %q (%v), expected %q", value, err, tc.want)
+			}
+		})
+	}
+	if _, err := (Int64Add{}).Merge("key", nil, []string{"x"}); err == nil {
+		t.Errorf("Expected an error for a non-numeric operand")
+	}
+}
+
+func TestDb_MergeVersions(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 200, Options{FS: fs, MergeOperator: StringAppend{}, KeepVersions: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("log", "a")
+	db.Merge("log", "b")
+	db.Merge("log", "c")
+	history, err := db.History("log")
+	if err != nil || len(history) != 3 {
+		t.Fatalf("Bad history %v (%v)", history, err)
+	}
+	for i, want := range []string{"a", "ab", "abc"} {
+		if history[i].Value != want {
+			t.Errorf("Bad value of version %d: %q, expected %q", i, history[i].Value, want)
+		}
+	}
+	if value, err := db.GetAt("log", history[1].Version); err != nil || value != "ab" {
+		t.Errorf("Bad value at version %d: %q (%v)", history[1].Version, value, err)
+	}
+}
+
+func recordsOnDisk(t *testing.T, fs *FaultFS, key string) int {
+	n := 0
+	forEachRecord(t, fs, "/db", func(e entry) {
+		if e.key == key && e.sub == "" {
+			n++
+		}
+	})
+	return n
+}
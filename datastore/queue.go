@@ -0,0 +1,369 @@
+package datastore
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultVisibilityTimeout = 30 * time.Second
+
+var (
+	ErrQueueEmpty  = fmt.Errorf("no message is available")
+	ErrNotInFlight = fmt.Errorf("message is not in flight with this receipt")
+)
+
+// QueueOptions tunes the delivery of the messages of a queue.
+type QueueOptions struct {
+	// VisibilityTimeout is how long a dequeued message is hidden from other
+	// consumers before it is delivered again unless acked, 30s when zero.
+	VisibilityTimeout time.Duration
+	// MaxDeliveries moves a message to the dead-letter queue instead of
+	// delivering it once more after that many deliveries. Zero delivers
+	// messages until they are acked.
+	MaxDeliveries int
+	// DeadLetter names the dead-letter queue, the queue name with ".dead"
+	// appended when empty.
+	DeadLetter string
+}
+
+// Queue is a durable queue delivering every message at least once.
+//
+// A queue is stored like a list: its head numbers the messages from first to
+// last-1 and every message is an element of the head's generation. The head
+// also records next, the first message never delivered. Acked messages are
+// deleted and first, the offset of the consumers, moves past them.
+type Queue struct {
+	db   *Db
+	name string
+	opts QueueOptions
+}
+
+// Message is a dequeued message. Its Receipt acks or nacks it while the
+// delivery is in flight.
+type Message struct {
+	ID         uint64
+	Body       string
+	Deliveries int
+	Receipt    string
+}
+
+// receipt names a delivery of message id, the deliveries-th one.
+func receipt(id int64, deliveries int) string {
+	return fmt.Sprintf("%d-%d", id, deliveries)
+}
+
+func parseReceipt(receipt string) (id int64, deliveries int, ok bool) {
+	a, b, found := strings.Cut(receipt, "-")
+	id, err := strconv.ParseInt(a, 10, 64)
+	if !found || err != nil {
+		return 0, 0, false
+	}
+	deliveries, err = strconv.Atoi(b)
+	return id, deliveries, err == nil
+}
+
+// queuedMessage is the value of a message: how often it was delivered and
+// until when it is hidden from other consumers.
+type queuedMessage struct {
+	deliveries int
+	// hidden is the end of the visibility timeout in unix nanoseconds.
+	hidden int64
+	body   string
+}
+
+func (m queuedMessage) encode() string {
+	return fmt.Sprintf("%d %d %s", m.deliveries, m.hidden, m.body) + "s"
+}
+
+func parseMessage(value string) (queuedMessage, error) {
+	var m queuedMessage
+	fields := strings.SplitN(value, " ", 3)
+	if len(fields) != 3 {
+		return m, fmt.Errorf("bad queued message")
+	}
+	if _, err := fmt.Sscanf(fields[0]+" "+fields[1], "%d %d", &m.deliveries, &m.hidden); err != nil {
+		return m, fmt.Errorf("bad queued message: %w", err)
+	}
+	m.body = fields[2]
+	return m, nil
+}
+
+// Queue returns the queue stored under key name. It is created by the first
+// Enqueue.
+func (db *Db) Queue(name string, opts QueueOptions) *Queue {
+	if opts.VisibilityTimeout <= 0 {
+		opts.VisibilityTimeout = defaultVisibilityTimeout
+	}
+	if opts.DeadLetter == "" {
+		opts.DeadLetter = name + ".dead"
+	}
+	return &Queue{db: db, name: name, opts: opts}
+}
+
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// DeadLetters returns the dead-letter queue of q.
+func (q *Queue) DeadLetters() *Queue {
+	return q.db.Queue(q.opts.DeadLetter, QueueOptions{VisibilityTimeout: q.opts.VisibilityTimeout})
+}
+
+// Enqueue appends a message to the queue and returns its id.
+func (q *Queue) Enqueue(body string) (uint64, error) {
+	q.db.collectionsMu.Lock()
+	defer q.db.collectionsMu.Unlock()
+	return q.db.enqueue(context.Background(), q.name, body)
+}
+
+func (db *Db) enqueue(ctx context.Context, name, body string) (uint64, error) {
+	h, ok, err := db.head(ctx, name, queueTag)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		if err := db.putHead(ctx, name, h); err != nil {
+			return 0, err
+		}
+	}
+	// Like a list element, the message is written before the head that
+	// makes it part of the queue.
+	if err := db.putElement(ctx, h.listKey(name, h.last), queuedMessage{body: body}.encode()); err != nil {
+		return 0, err
+	}
+	h.last++
+	if err := db.putHead(ctx, name, h); err != nil {
+		return 0, err
+	}
+	return uint64(h.last - 1), nil
+}
+
+// Dequeue delivers the message whose visibility timeout ended first, or the
+// oldest message never delivered when there is none. It fails with
+// ErrQueueEmpty when no message is available.
+func (q *Queue) Dequeue() (Message, error) {
+	ctx := context.Background()
+	db := q.db
+	db.collectionsMu.Lock()
+	defer db.collectionsMu.Unlock()
+	h, ok, err := db.head(ctx, q.name, queueTag)
+	if err != nil {
+		return Message{}, err
+	} else if !ok {
+		return Message{}, ErrQueueEmpty
+	}
+	f, err := db.flights(ctx, q.name, h)
+	if err != nil {
+		return Message{}, err
+	}
+	now := time.Now().UnixNano()
+	for {
+		var id, hidden int64
+		switch {
+		case f.Len() > 0 && f.heap[0].hidden <= now:
+			next := heap.Pop(f).(flight)
+			id, hidden = next.id, next.hidden
+		case h.next < h.last:
+			id = h.next
+			h.next++
+			if err := db.putHead(ctx, q.name, h); err != nil {
+				return Message{}, err
+			}
+		default:
+			return Message{}, ErrQueueEmpty
+		}
+		key := h.listKey(q.name, id)
+		m, err := db.message(ctx, key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return Message{}, err
+		}
+		if m.hidden != hidden {
+			// Delivered or nacked since, that pushed another flight.
+			continue
+		}
+		if q.opts.MaxDeliveries > 0 && m.deliveries >= q.opts.MaxDeliveries {
+			if _, err := db.enqueue(ctx, q.opts.DeadLetter, m.body); err != nil {
+				return Message{}, err
+			}
+			if h, err = db.removeMessage(ctx, q.name, h, id); err != nil {
+				return Message{}, err
+			}
+			continue
+		}
+		m.deliveries++
+		m.hidden = now + int64(q.opts.VisibilityTimeout)
+		if err := db.putElement(ctx, key, m.encode()); err != nil {
+			return Message{}, err
+		}
+		heap.Push(f, flight{id: id, hidden: m.hidden})
+		return Message{ID: uint64(id), Body: m.body, Deliveries: m.deliveries, Receipt: receipt(id, m.deliveries)}, nil
+	}
+}
+
+// flight is a delivered message, due for redelivery at hidden.
+type flight struct {
+	id     int64
+	hidden int64
+}
+
+// flights keeps the delivered messages of a generation of a queue in memory,
+// the one due first on top, so Dequeue finds the messages to redeliver
+// without reading the ones in flight. A message gets a flight for every
+// delivery and nack; the flights of older ones are dropped as they come up.
+type flights struct {
+	gen  string
+	heap []flight
+}
+
+func (f *flights) Len() int           { return len(f.heap) }
+func (f *flights) Less(i, j int) bool { return f.heap[i].hidden < f.heap[j].hidden }
+func (f *flights) Swap(i, j int)      { f.heap[i], f.heap[j] = f.heap[j], f.heap[i] }
+func (f *flights) Push(x any)         { f.heap = append(f.heap, x.(flight)) }
+
+func (f *flights) Pop() any {
+	n := len(f.heap)
+	last := f.heap[n-1]
+	f.heap = f.heap[:n-1]
+	return last
+}
+
+// flights returns the delivered messages of the queue under name with the
+// head h. They are read from the messages once per generation and Db.
+// Called with collectionsMu held.
+func (db *Db) flights(ctx context.Context, name string, h collectionHead) (*flights, error) {
+	if f := db.queues[name]; f != nil && f.gen == h.gen {
+		return f, nil
+	}
+	f := &flights{gen: h.gen}
+	for id := h.first; id < h.next; id++ {
+		m, err := db.message(ctx, h.listKey(name, id))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		f.heap = append(f.heap, flight{id: id, hidden: m.hidden})
+	}
+	heap.Init(f)
+	if db.queues == nil {
+		db.queues = make(map[string]*flights)
+	}
+	db.queues[name] = f
+	return f, nil
+}
+
+func (db *Db) message(ctx context.Context, key recordKey) (queuedMessage, error) {
+	value, err := db.getElement(ctx, key)
+	if err != nil {
+		return queuedMessage{}, err
+	}
+	return parseMessage(value)
+}
+
+// Ack removes a delivered message for good. It fails with ErrNotInFlight
+// unless the delivery of receipt is the last one of the message and its
+// visibility timeout has not ended, and with ErrNotFound once the message is
+// gone.
+func (q *Queue) Ack(receipt string) error {
+	ctx := context.Background()
+	q.db.collectionsMu.Lock()
+	defer q.db.collectionsMu.Unlock()
+	h, id, _, err := q.inFlight(ctx, receipt)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.removeMessage(ctx, q.name, h, id)
+	return err
+}
+
+// Nack makes a delivered message available again right away. It fails like
+// Ack.
+func (q *Queue) Nack(receipt string) error {
+	ctx := context.Background()
+	db := q.db
+	db.collectionsMu.Lock()
+	defer db.collectionsMu.Unlock()
+	h, id, m, err := q.inFlight(ctx, receipt)
+	if err != nil {
+		return err
+	}
+	f, err := db.flights(ctx, q.name, h)
+	if err != nil {
+		return err
+	}
+	m.hidden = 0
+	if err := db.putElement(ctx, h.listKey(q.name, id), m.encode()); err != nil {
+		return err
+	}
+	heap.Push(f, flight{id: id})
+	return nil
+}
+
+// inFlight returns the message delivered with receipt.
+func (q *Queue) inFlight(ctx context.Context, receipt string) (collectionHead, int64, queuedMessage, error) {
+	id, deliveries, ok := parseReceipt(receipt)
+	if !ok {
+		return collectionHead{}, 0, queuedMessage{}, ErrNotInFlight
+	}
+	h, ok, err := q.db.head(ctx, q.name, queueTag)
+	if err != nil {
+		return h, id, queuedMessage{}, err
+	}
+	if !ok || id < h.first || id >= h.last {
+		return h, id, queuedMessage{}, ErrNotFound
+	}
+	m, err := q.db.message(ctx, h.listKey(q.name, id))
+	if err == nil && (m.deliveries != deliveries || m.hidden <= time.Now().UnixNano()) {
+		err = ErrNotInFlight
+	}
+	return h, id, m, err
+}
+
+// removeMessage deletes message id and moves the consumer offset past the
+// messages removed at the front of the queue. It returns the updated head.
+func (db *Db) removeMessage(ctx context.Context, name string, h collectionHead, id int64) (collectionHead, error) {
+	if err := db.putElement(ctx, h.listKey(name, id), deleteMarker); err != nil {
+		return h, err
+	}
+	first := h.first
+	for h.first < h.last {
+		if _, err := db.getValue(ctx, h.listKey(name, h.first)); err == nil {
+			break
+		} else if err != ErrNotFound {
+			return h, err
+		}
+		h.first++
+	}
+	if h.next < h.first {
+		h.next = h.first
+	}
+	if h.first == first {
+		return h, nil
+	}
+	return h, db.putHead(ctx, name, h)
+}
+
+// Len returns the number of messages that are not acked yet, including the
+// ones in flight.
+func (q *Queue) Len() (int, error) {
+	ctx := context.Background()
+	h, ok, err := q.db.head(ctx, q.name, queueTag)
+	if err != nil || !ok {
+		return 0, err
+	}
+	n := 0
+	for id := h.first; id < h.last; id++ {
+		if _, err := q.db.getValue(ctx, h.listKey(q.name, id)); err == nil {
+			n++
+		} else if err != ErrNotFound {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDb_Queue(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 300, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	opts := QueueOptions{VisibilityTimeout: 20 * time.Millisecond, MaxDeliveries: 2}
+	q := db.Queue("jobs", opts)
+
+	t.Run("fifo", func(t *testing.T) {
+		for _, body := range []string{"a", "b b", ""} {
+			if _, err := q.Enqueue(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var first Message
+		for _, want := range []string{"a", "b b", ""} {
+			m, err := q.Dequeue()
+			if err != nil || m.Body != want || m.Deliveries != 1 {
+				t.Fatalf("Bad message %+v (%v), expected %q", m, err, want)
+			}
+			if err := q.Ack(m.Receipt); err != nil {
+				t.Fatal(err)
+			}
+			if want == "a" {
+				first = m
+			}
+		}
+		if _, err := q.Dequeue(); err != ErrQueueEmpty {
+			t.Errorf("Expected ErrQueueEmpty, got %v", err)
+		}
+		if err := q.Ack(first.Receipt); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a second ack, got %v", err)
+		}
+	})
+
+	t.Run("receipts", func(t *testing.T) {
+		id, _ := q.Enqueue("r")
+		// The message was never delivered.
+		if err := q.Ack(receipt(int64(id), 0)); err != ErrNotInFlight {
+			t.Errorf("Expected ErrNotInFlight for a pending message, got %v", err)
+		}
+		for _, bad := range []string{"", "x", strconv.FormatUint(id, 10)} {
+			if err := q.Ack(bad); err != ErrNotInFlight {
+				t.Errorf("Expected ErrNotInFlight for receipt %q, got %v", bad, err)
+			}
+		}
+		m, _ := q.Dequeue()
+		if err := q.Ack(receipt(int64(id), m.Deliveries+1)); err != ErrNotInFlight {
+			t.Errorf("Expected ErrNotInFlight for another delivery, got %v", err)
+		}
+		if err := q.Ack(m.Receipt); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	var slow Message
+	t.Run("visibility timeout", func(t *testing.T) {
+		q.Enqueue("slow")
+		m, _ := q.Dequeue()
+		if _, err := q.Dequeue(); err != ErrQueueEmpty {
+			t.Errorf("The message in flight was delivered twice (%v)", err)
+		}
+		time.Sleep(opts.VisibilityTimeout)
+		if err := q.Nack(m.Receipt); err != ErrNotInFlight {
+			t.Errorf("Expected ErrNotInFlight once the timeout ended, got %v", err)
+		}
+		again, err := q.Dequeue()
+		if err != nil || again.ID != m.ID || again.Deliveries != 2 {
+			t.Errorf("Expected a redelivery of %d, got %+v (%v)", m.ID, again, err)
+		}
+		// The consumer of the first delivery is too late.
+		if err := q.Ack(m.Receipt); err != ErrNotInFlight {
+			t.Errorf("Expected ErrNotInFlight for a stale receipt, got %v", err)
+		}
+		slow = again
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		// "slow" was delivered twice already.
+		if err := q.Nack(slow.Receipt); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := q.Dequeue(); err != ErrQueueEmpty {
+			t.Errorf("Expected the message to be dead-lettered, got %+v (%v)", m, err)
+		}
+		m, err := q.DeadLetters().Dequeue()
+		if err != nil || m.Body != "slow" {
+			t.Errorf("Bad dead letter %+v (%v)", m, err)
+		}
+		if n, _ := q.Len(); n != 0 {
+			t.Errorf("Expected an empty queue, got %d messages", n)
+		}
+	})
+
+	t.Run("nack", func(t *testing.T) {
+		id, _ := q.Enqueue("retry")
+		m, _ := q.Dequeue()
+		if err := q.Nack(m.Receipt); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := q.Dequeue(); err != nil || m.ID != id {
+			t.Errorf("Expected the nacked message back, got %+v (%v)", m, err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		q.Enqueue("pending")
+		db.Close()
+		db, err = NewDbWithOptions("/db", 300, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q = db.Queue("jobs", opts)
+		if n, err := q.Len(); err != nil || n != 2 {
+			t.Errorf("Expected 2 pending messages, got %d (%v)", n, err)
+		}
+		// "retry" is still in flight.
+		if m, err := q.Dequeue(); err != nil || m.Body != "pending" {
+			t.Errorf("Bad message after reopening %+v (%v)", m, err)
+		}
+		// Once the timeouts end, "retry", delivered twice, goes to the
+		// dead letters and "pending" is delivered again.
+		time.Sleep(opts.VisibilityTimeout)
+		if m, err := q.Dequeue(); err != nil || m.Body != "pending" || m.Deliveries != 2 {
+			t.Errorf("Expected a redelivery after reopening, got %+v (%v)", m, err)
+		}
+		if n, err := q.DeadLetters().Len(); err != nil || n != 2 {
+			t.Errorf("Expected 2 dead letters, got %d (%v)", n, err)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		db.Put("plain", "value")
+		if _, err := db.Queue("plain", opts).Enqueue("x"); err != ErrWrongType {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package datastore
+
+import "context"
+
+// A range tombstone is a single record deleting every key of its bucket from
+// its key up to its value, exclusive, all the way when the value is empty. It
+// deletes the records written before it, including the elements of the
+// collections stored under the keys, and leaves the ones written after it
+// alone. Segments keep their tombstones apart from the key index; lookups
+// check whether the record found is older than a tombstone covering its key.
+// Merges leave out the records covered and the tombstones themselves, the
+// output of a merge has nothing older left to hide.
+type rangeTombstone struct {
+	bucket     uint32
+	start, end string
+	versionPos
+}
+
+func (t *rangeTombstone) covers(key recordKey) bool {
+	return key.bucket == t.bucket && key.key >= t.start && (t.end == "" || key.key < t.end)
+}
+
+// addRange puts a tombstone written at pos into s.
+func (s *Segment) addRange(t rangeTombstone) {
+	s.ranges = append(s.ranges, t)
+	if s.sealedWith == nil {
+		s.sealedWith = make(map[uint32]bool)
+	}
+	s.sealedWith[t.keyID] = true
+}
+
+// lastRangeDelete returns the segment index and the offset of the newest
+// tombstone of segments covering key, -1 when there is none. Damaged
+// tombstones are ignored like damaged records.
+func lastRangeDelete(segments []*Segment, key recordKey) (int, int64) {
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		for j := len(s.ranges) - 1; j >= 0; j-- {
+			if t := &s.ranges[j]; t.covers(key) && s.damageAt(t.offset) == nil {
+				return i, t.offset
+			}
+		}
+	}
+	return -1, 0
+}
+
+// deletedByRange reports whether the record of key at offset in segments[i]
+// is deleted by a tombstone written after it.
+func deletedByRange(segments []*Segment, i int, key recordKey, offset int64) bool {
+	ti, toff := lastRangeDelete(segments, key)
+	return ti > i || (ti == i && toff > offset)
+}
+
+// appendRangeVersions appends the versions of key in s to refs, oldest first,
+// with the tombstones covering it as deletions. A tombstone only counts for a
+// key that has a value to delete. healthy leaves the damaged records out.
+func appendRangeVersions(refs []versionRef, s *Segment, key recordKey, healthy bool) []versionRef {
+	add := func(v versionPos) {
+		if !healthy || s.damageAt(v.offset) == nil {
+			refs = appendVersion(refs, versionRef{s, v})
+		}
+	}
+	versions := s.versions[key]
+	for _, t := range s.ranges {
+		if !t.covers(key) {
+			continue
+		}
+		for len(versions) > 0 && versions[0].offset < t.offset {
+			add(versions[0])
+			versions = versions[1:]
+		}
+		if n := len(refs); n > 0 && !refs[n-1].deleted {
+			v := t.versionPos
+			v.deleted = true
+			add(v)
+		}
+	}
+	for _, v := range versions {
+		add(v)
+	}
+	return refs
+}
+
+// prefixEnd returns the first key past the keys starting with prefix, empty
+// when there is none.
+func prefixEnd(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
+
+func (db *Db) deleteRange(ctx context.Context, bucket uint32, start, end string) error {
+	if end != "" && end <= start {
+		return nil
+	}
+	return db.put(ctx, entry{key: start, value: end, bucket: bucket, deleteRange: true})
+}
+
+// DeleteRange deletes the keys from start up to end, exclusive, with a single
+// record. An empty end deletes all the keys from start on.
+func (db *Db) DeleteRange(start, end string) error {
+	return db.deleteRange(context.Background(), 0, start, end)
+}
+
+// DeletePrefix deletes the keys starting with prefix, see DeleteRange.
+func (db *Db) DeletePrefix(prefix string) error {
+	return db.deleteRange(context.Background(), 0, prefix, prefixEnd(prefix))
+}
+
+func (b *Bucket) DeleteRange(start, end string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.deleteRange(context.Background(), b.id, start, end)
+}
+
+func (b *Bucket) DeletePrefix(prefix string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.deleteRange(context.Background(), b.id, prefix, prefixEnd(prefix))
+}
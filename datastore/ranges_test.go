@@ -0,0 +1,182 @@
+package datastore
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDb_DeleteRange(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 150, Options{FS: fs, MergeOperator: Int64Add{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	keys := func(t *testing.T, prefix string, want ...string) {
+		t.Helper()
+		got, err := db.Keys(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected keys %v, got %v", want, got)
+		}
+	}
+
+	t.Run("prefix", func(t *testing.T) {
+		// Spread over several segments, so that the tombstone covers
+		// records of older ones.
+		for i := 0; i < 10; i++ {
+			db.Put("t1/k"+strconv.Itoa(i), "value"+strconv.Itoa(i))
+			db.Put("t2/k"+strconv.Itoa(i), "value"+strconv.Itoa(i))
+		}
+		db.Merge("t1/counter", "5")
+		db.LPush("t1/list", "a", "b")
+		if err := db.DeletePrefix("t1/"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("t1/k3"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if _, err := db.Get("t1/counter"); err != ErrNotFound {
+			t.Errorf("Expected the operands to be deleted, got %v", err)
+		}
+		if values, _ := db.LRange("t1/list", 0, -1); len(values) != 0 {
+			t.Errorf("Expected the list to be deleted, got %v", values)
+		}
+		if v, err := db.Get("t2/k3"); err != nil || v != "value3" {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+		keys(t, "t1/")
+		if stats, _ := db.Stats(); stats.Keys != 10 {
+			t.Errorf("Expected 10 keys left, got %d", stats.Keys)
+		}
+	})
+
+	t.Run("writes after", func(t *testing.T) {
+		db.Put("t1/k1", "new")
+		db.Merge("t1/counter", "1")
+		if v, err := db.Get("t1/k1"); err != nil || v != "new" {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+		if v, err := db.Get("t1/counter"); err != nil || v != "1" {
+			t.Errorf("Expected only the newer operand, got %q (%v)", v, err)
+		}
+		keys(t, "t1/", "t1/counter", "t1/k1")
+	})
+
+	t.Run("range", func(t *testing.T) {
+		if err := db.DeleteRange("t2/k2", "t2/k5"); err != nil {
+			t.Fatal(err)
+		}
+		keys(t, "t2/", "t2/k0", "t2/k1", "t2/k5", "t2/k6", "t2/k7", "t2/k8", "t2/k9")
+		if err := db.DeleteRange("t2/k9", "t2/k0"); err != nil {
+			t.Fatal(err)
+		}
+		keys(t, "t2/", "t2/k0", "t2/k1", "t2/k5", "t2/k6", "t2/k7", "t2/k8", "t2/k9")
+	})
+
+	check := func(t *testing.T) {
+		t.Helper()
+		keys(t, "t1/", "t1/counter", "t1/k1")
+		keys(t, "t2/", "t2/k0", "t2/k1", "t2/k5", "t2/k6", "t2/k7", "t2/k8", "t2/k9")
+		if v, err := db.Get("t1/counter"); err != nil || v != "1" {
+			t.Errorf("Bad counter %q (%v)", v, err)
+		}
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		for i := 0; i < 200 && recordsOnDisk(t, fs, "t1/k3") > 0; i++ {
+			db.Put("filler"+strconv.Itoa(i%5), "value")
+			time.Sleep(time.Millisecond)
+		}
+		if n := recordsOnDisk(t, fs, "t1/k3"); n != 0 {
+			t.Errorf("Expected merges to drop the deleted records, found %d", n)
+		}
+		check(t)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db.Close()
+		if db, err = NewDbWithOptions("/db", 150, Options{FS: fs, MergeOperator: Int64Add{}}); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("secondary index", func(t *testing.T) {
+		if err := db.CreateIndex("by_status", "$.status"); err != nil {
+			t.Fatal(err)
+		}
+		db.Put("o/1", `{"status": "paid"}`)
+		db.Put("p/1", `{"status": "paid"}`)
+		db.DeletePrefix("o/")
+		if got, err := db.QueryIndex("by_status", "paid"); err != nil || !reflect.DeepEqual(got, []string{"p/1"}) {
+			t.Errorf("Expected the deleted keys to leave the index, got %v (%v)", got, err)
+		}
+	})
+
+	t.Run("bucket", func(t *testing.T) {
+		b, err := db.Bucket("tenant")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Put("t1/a", "v")
+		b.Put("t2/a", "v")
+		if err := b.DeletePrefix("t1/"); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := b.Keys(""); !reflect.DeepEqual(got, []string{"t2/a"}) {
+			t.Errorf("Expected the other prefix to be kept, got %v", got)
+		}
+		keys(t, "t1/", "t1/counter", "t1/k1")
+	})
+}
+
+func TestDb_DeleteRangeVersions(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 150, Options{FS: fs, KeepVersions: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("a/1", "v1")
+	db.Put("b", "v")
+	if err := db.DeletePrefix("a/"); err != nil {
+		t.Fatal(err)
+	}
+	db.Put("a/1", "v2")
+	history, err := db.History("a/1")
+	if err != nil || len(history) != 3 || !history[1].Deleted || history[2].Value != "v2" {
+		t.Fatalf("Expected the tombstone as a deletion, got %+v (%v)", history, err)
+	}
+	if _, err := db.GetAt("a/1", history[1].Version); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound at the deletion, got %v", err)
+	}
+	if history, _ := db.History("b"); len(history) != 1 {
+		t.Errorf("Expected the tombstone to leave other keys alone, got %+v", history)
+	}
+	if _, err := db.History("a/2"); err != ErrNotFound {
+		t.Errorf("Expected no history of a key never written, got %v", err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"abc":      "abd",
+		"a\xff":    "b",
+		"\xff\xff": "",
+		"":         "",
+	} {
+		if got := prefixEnd(prefix); got != want {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", prefix, got, want)
+		}
+	}
+}
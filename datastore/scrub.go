@@ -0,0 +1,235 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// The scrubber rereads the sealed segments and checks the framing of every
+// record and, from format 1 on, its checksum. A segment with damaged ranges
+// is quarantined: reads skip the records in them and serve an older copy of
+// the key, or fail with a CorruptionError when there is none, and merges
+// leave them out, so the older copies take their place for good.
+const (
+	// scrubChunk is the number of bytes verified between two pauses, which
+	// keep the scrubber from competing with reads and writes.
+	scrubChunk = 256 << 10
+	scrubPause = 10 * time.Millisecond
+)
+
+// DamagedRange is a part of a segment file, from Offset to End, whose
+// records failed verification.
+type DamagedRange struct {
+	Segment     string
+	Offset, End int64
+}
+
+// CorruptionError is returned for a key whose record is damaged and that has
+// no older copy to fall back to.
+type CorruptionError struct {
+	DamagedRange
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("record in damaged range %d-%d of %s", e.Offset, e.End, e.Segment)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return errCorrupted
+}
+
+// ScrubStats describes the passes of the scrubber.
+type ScrubStats struct {
+	// Passes counts the completed passes, LastPass is the end of the last
+	// one.
+	Passes   int
+	LastPass time.Time
+	// Segments and Bytes count what was verified over all passes.
+	Segments int
+	Bytes    int64
+	// Damaged lists the ranges quarantined in the current segments.
+	Damaged []DamagedRange
+}
+
+// damageAt returns the damaged range of s holding the record at offset, nil
+// when the record is fine.
+func (s *Segment) damageAt(offset int64) *DamagedRange {
+	s.damagedMu.RLock()
+	defer s.damagedMu.RUnlock()
+	for i := range s.damaged {
+		if r := &s.damaged[i]; offset >= r.Offset && offset < r.End {
+			return r
+		}
+	}
+	return nil
+}
+
+// quarantine sets the damaged ranges of s and reports whether they are new.
+func (s *Segment) quarantine(ranges []DamagedRange) bool {
+	s.damagedMu.Lock()
+	defer s.damagedMu.Unlock()
+	if reflect.DeepEqual(s.damaged, ranges) {
+		return false
+	}
+	s.damaged = ranges
+	return true
+}
+
+// verify checks the records of the segment and returns the damaged ranges
+// and the number of bytes read. pause is called every scrubChunk bytes, it
+// stops the verification with an error.
+func (s *Segment) verify(pause func() error) ([]DamagedRange, int64, error) {
+	format, empty, err := readSegmentHeader(s.file)
+	if err != nil || empty {
+		return nil, 0, err
+	}
+	name := filepath.Base(s.filePath)
+	offset := format.start()
+	in := bufio.NewReaderSize(io.NewSectionReader(s.file, offset, math.MaxInt64-offset), bufSize)
+	var (
+		damaged []DamagedRange
+		next    = offset + scrubChunk
+	)
+	for {
+		if offset >= next {
+			if err := pause(); err != nil {
+				return nil, offset, err
+			}
+			next = offset + scrubChunk
+		}
+		_, n, err := format.next(in)
+		switch {
+		case err == io.EOF:
+			return damaged, offset, nil
+		case errors.Is(err, errChecksum):
+			damaged = append(damaged, DamagedRange{Segment: name, Offset: offset, End: offset + n})
+		case errors.Is(err, errCorrupted), errors.Is(err, errTornRecord):
+			r, err := damagedRest(name, in, offset, n)
+			if err != nil {
+				return nil, offset, err
+			}
+			return append(damaged, r), r.End, nil
+		case err != nil:
+			return nil, offset, err
+		}
+		offset += n
+	}
+}
+
+// damagedRest returns the range from offset, where a broken frame of n bytes
+// was read, to the end of the file read by in. The records past a broken frame
+// cannot be told apart, the rest of the file is lost.
+func damagedRest(name string, in io.Reader, offset, n int64) (DamagedRange, error) {
+	rest, err := io.Copy(io.Discard, in)
+	if err != nil {
+		return DamagedRange{}, err
+	}
+	return DamagedRange{Segment: name, Offset: offset, End: offset + n + rest}, nil
+}
+
+// pinSealed returns the sealed segments, kept open until they are released.
+func (db *Db) pinSealed() ([]*Segment, error) {
+	op := indexOp{kind: opPinSealed, sealed: make(chan []*Segment, 1)}
+	select {
+	case db.indexOps <- op:
+	case <-db.closed:
+		return nil, ErrClosed
+	}
+	return <-op.sealed, nil
+}
+
+// Scrub verifies all sealed segments once and quarantines the damaged ones.
+// Passes run one at a time. Options.ScrubInterval runs them in the
+// background.
+func (db *Db) Scrub() error {
+	db.scrubMu.Lock()
+	defer db.scrubMu.Unlock()
+	sealed, err := db.pinSealed()
+	if err != nil {
+		return err
+	}
+	pause := func() error {
+		select {
+		case <-db.closed:
+			return ErrClosed
+		case <-time.After(scrubPause):
+			return nil
+		}
+	}
+	var (
+		segments int
+		bytes    int64
+	)
+	for i, s := range sealed {
+		damaged, n, err := s.verify(pause)
+		bytes += n
+		if err != nil {
+			for _, s := range sealed[i:] {
+				s.readers.Done()
+			}
+			return err
+		}
+		segments++
+		if len(damaged) > 0 && s.quarantine(damaged) {
+			for _, r := range damaged {
+				log.Printf("scrub: %s: damaged records at bytes %d-%d, quarantined", r.Segment, r.Offset, r.End)
+			}
+		}
+		s.readers.Done()
+	}
+
+	db.scrubStatsMu.Lock()
+	defer db.scrubStatsMu.Unlock()
+	db.scrubStats.Passes++
+	db.scrubStats.LastPass = time.Now()
+	db.scrubStats.Segments += segments
+	db.scrubStats.Bytes += bytes
+	return nil
+}
+
+// ScrubStats returns the counters of the scrubber and the damaged ranges of
+// the current segments.
+func (db *Db) ScrubStats() (ScrubStats, error) {
+	sealed, err := db.pinSealed()
+	if err != nil {
+		return ScrubStats{}, err
+	}
+	db.scrubStatsMu.Lock()
+	stats := db.scrubStats
+	db.scrubStatsMu.Unlock()
+	stats.Damaged = nil
+	for _, s := range sealed {
+		s.damagedMu.RLock()
+		stats.Damaged = append(stats.Damaged, s.damaged...)
+		s.damagedMu.RUnlock()
+		s.readers.Done()
+	}
+	return stats, nil
+}
+
+// scrubber runs Scrub every interval until the Db is closed.
+func (db *Db) scrubber(interval time.Duration) {
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.closed:
+				return
+			case <-ticker.C:
+			}
+			if err := db.Scrub(); err != nil && err != ErrClosed {
+				log.Printf("scrub failed: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,224 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// flipByte corrupts the first occurrence of marker in the file at path.
+func flipByte(t *testing.T, fs *FaultFS, path, marker string) {
+	t.Helper()
+	f, err := fs.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte(marker))
+	if i < 0 {
+		t.Fatalf("%s does not hold %q", path, marker)
+	}
+	f.Close()
+	if f, err = fs.OpenFile(path, os.O_RDWR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(f, make([]byte, i)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{data[i] ^ 0x20}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeSegment stores the values by key as the segment file name, in the
+// current format.
+func writeSegment(t *testing.T, fs *FaultFS, name string, values ...string) {
+	t.Helper()
+	data := segmentHeader(currentFormat)
+	for i := 0; i < len(values); i += 2 {
+		data = append(data, segmentFormat(currentFormat).encode(entry{key: values[i], value: values[i+1] + "s"})...)
+	}
+	writeFile(t, fs, name, data)
+}
+
+func TestDb_Scrub(t *testing.T) {
+	fs := NewFaultFS(1)
+	// current-data0 holds the old copy of k, current-data1 the new one and
+	// the only copy of single, current-data2 is written to. Segments loaded
+	// on open are not merged until a new one is started.
+	writeSegment(t, fs, "/db/current-data0", "k", "old-value")
+	writeSegment(t, fs, "/db/current-data1", "k", "new-value", "single", "only-copy")
+	writeSegment(t, fs, "/db/current-data2", "last", "v")
+	db, err := NewDbWithOptions("/db", 100, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	if err := db.Scrub(); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := db.ScrubStats(); err != nil || stats.Passes != 1 || stats.Segments != 2 || len(stats.Damaged) != 0 {
+		t.Fatalf("Bad stats of a clean pass %+v (%v)", stats, err)
+	}
+
+	flipByte(t, fs, "/db/current-data1", "new-value")
+	flipByte(t, fs, "/db/current-data1", "only-copy")
+	// Reads do not verify checksums, the damage goes unnoticed until a pass.
+	if _, err := db.Get("k"); err != nil {
+		t.Errorf("Expected the damage to go unnoticed before a pass, got %v", err)
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		stats, err := db.ScrubStats()
+		if err != nil || len(stats.Damaged) != 2 || stats.Damaged[0].Segment != "current-data1" {
+			t.Errorf("Expected two damaged ranges, got %+v (%v)", stats.Damaged, err)
+		}
+		if v, err := db.Get("k"); err != nil || v != "old-value" {
+			t.Errorf("Expected the older copy, got %q (%v)", v, err)
+		}
+		var cerr *CorruptionError
+		if _, err := db.Get("single"); !errors.As(err, &cerr) || cerr.Segment != "current-data1" {
+			t.Errorf("Expected a CorruptionError, got %v", err)
+		}
+		if v, err := db.Get("last"); err != nil || v != "v" {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		if err := db.Scrub(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db.Close()
+		if db, err = NewDbWithOptions("/db", 100, Options{FS: fs, ScrubInterval: time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		for i := 0; i < 100; i++ {
+			if stats, _ := db.ScrubStats(); stats.Passes > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if stats, _ := db.ScrubStats(); stats.Passes == 0 {
+			t.Error("Expected background passes")
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			if stats, _ := db.ScrubStats(); len(stats.Damaged) == 0 {
+				break
+			}
+			db.Put("filler", "0123456789012345678901234567890123456789")
+			time.Sleep(time.Millisecond)
+		}
+		if stats, _ := db.ScrubStats(); len(stats.Damaged) != 0 {
+			t.Errorf("Expected merges to drop the damaged segment, got %+v", stats.Damaged)
+		}
+		if v, err := db.Get("k"); err != nil || v != "old-value" {
+			t.Errorf("Expected the older copy to be kept, got %q (%v)", v, err)
+		}
+		if _, err := db.Get("single"); err != ErrNotFound {
+			t.Errorf("Expected the damaged key to be gone, got %v", err)
+		}
+	})
+}
+
+// breakFrame zeroes the length of the record at offset of the file at path.
+func breakFrame(t *testing.T, fs *FaultFS, path string, offset int64) {
+	t.Helper()
+	f, err := fs.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.ReadFull(f, make([]byte, offset)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDb_ReopenDamagedFrame(t *testing.T) {
+	first := segmentHeaderSize + int64(len(segmentFormat(currentFormat).encode(entry{key: "k", value: "new-values"})))
+
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		stats, err := db.ScrubStats()
+		if err != nil || len(stats.Damaged) != 1 || stats.Damaged[0].Segment != "current-data1" || stats.Damaged[0].Offset != first {
+			t.Errorf("Expected the rest of current-data1 to be quarantined, got %+v (%v)", stats.Damaged, err)
+		}
+		if v, err := db.Get("k"); err != nil || v != "new-value" {
+			t.Errorf("Expected the record before the damage, got %q (%v)", v, err)
+		}
+		if v, err := db.Get("after"); err != nil || v != "old-value" {
+			t.Errorf("Expected the older copy, got %q (%v)", v, err)
+		}
+		if _, err := db.Get("single"); err == nil {
+			t.Error("Expected the damaged key to be lost")
+		}
+		if v, err := db.Get("last"); err != nil || v != "v" {
+			t.Errorf("Bad value %q (%v)", v, err)
+		}
+	}
+	segments := func(fs *FaultFS) {
+		writeSegment(t, fs, "/db/current-data0", "after", "old-value")
+		writeSegment(t, fs, "/db/current-data1", "k", "new-value", "single", "only-copy", "after", "new-value")
+		writeSegment(t, fs, "/db/current-data2", "last", "v")
+	}
+
+	t.Run("corrupted", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		segments(fs)
+		db, err := NewDbWithOptions("/db", 100, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		breakFrame(t, fs, "/db/current-data1", first)
+		if err := db.Scrub(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		if db, err = NewDbWithOptions("/db", 100, Options{FS: fs}); err != nil {
+			t.Fatalf("Expected the quarantined store to open, got %v", err)
+		}
+		defer db.Close()
+		check(t, db)
+	})
+
+	t.Run("torn", func(t *testing.T) {
+		fs := NewFaultFS(1)
+		segments(fs)
+		f, err := fs.OpenFile("/db/current-data1", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Truncate(first + 6); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		db, err := NewDbWithOptions("/db", 100, Options{FS: fs})
+		if err != nil {
+			t.Fatalf("Expected the torn sealed segment to open, got %v", err)
+		}
+		defer db.Close()
+		check(t, db)
+	})
+}
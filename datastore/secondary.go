@@ -0,0 +1,281 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Secondary indexes map a field of the JSON values of the default bucket to
+// the keys holding them. They live in memory like the hash index: the
+// definitions are kept in the meta bucket and the entries are rebuilt from
+// the values on open.
+const indexKeyPrefix = "index/"
+
+var (
+	ErrIndexExists = fmt.Errorf("index already exists")
+	ErrNoIndex     = fmt.Errorf("index does not exist")
+)
+
+type secondaryIndex struct {
+	path   string
+	fields []string
+	// keys lists the keys by indexed value, values gives the indexed value
+	// of every key.
+	keys   map[string]map[string]struct{}
+	values map[string]string
+}
+
+// parseIndexPath accepts paths like $.status or $.customer.country.
+func parseIndexPath(path string) ([]string, error) {
+	rest, ok := strings.CutPrefix(path, "$.")
+	if !ok || rest == "" {
+		return nil, fmt.Errorf("bad index path %q", path)
+	}
+	fields := strings.Split(rest, ".")
+	for _, f := range fields {
+		if f == "" {
+			return nil, fmt.Errorf("bad index path %q", path)
+		}
+	}
+	return fields, nil
+}
+
+func newSecondaryIndex(path string) (*secondaryIndex, error) {
+	fields, err := parseIndexPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return &secondaryIndex{
+		path:   path,
+		fields: fields,
+		keys:   make(map[string]map[string]struct{}),
+		values: make(map[string]string),
+	}, nil
+}
+
+// extract returns the indexed value of a type tagged value. Only scalar
+// fields of JSON strings and of values stored with a JSONCodec are indexed,
+// strings as they are and other scalars in their JSON form.
+func (idx *secondaryIndex) extract(value string) (string, bool) {
+	var data string
+	if typ, typed, ok := splitTyped(value); ok && strings.HasPrefix(typ, "json:") {
+		data = typed
+	} else if value != "" && value[len(value)-1:] == "s" {
+		data = value[:len(value)-1]
+	} else {
+		return "", false
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return "", false
+	}
+	for _, f := range idx.fields {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		doc = obj[f]
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case float64, bool:
+		data, _ := json.Marshal(v)
+		return string(data), true
+	}
+	return "", false
+}
+
+// set indexes the type tagged value of key, "" when the key was deleted.
+func (idx *secondaryIndex) set(key, value string) {
+	if old, ok := idx.values[key]; ok {
+		delete(idx.keys[old], key)
+		if len(idx.keys[old]) == 0 {
+			delete(idx.keys, old)
+		}
+		delete(idx.values, key)
+	}
+	v, ok := idx.extract(value)
+	if !ok {
+		return
+	}
+	if idx.keys[v] == nil {
+		idx.keys[v] = make(map[string]struct{})
+	}
+	idx.keys[v][key] = struct{}{}
+	idx.values[key] = v
+}
+
+// loadIndexes reads the index definitions. Called before the goroutines are
+// started, the entries are filled by fillIndexes afterwards.
+func (db *Db) loadIndexes() error {
+	db.indexes = make(map[string]*secondaryIndex)
+	seen := make(map[recordKey]bool)
+	for _, s := range db.segments {
+		for key := range s.index {
+			if key.bucket != metaBucket || !strings.HasPrefix(key.key, indexKeyPrefix) || seen[key] {
+				continue
+			}
+			seen[key] = true
+			s, pos, err := db.getSegmentAndPos(key)
+			if err != nil || pos.deleted {
+				continue
+			}
+			value, err := s.getFromSegment(pos.offset)
+			if err != nil {
+				return err
+			}
+			idx, err := newSecondaryIndex(value[:len(value)-1])
+			if err != nil {
+				return fmt.Errorf("index %s: %w", key.key, err)
+			}
+			db.indexes[strings.TrimPrefix(key.key, indexKeyPrefix)] = idx
+		}
+	}
+	return nil
+}
+
+// fillIndexes indexes the current values of all keys. The writer waits for
+// it before indexing new values, so the entries of keys written meanwhile
+// are not overwritten with older values.
+func (db *Db) fillIndexes(indexes ...*secondaryIndex) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	db.indexesMu.Lock()
+	defer db.indexesMu.Unlock()
+	keys, err := db.keys(recordKey{})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := db.getValue(ctx, recordKey{key: key})
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, idx := range indexes {
+			idx.set(key, value)
+		}
+	}
+	return nil
+}
+
+// updateIndexes is called by the writer for every record written with the
+// value it had before it was moved to the value log.
+func (db *Db) updateIndexes(e entry, value string) {
+	if e.bucket != 0 || e.sub != "" {
+		return
+	}
+	db.indexesMu.Lock()
+	defer db.indexesMu.Unlock()
+	if len(db.indexes) == 0 {
+		return
+	}
+	if e.deleteRange {
+		t := rangeTombstone{start: e.key, end: value}
+		for _, idx := range db.indexes {
+			for key := range idx.values {
+				if t.covers(recordKey{key: key}) {
+					idx.set(key, "")
+				}
+			}
+		}
+		return
+	}
+	if value == deleteMarker {
+		value = ""
+	} else if e.typ != "" {
+		value = joinType(value, e.typ)
+	} else if isOperand(value) {
+		// The operand was indexed already, so the folded value can be read.
+		folded, err := db.getValue(context.Background(), e.recordKey())
+		if err != nil {
+			folded = ""
+		}
+		value = folded
+	}
+	for _, idx := range db.indexes {
+		idx.set(e.key, value)
+	}
+}
+
+// CreateIndex indexes the JSON values of the default bucket by the field at
+// path, like $.status. The values stored already are indexed before it
+// returns.
+func (db *Db) CreateIndex(name, path string) error {
+	if name == "" {
+		return fmt.Errorf("empty index name")
+	}
+	idx, err := newSecondaryIndex(path)
+	if err != nil {
+		return err
+	}
+	// The writer takes indexesMu, so it is not held while writing.
+	db.indexDefsMu.Lock()
+	defer db.indexDefsMu.Unlock()
+	db.indexesMu.RLock()
+	_, exists := db.indexes[name]
+	db.indexesMu.RUnlock()
+	if exists {
+		return ErrIndexExists
+	}
+	if err := db.put(context.Background(), entry{key: indexKeyPrefix + name, value: path + "s", bucket: metaBucket}); err != nil {
+		return err
+	}
+	db.indexesMu.Lock()
+	db.indexes[name] = idx
+	db.indexesMu.Unlock()
+	return db.fillIndexes(idx)
+}
+
+func (db *Db) DropIndex(name string) error {
+	db.indexDefsMu.Lock()
+	defer db.indexDefsMu.Unlock()
+	db.indexesMu.RLock()
+	_, exists := db.indexes[name]
+	db.indexesMu.RUnlock()
+	if !exists {
+		return ErrNoIndex
+	}
+	if err := db.put(context.Background(), entry{key: indexKeyPrefix + name, value: deleteMarker, bucket: metaBucket}); err != nil {
+		return err
+	}
+	db.indexesMu.Lock()
+	delete(db.indexes, name)
+	db.indexesMu.Unlock()
+	return nil
+}
+
+// QueryIndex returns the keys whose indexed field equals value, sorted.
+// Numbers and booleans are matched in their JSON form.
+func (db *Db) QueryIndex(name, value string) ([]string, error) {
+	db.indexesMu.RLock()
+	defer db.indexesMu.RUnlock()
+	idx, ok := db.indexes[name]
+	if !ok {
+		return nil, ErrNoIndex
+	}
+	keys := make([]string, 0, len(idx.keys[value]))
+	for key := range idx.keys[value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Indexes returns the paths of the indexes by name.
+func (db *Db) Indexes() map[string]string {
+	db.indexesMu.RLock()
+	defer db.indexesMu.RUnlock()
+	res := make(map[string]string, len(db.indexes))
+	for name, idx := range db.indexes {
+		res[name] = idx.path
+	}
+	return res
+}
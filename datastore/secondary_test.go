@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDb_SecondaryIndexes(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 250, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	query := func(t *testing.T, name, value string, want ...string) {
+		t.Helper()
+		keys, err := db.QueryIndex(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == nil {
+			want = []string{}
+		}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("Expected %v for %s=%s, got %v", want, name, value, keys)
+		}
+	}
+
+	db.Put("o1", `{"status": "paid", "total": 10, "customer": {"country": "UA"}}`)
+	db.Put("o2", `{"status": "new", "total": 25}`)
+	db.Put("plain", "paid")
+
+	t.Run("backfill", func(t *testing.T) {
+		if err := db.CreateIndex("by_status", "$.status"); err != nil {
+			t.Fatal(err)
+		}
+		query(t, "by_status", "paid", "o1")
+		query(t, "by_status", "new", "o2")
+		if err := db.CreateIndex("by_status", "$.status"); err != ErrIndexExists {
+			t.Errorf("Expected ErrIndexExists, got %v", err)
+		}
+		if err := db.CreateIndex("bad", "status"); err == nil {
+			t.Error("Expected a bad path to be rejected")
+		}
+	})
+
+	t.Run("updates", func(t *testing.T) {
+		db.Put("o2", `{"status": "paid"}`)
+		db.Put("o3", `{"status": "paid"}`)
+		query(t, "by_status", "paid", "o1", "o2", "o3")
+		query(t, "by_status", "new")
+		db.Delete("o1")
+		db.Put("o3", `["paid"]`)
+		query(t, "by_status", "paid", "o2")
+	})
+
+	t.Run("nested fields and numbers", func(t *testing.T) {
+		db.Put("o1", `{"status": "paid", "total": 10, "customer": {"country": "UA"}}`)
+		if err := db.CreateIndex("by_country", "$.customer.country"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CreateIndex("by_total", "$.total"); err != nil {
+			t.Fatal(err)
+		}
+		query(t, "by_country", "UA", "o1")
+		query(t, "by_total", "10", "o1")
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		// Enough writes for the index records to be merged.
+		for i := 0; i < 20; i++ {
+			db.Put("o4", `{"status": "refunded"}`)
+		}
+		db.Close()
+		db, err = NewDbWithOptions("/db", 250, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"by_status": "$.status", "by_country": "$.customer.country", "by_total": "$.total"}
+		if indexes := db.Indexes(); !reflect.DeepEqual(indexes, want) {
+			t.Errorf("Expected %v after reopening, got %v", want, indexes)
+		}
+		query(t, "by_status", "paid", "o1", "o2")
+		query(t, "by_status", "refunded", "o4")
+		query(t, "by_country", "UA", "o1")
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err := db.DropIndex("by_total"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.QueryIndex("by_total", "10"); err != ErrNoIndex {
+			t.Errorf("Expected ErrNoIndex, got %v", err)
+		}
+		if err := db.DropIndex("by_total"); err != ErrNoIndex {
+			t.Errorf("Expected ErrNoIndex, got %v", err)
+		}
+		db.Close()
+		db, err = NewDbWithOptions("/db", 250, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := db.Indexes()["by_total"]; ok {
+			t.Error("Dropped index came back after reopening")
+		}
+	})
+}
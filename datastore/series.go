@@ -0,0 +1,490 @@
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// A time series is stored like the collections: a head record under the key
+// and the points in chunk records, the elements of the head's generation.
+// Every chunk holds up to maxChunkPoints points compressed the Gorilla way,
+// timestamps as delta-of-delta and values XORed with the previous one. Only
+// the newest chunk is rewritten by appends.
+const (
+	seriesTag      = "t"
+	maxChunkPoints = 120
+)
+
+var ErrOutOfOrder = fmt.Errorf("point is not newer than the last point of the series")
+
+// Point is a value of a time series.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Aggregation combines the points of a downsampling step.
+type Aggregation int
+
+const (
+	AggAvg Aggregation = iota
+	AggMin
+	AggMax
+)
+
+// seriesHead names the generation of the chunks, the retention of the series
+// and the key of the chunk appended to.
+type seriesHead struct {
+	gen       string
+	retention time.Duration
+	open      int64
+}
+
+func (h seriesHead) encode() string {
+	return fmt.Sprintf("%s %d %d%s", h.gen, h.retention, h.open, seriesTag)
+}
+
+func parseSeriesHead(value string) (seriesHead, error) {
+	var h seriesHead
+	if value[len(value)-1:] != seriesTag {
+		return h, ErrWrongType
+	}
+	if _, err := fmt.Sscanf(value[:len(value)-1], "%s %d %d", &h.gen, &h.retention, &h.open); err != nil {
+		return h, fmt.Errorf("bad series head: %w", err)
+	}
+	return h, nil
+}
+
+// collection gives the head to address the chunks with.
+func (h seriesHead) collection() collectionHead {
+	return collectionHead{tag: seriesTag, gen: h.gen}
+}
+
+// chunkKey encodes the chunk start so that chunks sort in time order.
+func (h seriesHead) chunkKey(key string, start int64) recordKey {
+	return h.collection().elementKey(key, fmt.Sprintf("%020d", uint64(start)^1<<63))
+}
+
+func (db *Db) seriesHead(ctx context.Context, key string) (seriesHead, bool, error) {
+	value, err := db.getValue(ctx, recordKey{key: key})
+	if err == ErrNotFound {
+		return seriesHead{gen: newGeneration()}, false, nil
+	} else if err != nil {
+		return seriesHead{}, false, err
+	}
+	h, err := parseSeriesHead(value)
+	return h, true, err
+}
+
+func (db *Db) readChunk(ctx context.Context, key recordKey) ([]Point, error) {
+	value, err := db.getElement(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunk([]byte(value))
+}
+
+// TSCreate creates the series under key or changes its retention. Points
+// older than retention before the newest point are dropped, with whole
+// chunks, when a chunk is started and by merges; zero keeps all points.
+func (db *Db) TSCreate(key string, retention time.Duration) error {
+	ctx := context.Background()
+	db.collectionsMu.Lock()
+	defer db.collectionsMu.Unlock()
+	h, _, err := db.seriesHead(ctx, key)
+	if err != nil {
+		return err
+	}
+	h.retention = retention
+	return db.put(ctx, entry{key: key, value: h.encode()})
+}
+
+// TSAdd appends a point to the series under key, creating it without
+// retention when it does not exist. Points have to be added in time order.
+func (db *Db) TSAdd(key string, t time.Time, value float64) error {
+	ctx := context.Background()
+	db.collectionsMu.Lock()
+	defer db.collectionsMu.Unlock()
+	h, ok, err := db.seriesHead(ctx, key)
+	if err != nil {
+		return err
+	}
+	var points []Point
+	if ok {
+		points, err = db.readChunk(ctx, h.chunkKey(key, h.open))
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	p := Point{Time: t, Value: value}
+	if n := len(points); n > 0 && !t.After(points[n-1].Time) {
+		return ErrOutOfOrder
+	}
+	if !ok || len(points) >= maxChunkPoints {
+		// The head goes first, so the new chunk belongs to the series.
+		h.open = t.UnixNano()
+		if err := db.put(ctx, entry{key: key, value: h.encode()}); err != nil {
+			return err
+		}
+		if err := db.putElement(ctx, h.chunkKey(key, h.open), string(encodeChunk([]Point{p}))+"s"); err != nil {
+			return err
+		}
+		if ok && h.retention > 0 {
+			return db.expireChunks(ctx, key, h, t.Add(-h.retention))
+		}
+		return nil
+	}
+	return db.putElement(ctx, h.chunkKey(key, h.open), string(encodeChunk(append(points, p)))+"s")
+}
+
+// expireChunks deletes the chunks that only hold points before cutoff. The
+// points of a chunk are older than the start of the next one.
+func (db *Db) expireChunks(ctx context.Context, key string, h seriesHead, cutoff time.Time) error {
+	subs, err := db.elements(ctx, key, h.collection())
+	if err != nil {
+		return err
+	}
+	next := h.chunkKey(key, cutoff.UnixNano()).sub
+	for i := 0; i+1 < len(subs) && subs[i+1] <= next; i++ {
+		if err := db.putElement(ctx, recordKey{key: key, sub: subs[i]}, deleteMarker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkLive reports whether the chunk key of the series whose head is the
+// value head may hold points within the retention of the series, according to
+// sealed. Used by merges, so that series no longer appended to get their
+// retention too. The newest point is not older than the start of the open
+// chunk, so the chunks whose points are all older than that start by the
+// retention are dropped.
+func (db *Db) chunkLive(sealed []*Segment, key recordKey, head string) (bool, error) {
+	h, err := parseSeriesHead(head)
+	if err != nil || h.retention <= 0 {
+		return true, nil
+	}
+	value, err := db.latestValue(sealed, key)
+	if err != nil || value == "" {
+		return true, err
+	}
+	points, err := decodeChunk([]byte(value[:len(value)-1]))
+	if err != nil || len(points) == 0 {
+		return true, nil
+	}
+	cutoff := time.Unix(0, h.open).Add(-h.retention)
+	return !points[len(points)-1].Time.Before(cutoff), nil
+}
+
+// TSRange returns the points of the series under key from from to to, both
+// included, that are within the retention of the series. Only the chunks
+// overlapping the range are read.
+func (db *Db) TSRange(key string, from, to time.Time) ([]Point, error) {
+	ctx := context.Background()
+	h, ok, err := db.seriesHead(ctx, key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if h.retention > 0 {
+		// The newest point is in the open chunk.
+		points, err := db.readChunk(ctx, h.chunkKey(key, h.open))
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if n := len(points); n > 0 {
+			if cutoff := points[n-1].Time.Add(-h.retention); from.Before(cutoff) {
+				from = cutoff
+			}
+		}
+	}
+	if to.Before(from) {
+		return nil, nil
+	}
+	subs, err := db.elements(ctx, key, h.collection())
+	if err != nil {
+		return nil, err
+	}
+	// The points of a chunk are older than the start of the next one, so the
+	// range starts in the last chunk starting by from.
+	first := h.chunkKey(key, from.UnixNano()).sub
+	i := sort.SearchStrings(subs, first)
+	if i > 0 && (i == len(subs) || subs[i] != first) {
+		i--
+	}
+	last := h.chunkKey(key, to.UnixNano()).sub
+	var all []Point
+	for ; i < len(subs) && subs[i] <= last; i++ {
+		points, err := db.readChunk(ctx, recordKey{key: key, sub: subs[i]})
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		all = append(all, points...)
+	}
+	start := sort.Search(len(all), func(i int) bool { return !all[i].Time.Before(from) })
+	end := sort.Search(len(all), func(i int) bool { return all[i].Time.After(to) })
+	if start >= end {
+		return nil, nil
+	}
+	return all[start:end], nil
+}
+
+// TSDownsample aggregates the points of TSRange in steps of the given length
+// starting at from. Every step with points gives a point at its start.
+func (db *Db) TSDownsample(key string, from, to time.Time, step time.Duration, agg Aggregation) ([]Point, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("bad downsampling step %s", step)
+	}
+	points, err := db.TSRange(key, from, to)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		res   []Point
+		count int
+	)
+	for _, p := range points {
+		start := from.Add(p.Time.Sub(from) / step * step)
+		if n := len(res); n > 0 && res[n-1].Time.Equal(start) {
+			last := &res[n-1]
+			switch agg {
+			case AggMin:
+				last.Value = math.Min(last.Value, p.Value)
+			case AggMax:
+				last.Value = math.Max(last.Value, p.Value)
+			default:
+				last.Value += p.Value
+			}
+			count++
+			continue
+		}
+		if n := len(res); n > 0 && agg == AggAvg {
+			res[n-1].Value /= float64(count)
+		}
+		res = append(res, Point{Time: start, Value: p.Value})
+		count = 1
+	}
+	if n := len(res); n > 0 && agg == AggAvg {
+		res[n-1].Value /= float64(count)
+	}
+	return res, nil
+}
+
+type bitWriter struct {
+	buf []byte
+	n   uint
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		free := 8 - w.n%8
+		take := free
+		if n < take {
+			take = n
+		}
+		chunk := byte(v>>(n-take)) & (1<<take - 1)
+		w.buf[len(w.buf)-1] |= chunk << (free - take)
+		w.n += take
+		n -= take
+	}
+}
+
+func (w *bitWriter) writeBit(b bool) {
+	if b {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+type bitReader struct {
+	data []byte
+	pos  uint
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	if r.pos+n > uint(len(r.data))*8 {
+		return 0, errCorrupted
+	}
+	var v uint64
+	for n > 0 {
+		used := r.pos % 8
+		take := 8 - used
+		if n < take {
+			take = n
+		}
+		b := r.data[r.pos/8] >> (8 - used - take) & (1<<take - 1)
+		v = v<<take | uint64(b)
+		r.pos += take
+		n -= take
+	}
+	return v, nil
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	v, err := r.readBits(1)
+	return v == 1, err
+}
+
+// dodBits are the sizes of the delta-of-delta buckets. A bucket is picked by
+// as many one bits as its number, ended by a zero bit except for the last
+// one; a lone zero bit means that the timestamp is as far from the previous
+// one as that one from its own predecessor.
+var dodBits = [...]uint{14, 24, 32, 64}
+
+// encodeChunk compresses points: a two byte point count, the first point as
+// is, then the delta-of-delta of every timestamp and the XOR of every value
+// with the previous one.
+func encodeChunk(points []Point) []byte {
+	w := &bitWriter{buf: binary.BigEndian.AppendUint16(nil, uint16(len(points)))}
+	w.n = 16
+	var (
+		prevTime, prevDelta int64
+		prevBits            uint64
+		leading, trailing   uint = 65, 0
+	)
+	for i, p := range points {
+		t, v := p.Time.UnixNano(), math.Float64bits(p.Value)
+		if i == 0 {
+			w.writeBits(uint64(t), 64)
+			w.writeBits(v, 64)
+			prevTime, prevBits = t, v
+			continue
+		}
+
+		delta := t - prevTime
+		dod := delta - prevDelta
+		if dod == 0 {
+			w.writeBit(false)
+		} else {
+			for i, n := range dodBits {
+				if n == 64 || (dod >= -1<<(n-1) && dod < 1<<(n-1)) {
+					w.writeBits(1<<(i+1)-1, uint(i+1))
+					if i+1 < len(dodBits) {
+						w.writeBit(false)
+					}
+					w.writeBits(uint64(dod), n)
+					break
+				}
+			}
+		}
+		prevTime, prevDelta = t, delta
+
+		x := v ^ prevBits
+		prevBits = v
+		if x == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+		lz, tz := uint(bits.LeadingZeros64(x)), uint(bits.TrailingZeros64(x))
+		if lz > 31 {
+			lz = 31
+		}
+		if leading <= lz && trailing <= tz {
+			// The meaningful bits fit in the window of the previous value.
+			w.writeBit(false)
+			w.writeBits(x>>trailing, 64-leading-trailing)
+			continue
+		}
+		leading, trailing = lz, tz
+		w.writeBit(true)
+		w.writeBits(uint64(leading), 5)
+		w.writeBits(uint64(64-leading-trailing-1), 6)
+		w.writeBits(x>>trailing, 64-leading-trailing)
+	}
+	return w.buf
+}
+
+func decodeChunk(data []byte) ([]Point, error) {
+	if len(data) < 2 {
+		return nil, errCorrupted
+	}
+	r := &bitReader{data: data, pos: 16}
+	n := int(binary.BigEndian.Uint16(data))
+	points := make([]Point, 0, n)
+	var (
+		prevTime, prevDelta int64
+		prevBits            uint64
+		leading, trailing   uint
+	)
+	for i := 0; i < n; i++ {
+		if i == 0 {
+			t, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			prevTime, prevBits = int64(t), v
+			points = append(points, Point{Time: time.Unix(0, prevTime), Value: math.Float64frombits(v)})
+			continue
+		}
+
+		ones := 0
+		for ones < len(dodBits) {
+			bit, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if !bit {
+				break
+			}
+			ones++
+		}
+		var dod int64
+		if ones > 0 {
+			n := dodBits[ones-1]
+			u, err := r.readBits(n)
+			if err != nil {
+				return nil, err
+			}
+			dod = signExtend(u, n)
+		}
+		prevDelta += dod
+		prevTime += prevDelta
+
+		if changed, err := r.readBit(); err != nil {
+			return nil, err
+		} else if changed {
+			if fresh, err := r.readBit(); err != nil {
+				return nil, err
+			} else if fresh {
+				l, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				size, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				leading, trailing = uint(l), 64-uint(l)-uint(size)-1
+			}
+			x, err := r.readBits(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			prevBits ^= x << trailing
+		}
+		points = append(points, Point{Time: time.Unix(0, prevTime), Value: math.Float64frombits(prevBits)})
+	}
+	return points, nil
+}
+
+func signExtend(u uint64, n uint) int64 {
+	if n == 64 {
+		return int64(u)
+	}
+	return int64(u<<(64-n)) >> (64 - n)
+}
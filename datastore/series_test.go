@@ -0,0 +1,218 @@
+package datastore
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChunkEncoding(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	for name, gen := range map[string]func(i int) Point{
+		"regular": func(i int) Point {
+			return Point{Time: start.Add(time.Duration(i) * time.Second), Value: 20.5}
+		},
+		"jitter": func(i int) Point {
+			return Point{
+				Time:  start.Add(time.Duration(i)*time.Second + time.Duration(rand.Intn(1000))*time.Millisecond),
+				Value: rand.NormFloat64(),
+			}
+		},
+		"gaps": func(i int) Point {
+			return Point{Time: start.Add(time.Duration(i*i) * time.Hour), Value: float64(i)}
+		},
+		"special values": func(i int) Point {
+			values := []float64{0, -1, math.MaxFloat64, math.Inf(-1), math.SmallestNonzeroFloat64}
+			return Point{Time: start.Add(time.Duration(i) * time.Nanosecond), Value: values[i%len(values)]}
+		},
+	} {
+		gen := gen
+		t.Run(name, func(t *testing.T) {
+			points := make([]Point, maxChunkPoints)
+			for i := range points {
+				points[i] = gen(i)
+			}
+			data := encodeChunk(points)
+			decoded, err := decodeChunk(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(points) {
+				t.Fatalf("Decoded %d points, expected %d", len(decoded), len(points))
+			}
+			for i := range points {
+				if !decoded[i].Time.Equal(points[i].Time) || decoded[i].Value != points[i].Value {
+					t.Fatalf("Point %d decoded as %v, expected %v", i, decoded[i], points[i])
+				}
+			}
+			if name == "regular" && len(data) > 60 {
+				t.Errorf("Regular points take %d bytes", len(data))
+			}
+		})
+	}
+	if _, err := decodeChunk([]byte{0, 2, 1}); err != errCorrupted {
+		t.Errorf("Expected errCorrupted for a truncated chunk, got %v", err)
+	}
+}
+
+func TestDb_TimeSeries(t *testing.T) {
+	fs := NewFaultFS(1)
+	db, err := NewDbWithOptions("/db", 1000, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	start := time.Unix(1700000000, 0)
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+	t.Run("range", func(t *testing.T) {
+		for i := 0; i < 300; i++ {
+			if err := db.TSAdd("dev42:ts", at(i), float64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		points, err := db.TSRange("dev42:ts", at(118), at(122))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []float64
+		for _, p := range points {
+			values = append(values, p.Value)
+		}
+		if !reflect.DeepEqual(values, []float64{118, 119, 120, 121, 122}) {
+			t.Errorf("Bad range across chunks %v", values)
+		}
+		if err := db.TSAdd("dev42:ts", at(10), 1); err != ErrOutOfOrder {
+			t.Errorf("Expected ErrOutOfOrder, got %v", err)
+		}
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		// Chunks start at 0, 120 and 240. A broken chunk fails the ranges
+		// reading it.
+		h := mustSeriesHead(t, db, "dev42:ts")
+		ctx := context.Background()
+		for _, tc := range []struct {
+			broken   int
+			from, to int
+		}{
+			{0, 120, 250},
+			{0, 130, 299},
+			{240, 0, 239},
+			{120, 240, 245},
+		} {
+			chunk := h.chunkKey("dev42:ts", at(tc.broken).UnixNano())
+			value, err := db.getValue(ctx, chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.putElement(ctx, chunk, "\x00s")
+			points, err := db.TSRange("dev42:ts", at(tc.from), at(tc.to))
+			if err != nil || len(points) != tc.to-tc.from+1 || points[0].Value != float64(tc.from) {
+				t.Errorf("Expected the range from %d to %d without the chunk at %d, got %d points (%v)", tc.from, tc.to, tc.broken, len(points), err)
+			}
+			db.putElement(ctx, chunk, value)
+		}
+		if points, err := db.TSRange("dev42:ts", at(10), at(5)); err != nil || len(points) != 0 {
+			t.Errorf("Expected no points of an empty range, got %v (%v)", points, err)
+		}
+	})
+
+	t.Run("downsample", func(t *testing.T) {
+		for _, tc := range []struct {
+			agg  Aggregation
+			want []float64
+		}{
+			{AggAvg, []float64{4.5, 14.5, 24.5}},
+			{AggMin, []float64{0, 10, 20}},
+			{AggMax, []float64{9, 19, 29}},
+		} {
+			points, err := db.TSDownsample("dev42:ts", at(0), at(29), 10*time.Second, tc.agg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var values []float64
+			for _, p := range points {
+				values = append(values, p.Value)
+			}
+			if !reflect.DeepEqual(values, tc.want) || !points[1].Time.Equal(at(10)) {
+				t.Errorf("Bad downsampling %d: %v", tc.agg, points)
+			}
+		}
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		if err := db.TSCreate("dev42:ts", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		points, _ := db.TSRange("dev42:ts", at(0), at(1000))
+		if len(points) != 61 || points[0].Value != 239 {
+			t.Errorf("Expected the last minute of points, got %d starting at %v", len(points), points[0])
+		}
+		for i := 300; i < 400; i++ {
+			db.TSAdd("dev42:ts", at(i), float64(i))
+		}
+		// A chunk was started at 360, only that one and the one before
+		// can hold points of the last minute.
+		subs, _ := db.elements(context.Background(), "dev42:ts", mustSeriesHead(t, db, "dev42:ts").collection())
+		if len(subs) != 2 {
+			t.Errorf("Expected 2 live chunks, got %d", len(subs))
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		db.Put("plain", "value")
+		if err := db.TSAdd("plain", at(0), 1); err != ErrWrongType {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+		if _, err := db.LPush("dev42:ts", "a"); err != ErrWrongType {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db.Close()
+		db, err = NewDbWithOptions("/db", 1000, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		points, err := db.TSRange("dev42:ts", at(390), at(400))
+		if err != nil || len(points) != 10 || points[9].Value != 399 {
+			t.Errorf("Bad points after reopening %v (%v)", points, err)
+		}
+	})
+
+	t.Run("retention of idle series", func(t *testing.T) {
+		for i := 0; i < 300; i++ {
+			db.TSAdd("idle", at(i), float64(i))
+		}
+		// No point is added after the retention is set: merges drop the
+		// chunk at 0, the one at 120 holds points after 240-60.
+		if err := db.TSCreate("idle", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500 && elementsOnDisk(t, fs, "idle") != 2; i++ {
+			db.Put("filler", "0123456789012345678901234567890123456789")
+			time.Sleep(time.Millisecond)
+		}
+		if n := elementsOnDisk(t, fs, "idle"); n != 2 {
+			t.Errorf("Expected merges to keep 2 chunks, found %d", n)
+		}
+		points, err := db.TSRange("idle", at(0), at(1000))
+		if err != nil || len(points) != 61 || points[0].Value != 239 {
+			t.Errorf("Expected the last minute of points, got %d (%v)", len(points), err)
+		}
+	})
+}
+
+func mustSeriesHead(t *testing.T, db *Db, key string) seriesHead {
+	h, ok, err := db.seriesHead(context.Background(), key)
+	if err != nil || !ok {
+		t.Fatalf("No series head for %s (%v)", key, err)
+	}
+	return h
+}
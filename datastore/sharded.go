@@ -0,0 +1,448 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const shardFileName = "SHARD"
+
+// ShardedDb partitions keys by hash across independent Dbs, each with its own
+// directory and writer goroutine. The directories must be passed in the same
+// order every time, which is checked on open.
+//
+// Collections, time series and blobs live in the shard of their key. Queues,
+// secondary indexes, export and import span keys of several shards and are
+// not supported: a queue and its dead letters would land in different shards
+// and an index or export of one shard sees only its keys.
+type ShardedDb struct {
+	shards []*Db
+}
+
+// NewShardedDb opens a Db in each of dirs with opts. The budgets of opts, such
+// as CacheSize and MaxBytes, are per shard: the ShardedDb takes up to
+// len(dirs) times them.
+func NewShardedDb(dirs []string, segmentSize int64, opts Options) (*ShardedDb, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no shard directories")
+	}
+	sdb := &ShardedDb{}
+	for i, dir := range dirs {
+		db, err := NewDbWithOptions(dir, segmentSize, opts)
+		if err == nil {
+			err = db.checkShard(i, len(dirs))
+			if err != nil {
+				db.Close()
+			}
+		}
+		if err != nil {
+			sdb.Close()
+			return nil, err
+		}
+		sdb.shards = append(sdb.shards, db)
+	}
+	return sdb, nil
+}
+
+// checkShard makes sure the directory is opened as the same shard it was
+// created as, otherwise keys would be looked up in the wrong one.
+func (db *Db) checkShard(index, count int) error {
+	want := fmt.Sprintf("%d/%d", index, count)
+	path := filepath.Join(db.dir, shardFileName)
+	f, err := db.fs.OpenFile(path, os.O_RDONLY, 0)
+	if err == nil {
+		data, rerr := io.ReadAll(f)
+		f.Close()
+		if rerr != nil {
+			return rerr
+		}
+		if got := strings.TrimSpace(string(data)); got != want {
+			return fmt.Errorf("%s holds shard %s, opened as %s", db.dir, got, want)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) || db.readOnly {
+		return err
+	}
+	f, err = db.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(want + "\n"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func shardIndex(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+func (sdb *ShardedDb) shard(key string) *Db {
+	return sdb.shards[shardIndex(key, len(sdb.shards))]
+}
+
+// each runs fn on all shards in parallel and returns the first error.
+func (sdb *ShardedDb) each(fn func(i int, db *Db) error) error {
+	errs := make([]error, len(sdb.shards))
+	var wg sync.WaitGroup
+	for i, db := range sdb.shards {
+		i, db := i, db
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, db)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sdb *ShardedDb) Close() error {
+	return sdb.each(func(_ int, db *Db) error {
+		return db.Close()
+	})
+}
+
+func (sdb *ShardedDb) Get(key string) (string, error) {
+	return sdb.shard(key).Get(key)
+}
+
+func (sdb *ShardedDb) GetCtx(ctx context.Context, key string) (string, error) {
+	return sdb.shard(key).GetCtx(ctx, key)
+}
+
+func (sdb *ShardedDb) Put(key, value string) error {
+	return sdb.shard(key).Put(key, value)
+}
+
+func (sdb *ShardedDb) PutCtx(ctx context.Context, key, value string) error {
+	return sdb.shard(key).PutCtx(ctx, key, value)
+}
+
+func (sdb *ShardedDb) Delete(key string) error {
+	return sdb.shard(key).Delete(key)
+}
+
+func (sdb *ShardedDb) DeleteCtx(ctx context.Context, key string) error {
+	return sdb.shard(key).DeleteCtx(ctx, key)
+}
+
+// DeleteRange deletes the keys from start up to end in every shard, see
+// Db.DeleteRange. A failed shard leaves the others deleted.
+func (sdb *ShardedDb) DeleteRange(start, end string) error {
+	return sdb.each(func(_ int, db *Db) error {
+		return db.DeleteRange(start, end)
+	})
+}
+
+// DeletePrefix deletes the keys starting with prefix in every shard.
+func (sdb *ShardedDb) DeletePrefix(prefix string) error {
+	return sdb.each(func(_ int, db *Db) error {
+		return db.DeletePrefix(prefix)
+	})
+}
+
+func (sdb *ShardedDb) Merge(key, operand string) error {
+	return sdb.shard(key).Merge(key, operand)
+}
+
+func (sdb *ShardedDb) GetInt64(key string) (int64, error) {
+	return sdb.shard(key).GetInt64(key)
+}
+
+func (sdb *ShardedDb) PutInt64(key string, value int64) error {
+	return sdb.shard(key).PutInt64(key, value)
+}
+
+func (sdb *ShardedDb) GetReader(key string) (io.ReadCloser, error) {
+	return sdb.shard(key).GetReader(key)
+}
+
+// History returns the versions of key. Version numbers are only comparable
+// between keys of the same shard.
+func (sdb *ShardedDb) History(key string) ([]Version, error) {
+	return sdb.shard(key).History(key)
+}
+
+func (sdb *ShardedDb) GetAt(key string, version uint64) (string, error) {
+	return sdb.shard(key).GetAt(key, version)
+}
+
+func (sdb *ShardedDb) GetAtTime(key string, t time.Time) (string, error) {
+	return sdb.shard(key).GetAtTime(key, t)
+}
+
+func (sdb *ShardedDb) LPush(key string, values ...string) (int, error) {
+	return sdb.shard(key).LPush(key, values...)
+}
+
+func (sdb *ShardedDb) RPop(key string) (string, error) {
+	return sdb.shard(key).RPop(key)
+}
+
+func (sdb *ShardedDb) LRange(key string, start, stop int) ([]string, error) {
+	return sdb.shard(key).LRange(key, start, stop)
+}
+
+func (sdb *ShardedDb) HSet(key, field, value string) error {
+	return sdb.shard(key).HSet(key, field, value)
+}
+
+func (sdb *ShardedDb) HGet(key, field string) (string, error) {
+	return sdb.shard(key).HGet(key, field)
+}
+
+func (sdb *ShardedDb) HGetAll(key string) (map[string]string, error) {
+	return sdb.shard(key).HGetAll(key)
+}
+
+func (sdb *ShardedDb) SAdd(key string, members ...string) (int, error) {
+	return sdb.shard(key).SAdd(key, members...)
+}
+
+func (sdb *ShardedDb) SIsMember(key, member string) (bool, error) {
+	return sdb.shard(key).SIsMember(key, member)
+}
+
+func (sdb *ShardedDb) SMembers(key string) ([]string, error) {
+	return sdb.shard(key).SMembers(key)
+}
+
+func (sdb *ShardedDb) TSCreate(key string, retention time.Duration) error {
+	return sdb.shard(key).TSCreate(key, retention)
+}
+
+func (sdb *ShardedDb) TSAdd(key string, t time.Time, value float64) error {
+	return sdb.shard(key).TSAdd(key, t, value)
+}
+
+func (sdb *ShardedDb) TSRange(key string, from, to time.Time) ([]Point, error) {
+	return sdb.shard(key).TSRange(key, from, to)
+}
+
+func (sdb *ShardedDb) TSDownsample(key string, from, to time.Time, step time.Duration, agg Aggregation) ([]Point, error) {
+	return sdb.shard(key).TSDownsample(key, from, to, step, agg)
+}
+
+// PutBlob stores the blob in the shard of key. Chunks are deduplicated within
+// a shard only.
+func (sdb *ShardedDb) PutBlob(key string, r io.Reader) (int64, error) {
+	return sdb.shard(key).PutBlob(key, r)
+}
+
+func (sdb *ShardedDb) GetBlob(key string) (io.ReadCloser, error) {
+	return sdb.shard(key).GetBlob(key)
+}
+
+func (sdb *ShardedDb) DeleteBlob(key string) error {
+	return sdb.shard(key).DeleteBlob(key)
+}
+
+// Keys gathers the keys starting with prefix from all shards, sorted.
+func (sdb *ShardedDb) Keys(prefix string) ([]string, error) {
+	return sdb.gatherKeys(func(i int) ([]string, error) {
+		return sdb.shards[i].Keys(prefix)
+	})
+}
+
+// Stats sums the stats of all shards.
+func (sdb *ShardedDb) Stats() (BucketStats, error) {
+	return sdb.gatherStats(func(i int) (BucketStats, error) {
+		return sdb.shards[i].Stats()
+	})
+}
+
+// CacheStats sums the value cache counters of all shards.
+func (sdb *ShardedDb) CacheStats() CacheStats {
+	var total CacheStats
+	for _, db := range sdb.shards {
+		stats := db.CacheStats()
+		total.Hits += stats.Hits
+		total.Misses += stats.Misses
+		total.Entries += stats.Entries
+		total.Bytes += stats.Bytes
+	}
+	return total
+}
+
+// EvictionStats sums the eviction counters of all shards, MaxBytes included.
+func (sdb *ShardedDb) EvictionStats() EvictionStats {
+	var total EvictionStats
+	for _, db := range sdb.shards {
+		stats := db.EvictionStats()
+		total.Policy = stats.Policy
+		total.Keys += stats.Keys
+		total.Bytes += stats.Bytes
+		total.MaxBytes += stats.MaxBytes
+		total.Evictions += stats.Evictions
+		total.EvictedBytes += stats.EvictedBytes
+	}
+	return total
+}
+
+func (sdb *ShardedDb) gatherKeys(keys func(i int) ([]string, error)) ([]string, error) {
+	parts := make([][]string, len(sdb.shards))
+	err := sdb.each(func(i int, _ *Db) error {
+		var err error
+		parts[i], err = keys(i)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, part := range parts {
+		res = append(res, part...)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (sdb *ShardedDb) gatherStats(stats func(i int) (BucketStats, error)) (BucketStats, error) {
+	parts := make([]BucketStats, len(sdb.shards))
+	err := sdb.each(func(i int, _ *Db) error {
+		var err error
+		parts[i], err = stats(i)
+		return err
+	})
+	var total BucketStats
+	for _, part := range parts {
+		total.Keys += part.Keys
+		total.Bytes += part.Bytes
+	}
+	return total, err
+}
+
+// ShardedBucket is a bucket present in every shard.
+type ShardedBucket struct {
+	sdb     *ShardedDb
+	name    string
+	buckets []*Bucket
+}
+
+// Bucket returns the bucket with the given name, creating it in the shards
+// missing it.
+func (sdb *ShardedDb) Bucket(name string) (*ShardedBucket, error) {
+	return sdb.bucket(name, (*Db).Bucket)
+}
+
+// LookupBucket is Bucket that fails with ErrNotFound instead of creating the
+// bucket.
+func (sdb *ShardedDb) LookupBucket(name string) (*ShardedBucket, error) {
+	return sdb.bucket(name, (*Db).LookupBucket)
+}
+
+func (sdb *ShardedDb) bucket(name string, open func(*Db, string) (*Bucket, error)) (*ShardedBucket, error) {
+	sb := &ShardedBucket{sdb: sdb, name: name, buckets: make([]*Bucket, len(sdb.shards))}
+	err := sdb.each(func(i int, db *Db) error {
+		var err error
+		sb.buckets[i], err = open(db, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
+
+// DropBucket drops the bucket in every shard that has it.
+func (sdb *ShardedDb) DropBucket(name string) error {
+	dropped := make([]bool, len(sdb.shards))
+	err := sdb.each(func(i int, db *Db) error {
+		err := db.DropBucket(name)
+		dropped[i] = err == nil
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, ok := range dropped {
+		if ok {
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (sb *ShardedBucket) Name() string {
+	return sb.name
+}
+
+func (sb *ShardedBucket) shard(key string) *Bucket {
+	return sb.buckets[shardIndex(key, len(sb.buckets))]
+}
+
+func (sb *ShardedBucket) Get(key string) (string, error) {
+	return sb.shard(key).Get(key)
+}
+
+func (sb *ShardedBucket) GetCtx(ctx context.Context, key string) (string, error) {
+	return sb.shard(key).GetCtx(ctx, key)
+}
+
+func (sb *ShardedBucket) Put(key, value string) error {
+	return sb.shard(key).Put(key, value)
+}
+
+func (sb *ShardedBucket) PutCtx(ctx context.Context, key, value string) error {
+	return sb.shard(key).PutCtx(ctx, key, value)
+}
+
+func (sb *ShardedBucket) Delete(key string) error {
+	return sb.shard(key).Delete(key)
+}
+
+func (sb *ShardedBucket) DeleteCtx(ctx context.Context, key string) error {
+	return sb.shard(key).DeleteCtx(ctx, key)
+}
+
+func (sb *ShardedBucket) DeleteRange(start, end string) error {
+	return sb.sdb.each(func(i int, _ *Db) error {
+		return sb.buckets[i].DeleteRange(start, end)
+	})
+}
+
+func (sb *ShardedBucket) DeletePrefix(prefix string) error {
+	return sb.sdb.each(func(i int, _ *Db) error {
+		return sb.buckets[i].DeletePrefix(prefix)
+	})
+}
+
+func (sb *ShardedBucket) Merge(key, operand string) error {
+	return sb.shard(key).Merge(key, operand)
+}
+
+func (sb *ShardedBucket) Keys(prefix string) ([]string, error) {
+	return sb.sdb.gatherKeys(func(i int) ([]string, error) {
+		return sb.buckets[i].Keys(prefix)
+	})
+}
+
+func (sb *ShardedBucket) Stats() (BucketStats, error) {
+	return sb.sdb.gatherStats(func(i int) (BucketStats, error) {
+		return sb.buckets[i].Stats()
+	})
+}
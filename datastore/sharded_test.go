@@ -0,0 +1,198 @@
+package datastore
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShardedDb(t *testing.T) {
+	fs := NewFaultFS(1)
+	dirs := []string{"/shard0", "/shard1", "/shard2"}
+	opts := Options{FS: fs}
+	sdb, err := NewShardedDb(dirs, 200, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { sdb.Close() }()
+
+	const n = 30
+	t.Run("put/get", func(t *testing.T) {
+		for i := 0; i < n; i++ {
+			key := "key" + strconv.Itoa(i)
+			if err := sdb.Put(key, "v"+strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < n; i++ {
+			key := "key" + strconv.Itoa(i)
+			if value, err := sdb.Get(key); err != nil || value != "v"+strconv.Itoa(i) {
+				t.Errorf("Bad value for %s: %q (%v)", key, value, err)
+			}
+		}
+		for i, db := range sdb.shards {
+			if stats, _ := db.Stats(); stats.Keys == 0 || stats.Keys == n {
+				t.Errorf("Keys are not spread, shard %d holds %d of them", i, stats.Keys)
+			}
+		}
+	})
+
+	t.Run("scatter-gather", func(t *testing.T) {
+		keys, err := sdb.Keys("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"key1", "key10", "key11", "key12", "key13", "key14", "key15", "key16", "key17", "key18", "key19"}
+		if len(keys) != len(want) {
+			t.Fatalf("Bad keys %v", keys)
+		}
+		for i := range want {
+			if keys[i] != want[i] {
+				t.Errorf("Bad keys %v", keys)
+				break
+			}
+		}
+		if stats, err := sdb.Stats(); err != nil || stats.Keys != n {
+			t.Errorf("Bad stats %+v (%v)", stats, err)
+		}
+	})
+
+	t.Run("delete range", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			sdb.Put("tmp/"+strconv.Itoa(i), "x")
+		}
+		if err := sdb.DeletePrefix("tmp/"); err != nil {
+			t.Fatal(err)
+		}
+		if keys, err := sdb.Keys("tmp/"); err != nil || len(keys) != 0 {
+			t.Errorf("Expected the prefix to be deleted in every shard, got %v (%v)", keys, err)
+		}
+		if err := sdb.DeleteRange("key2", "key3"); err != nil {
+			t.Fatal(err)
+		}
+		if keys, _ := sdb.Keys("key2"); len(keys) != 0 {
+			t.Errorf("Expected the range to be deleted, got %v", keys)
+		}
+		if stats, err := sdb.Stats(); err != nil || stats.Keys != n-11 {
+			t.Errorf("Expected %d keys left, got %+v (%v)", n-11, stats, err)
+		}
+		for i := 20; i < 30; i++ {
+			sdb.Put("key"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+		}
+		sdb.Put("key2", "v2")
+	})
+
+	t.Run("buckets", func(t *testing.T) {
+		b, err := sdb.Bucket("orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			b.Put("order"+strconv.Itoa(i), "x")
+		}
+		if value, err := b.Get("order3"); err != nil || value != "x" {
+			t.Errorf("Bad value in bucket: %q (%v)", value, err)
+		}
+		if stats, err := b.Stats(); err != nil || stats.Keys != 10 {
+			t.Errorf("Bad bucket stats %+v (%v)", stats, err)
+		}
+		if err := b.DeleteRange("order5", ""); err != nil {
+			t.Fatal(err)
+		}
+		if keys, err := b.Keys(""); err != nil || len(keys) != 5 || keys[4] != "order4" {
+			t.Errorf("Expected the keys from order5 on to be deleted, got %v (%v)", keys, err)
+		}
+		if err := sdb.DropBucket("orders"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sdb.LookupBucket("orders"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("collections", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			key := "c" + strconv.Itoa(i)
+			sdb.LPush("list/"+key, "a", "b")
+			sdb.HSet("hash/"+key, "f", key)
+			sdb.SAdd("set/"+key, key)
+			sdb.TSCreate("ts/"+key, time.Hour)
+			sdb.TSAdd("ts/"+key, time.Unix(0, 1), float64(i))
+			sdb.PutBlob("blob/"+key, strings.NewReader(key))
+		}
+		for i := 0; i < 5; i++ {
+			key := "c" + strconv.Itoa(i)
+			if v, err := sdb.LRange("list/"+key, 0, -1); err != nil || len(v) != 2 || v[0] != "b" {
+				t.Errorf("Bad list %v (%v)", v, err)
+			}
+			if v, err := sdb.HGet("hash/"+key, "f"); err != nil || v != key {
+				t.Errorf("Bad hash field %q (%v)", v, err)
+			}
+			if ok, err := sdb.SIsMember("set/"+key, key); err != nil || !ok {
+				t.Errorf("Expected %s in its set (%v)", key, err)
+			}
+			if points, err := sdb.TSRange("ts/"+key, time.Unix(0, 0), time.Unix(0, 2)); err != nil || len(points) != 1 || points[0].Value != float64(i) {
+				t.Errorf("Bad series %v (%v)", points, err)
+			}
+			if r, err := sdb.GetBlob("blob/" + key); err != nil {
+				t.Error(err)
+			} else if data, _ := io.ReadAll(r); string(data) != key {
+				t.Errorf("Bad blob %q", data)
+			}
+		}
+		for i := 0; i < 5; i++ {
+			if err := sdb.DeleteBlob("blob/c" + strconv.Itoa(i)); err != nil {
+				t.Error(err)
+			}
+		}
+		for _, prefix := range []string{"list/", "hash/", "set/", "ts/"} {
+			if err := sdb.DeletePrefix(prefix); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("eviction stats", func(t *testing.T) {
+		if stats := sdb.EvictionStats(); stats.MaxBytes != 0 || stats.Keys != 0 {
+			t.Errorf("Expected no eviction without MaxBytes, got %+v", stats)
+		}
+		cache, err := NewShardedDb([]string{"/cache0", "/cache1"}, 500, Options{FS: fs, MaxBytes: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cache.Close()
+		for i := 0; i < 30; i++ {
+			cache.Put("key"+strconv.Itoa(i), "value-"+strconv.Itoa(i))
+		}
+		stats := cache.EvictionStats()
+		if stats.MaxBytes != 200 || stats.Evictions == 0 || stats.Bytes > stats.MaxBytes {
+			t.Errorf("Expected each shard to keep to its own budget, got %+v", stats)
+		}
+		var keys int
+		for _, db := range cache.shards {
+			keys += db.EvictionStats().Keys
+		}
+		if stats.Keys != keys {
+			t.Errorf("Expected the keys of all shards, %d, got %d", keys, stats.Keys)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := sdb.Close(); err != nil {
+			t.Fatal(err)
+		}
+		swapped := []string{dirs[1], dirs[0], dirs[2]}
+		if _, err := NewShardedDb(swapped, 200, opts); err == nil {
+			t.Fatal("Expected an error for directories in another order")
+		}
+		sdb, err = NewShardedDb(dirs, 200, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := sdb.Get("key7"); err != nil || value != "v7" {
+			t.Errorf("Bad value after reopen: %q (%v)", value, err)
+		}
+	})
+}
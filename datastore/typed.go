@@ -0,0 +1,279 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Typed values are stored as data | typedTag with their type recorded in the
+// extension of the record, so reading one with a codec of another type fails
+// instead of decoding garbage. Once read the type is joined to the value:
+//
+//	data | type | type length uint8 | typedTag
+//
+// Strings and int64 values keep their plain form and stay readable with Get
+// and GetInt64.
+const typedTag = "c"
+
+var ErrTypeMismatch = fmt.Errorf("stored value has another type")
+
+// Codec converts the values of T to bytes and back.
+type Codec[T any] interface {
+	// Type names the encoding and the type, it is recorded with every value.
+	Type() string
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// nativeCodec is implemented by the codecs storing values with a type tag of
+// their own.
+type nativeCodec interface {
+	tag() string
+}
+
+func typeName[T any]() string {
+	return reflect.TypeOf((*T)(nil)).Elem().String()
+}
+
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Type() string { return "json:" + typeName[T]() }
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Type() string { return "gob:" + typeName[T]() }
+
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// StringCodec stores strings like Put does.
+type StringCodec struct{}
+
+func (StringCodec) Type() string { return "string" }
+func (StringCodec) tag() string  { return "s" }
+
+func (StringCodec) Marshal(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Unmarshal(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// Int64Codec stores numbers like PutInt64 does.
+type Int64Codec struct{}
+
+func (Int64Codec) Type() string { return "int64" }
+func (Int64Codec) tag() string  { return "i" }
+
+func (Int64Codec) Marshal(v int64) ([]byte, error) {
+	return strconv.AppendInt(nil, v, 10), nil
+}
+
+func (Int64Codec) Unmarshal(data []byte) (int64, error) {
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// splitTyped returns the type and the data of a value stored with typedTag.
+func splitTyped(value string) (typ, data string, ok bool) {
+	if len(value) < 2 || value[len(value)-1:] != typedTag {
+		return "", "", false
+	}
+	n := int(value[len(value)-2])
+	if len(value) < n+2 {
+		return "", "", false
+	}
+	end := len(value) - 2
+	return value[end-n : end], value[:end-n], true
+}
+
+// joinType returns the value read from a record whose extension records its
+// type typ in the form splitTyped takes apart.
+func joinType(value, typ string) string {
+	if typ == "" || !strings.HasSuffix(value, typedTag) {
+		return value
+	}
+	return value[:len(value)-1] + typ + string([]byte{byte(len(typ))}) + typedTag
+}
+
+// storedType describes the type tagged value for errors.
+func storedType(value string) string {
+	if typ, _, ok := splitTyped(value); ok {
+		return typ
+	}
+	switch value[len(value)-1:] {
+	case "s":
+		return "string"
+	case "i":
+		return "int64"
+	case listTag:
+		return "list"
+	case hashTag:
+		return "hash"
+	case setTag:
+		return "set"
+	case seriesTag:
+		return "series"
+	case queueTag:
+		return "queue"
+	}
+	return "unknown"
+}
+
+// Typed stores values of T under the keys of a Db or a bucket.
+type Typed[T any] struct {
+	db     *Db
+	bucket *Bucket
+	codec  Codec[T]
+}
+
+func NewTyped[T any](db *Db, codec Codec[T]) *Typed[T] {
+	return &Typed[T]{db: db, codec: codec}
+}
+
+func NewTypedBucket[T any](b *Bucket, codec Codec[T]) *Typed[T] {
+	return &Typed[T]{db: b.db, bucket: b, codec: codec}
+}
+
+func (t *Typed[T]) recordKey(key string) (recordKey, error) {
+	if t.bucket == nil {
+		return recordKey{key: key}, nil
+	}
+	if err := t.bucket.check(); err != nil {
+		return recordKey{}, err
+	}
+	return recordKey{bucket: t.bucket.id, key: key}, nil
+}
+
+// encode returns the value and the type to record for v, the type is empty
+// for the codecs with a type tag of their own.
+func (t *Typed[T]) encode(v T) (value, typ string, err error) {
+	data, err := t.codec.Marshal(v)
+	if err != nil {
+		return "", "", err
+	}
+	if n, ok := t.codec.(nativeCodec); ok {
+		return string(data) + n.tag(), "", nil
+	}
+	return typedValue(data, t.codec.Type())
+}
+
+// typedValue returns the value storing data with typedTag and typ, the type
+// recorded with it.
+func typedValue(data []byte, typ string) (string, string, error) {
+	if typ == "" || len(typ) > 255 {
+		return "", "", fmt.Errorf("bad type name %q", typ)
+	}
+	return string(data) + typedTag, typ, nil
+}
+
+func (t *Typed[T]) decode(key, value string) (T, error) {
+	var (
+		data string
+		ok   bool
+		zero T
+	)
+	if n, native := t.codec.(nativeCodec); native {
+		data, ok = value[:len(value)-1], value[len(value)-1:] == n.tag()
+	} else {
+		var typ string
+		typ, data, ok = splitTyped(value)
+		ok = ok && typ == t.codec.Type()
+	}
+	if !ok {
+		return zero, fmt.Errorf("%w: %q holds %s, not %s", ErrTypeMismatch, key, storedType(value), t.codec.Type())
+	}
+	return t.codec.Unmarshal([]byte(data))
+}
+
+func (t *Typed[T]) Get(key string) (T, error) {
+	return t.GetCtx(context.Background(), key)
+}
+
+func (t *Typed[T]) GetCtx(ctx context.Context, key string) (T, error) {
+	var zero T
+	rk, err := t.recordKey(key)
+	if err != nil {
+		return zero, err
+	}
+	value, err := t.db.getValue(ctx, rk)
+	if err != nil {
+		return zero, err
+	}
+	return t.decode(key, value)
+}
+
+func (t *Typed[T]) Put(key string, v T) error {
+	return t.PutCtx(context.Background(), key, v)
+}
+
+func (t *Typed[T]) PutCtx(ctx context.Context, key string, v T) error {
+	rk, err := t.recordKey(key)
+	if err != nil {
+		return err
+	}
+	value, typ, err := t.encode(v)
+	if err != nil {
+		return err
+	}
+	return t.db.put(ctx, entry{key: key, value: value, bucket: rk.bucket, typ: typ})
+}
+
+func (t *Typed[T]) Delete(key string) error {
+	rk, err := t.recordKey(key)
+	if err != nil {
+		return err
+	}
+	return t.db.put(context.Background(), entry{key: key, value: deleteMarker, bucket: rk.bucket})
+}
+
+// Each calls fn with the keys starting with prefix, in order, and their
+// values until fn returns an error. Keys deleted meanwhile are skipped, a key
+// holding another type stops the iteration with ErrTypeMismatch.
+func (t *Typed[T]) Each(prefix string, fn func(key string, v T) error) error {
+	rk, err := t.recordKey(prefix)
+	if err != nil {
+		return err
+	}
+	keys, err := t.db.keys(rk)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		v, err := t.Get(key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
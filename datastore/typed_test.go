@@ -0,0 +1,193 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testOrder struct {
+	Status string
+	Total  int
+	Items  []string
+}
+
+func TestTyped(t *testing.T) {
+	db, err := NewDbWithOptions("/db", 250, Options{FS: NewFaultFS(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	order := testOrder{Status: "paid", Total: 30, Items: []string{"a", "b"}}
+
+	t.Run("codecs", func(t *testing.T) {
+		for _, tc := range []struct {
+			name  string
+			typed *Typed[testOrder]
+		}{
+			{"json", NewTyped[testOrder](db, JSONCodec[testOrder]{})},
+			{"gob", NewTyped[testOrder](db, GobCodec[testOrder]{})},
+		} {
+			if err := tc.typed.Put(tc.name, order); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tc.typed.Get(tc.name)
+			if err != nil || !reflect.DeepEqual(got, order) {
+				t.Errorf("%s: got %+v (%v)", tc.name, got, err)
+			}
+		}
+		if _, err := NewTyped[testOrder](db, JSONCodec[testOrder]{}).Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("plain values", func(t *testing.T) {
+		strs := NewTyped[string](db, StringCodec{})
+		ints := NewTyped[int64](db, Int64Codec{})
+		strs.Put("s", "hello")
+		ints.Put("n", -42)
+		if v, err := db.Get("s"); err != nil || v != "hello" {
+			t.Errorf("Bad Get result %q (%v)", v, err)
+		}
+		if v, err := db.GetInt64("n"); err != nil || v != -42 {
+			t.Errorf("Bad GetInt64 result %d (%v)", v, err)
+		}
+		db.Put("s2", "world")
+		if v, err := strs.Get("s2"); err != nil || v != "world" {
+			t.Errorf("Bad typed Get result %q (%v)", v, err)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		db.LPush("list", "a")
+		for _, tc := range []struct {
+			name string
+			get  func() error
+		}{
+			{"gob as json", func() error { _, err := NewTyped[testOrder](db, JSONCodec[testOrder]{}).Get("gob"); return err }},
+			{"json as other type", func() error {
+				_, err := NewTyped[map[string]int](db, JSONCodec[map[string]int]{}).Get("json")
+				return err
+			}},
+			{"string as int64", func() error { _, err := NewTyped[int64](db, Int64Codec{}).Get("s"); return err }},
+			{"json as string", func() error { _, err := NewTyped[string](db, StringCodec{}).Get("json"); return err }},
+			{"list as json", func() error { _, err := NewTyped[testOrder](db, JSONCodec[testOrder]{}).Get("list"); return err }},
+		} {
+			if err := tc.get(); !errors.Is(err, ErrTypeMismatch) {
+				t.Errorf("%s: expected ErrTypeMismatch, got %v", tc.name, err)
+			}
+		}
+		_, err := NewTyped[testOrder](db, JSONCodec[testOrder]{}).Get("gob")
+		if want := `stored value has another type: "gob" holds gob:datastore.testOrder, not json:datastore.testOrder`; err.Error() != want {
+			t.Errorf("Unclear error %q", err)
+		}
+	})
+
+	t.Run("each", func(t *testing.T) {
+		b, err := db.Bucket("orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		orders := NewTypedBucket[testOrder](b, JSONCodec[testOrder]{})
+		for i, status := range []string{"new", "paid", "sent"} {
+			orders.Put("o"+string(rune('1'+i)), testOrder{Status: status, Total: i})
+		}
+		orders.Delete("o2")
+		var got []string
+		err = orders.Each("o", func(key string, o testOrder) error {
+			got = append(got, key+"="+o.Status)
+			return nil
+		})
+		if want := []string{"o1=new", "o3=sent"}; err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v (%v)", want, got, err)
+		}
+		b.Put("o4", "plain")
+		if err := orders.Each("o", func(string, testOrder) error { return nil }); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("Expected ErrTypeMismatch, got %v", err)
+		}
+		db.DropBucket("orders")
+		if err := orders.Put("o5", testOrder{}); err != ErrBucketDropped {
+			t.Errorf("Expected ErrBucketDropped, got %v", err)
+		}
+	})
+
+	t.Run("secondary index", func(t *testing.T) {
+		if err := db.CreateIndex("by_status", "$.Status"); err != nil {
+			t.Fatal(err)
+		}
+		if keys, _ := db.QueryIndex("by_status", "paid"); !reflect.DeepEqual(keys, []string{"json"}) {
+			t.Errorf("Expected the JSON typed value to be indexed, got %v", keys)
+		}
+	})
+}
+
+func TestTyped_TypeExtension(t *testing.T) {
+	fs := NewFaultFS(1)
+	opts := Options{FS: fs, ValueLogThreshold: 16}
+	db, err := NewDbWithOptions("/db", 250, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	codec := JSONCodec[testOrder]{}
+	orders := NewTyped[testOrder](db, codec)
+	order := testOrder{Status: "paid", Total: 30}
+
+	checkDisk := func(t *testing.T) {
+		t.Helper()
+		found := false
+		forEachRecord(t, fs, "/db", func(e entry) {
+			if e.key != "order" {
+				return
+			}
+			found = true
+			if e.typ != codec.Type() || strings.Contains(e.value, codec.Type()) || !strings.HasSuffix(e.value, typedTag) {
+				t.Errorf("Expected the type in the extension only, got type %q and value %q", e.typ, e.value)
+			}
+		})
+		if !found {
+			t.Error("No record of the typed value")
+		}
+	}
+	check := func(t *testing.T) {
+		t.Helper()
+		if got, err := orders.Get("order"); err != nil || !reflect.DeepEqual(got, order) {
+			t.Errorf("Bad value %+v (%v)", got, err)
+		}
+		if _, err := NewTyped[string](db, JSONCodec[string]{}).Get("order"); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("Expected ErrTypeMismatch, got %v", err)
+		}
+	}
+
+	orders.Put("order", testOrder{Status: "new"})
+	if err := orders.Put("order", order); err != nil {
+		t.Fatal(err)
+	}
+	checkDisk(t)
+	check(t)
+
+	t.Run("merge", func(t *testing.T) {
+		for i := 0; i < 200 && recordsOnDisk(t, fs, "order") > 1; i++ {
+			db.Put("filler"+strconv.Itoa(i%10), "value")
+			time.Sleep(time.Millisecond)
+		}
+		if n := recordsOnDisk(t, fs, "order"); n != 1 {
+			t.Fatalf("Expected a merge to keep one record, found %d", n)
+		}
+		checkDisk(t)
+		check(t)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db.Close()
+		if db, err = NewDbWithOptions("/db", 250, opts); err != nil {
+			t.Fatal(err)
+		}
+		orders = NewTyped[testOrder](db, codec)
+		check(t)
+	})
+}
@@ -0,0 +1,506 @@
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	vlogFileName        = "value-log"
+	pointerTag          = "p"
+	pointerSize         = 4 + 8 + 8
+	defaultVlogFileSize = 64 << 20
+	// The top bits of the length mark pointers to sealed and to compressed
+	// values.
+	pointerSealed     = 1 << 63
+	pointerCompressed = 1 << 62
+)
+
+var errVlogGone = errors.New("value log file was collected")
+
+// valuePointer locates a (type tagged) value in the value log. Sealed and
+// compressed values have to be unpacked, see packer. Sealed values are
+// opened with the extension of their record, so their pointers locate the
+// whole record.
+type valuePointer struct {
+	file       int
+	offset     int64
+	length     int64
+	sealed     bool
+	compressed bool
+}
+
+func (p valuePointer) encode() string {
+	var buf [pointerSize]byte
+	length := uint64(p.length)
+	if p.sealed {
+		length |= pointerSealed
+	}
+	if p.compressed {
+		length |= pointerCompressed
+	}
+	binary.LittleEndian.PutUint32(buf[:], uint32(p.file))
+	binary.LittleEndian.PutUint64(buf[4:], uint64(p.offset))
+	binary.LittleEndian.PutUint64(buf[12:], length)
+	return string(buf[:]) + pointerTag
+}
+
+func isPointer(value string) bool {
+	return len(value) == pointerSize+1 && value[pointerSize:] == pointerTag
+}
+
+func decodePointer(value string) valuePointer {
+	length := binary.LittleEndian.Uint64([]byte(value[12:20]))
+	return valuePointer{
+		file:       int(binary.LittleEndian.Uint32([]byte(value[:4]))),
+		offset:     int64(binary.LittleEndian.Uint64([]byte(value[4:12]))),
+		length:     int64(length &^ (pointerSealed | pointerCompressed)),
+		sealed:     length&pointerSealed != 0,
+		compressed: length&pointerCompressed != 0,
+	}
+}
+
+type vlogFile struct {
+	id   int
+	file File
+	path string
+	size int64
+	refs sync.WaitGroup
+	// info describes the records of the file, it is nil until the file is
+	// scanned.
+	info *fileInfo
+}
+
+// fileInfo tells the keys sealing the records of a file, 0 for plaintext
+// records, and how their values are compressed.
+type fileInfo struct {
+	sealedWith  map[uint32]bool
+	compression CompressionStats
+}
+
+func newFileInfo() *fileInfo {
+	return &fileInfo{sealedWith: make(map[uint32]bool)}
+}
+
+// scanFileInfo unpacks all the records of f.
+func scanFileInfo(f io.ReaderAt, p packer) (*fileInfo, int64, error) {
+	info := newFileInfo()
+	size, err := scanRecords(f, func(_ int64, e entry) error {
+		keyID := e.keyID()
+		e, stored, err := p.unpack(e)
+		if err != nil {
+			return err
+		}
+		info.sealedWith[keyID] = true
+		info.compression.add(int64(len(e.value)), stored)
+		return nil
+	})
+	return info, size, err
+}
+
+// valueLog keeps values too big for the segments, WiscKey style. Records have
+// the segment format, so the key of every value is known when collecting a
+// file. Only the writer goroutine appends.
+type valueLog struct {
+	fs          FS
+	dir         string
+	maxFileSize int64
+	noSync      bool
+	packer      packer
+
+	mu     sync.Mutex
+	files  map[int]*vlogFile
+	head   *vlogFile
+	nextID int
+}
+
+func openValueLog(fs FS, dir string, maxFileSize int64, noSync, readOnly bool, p packer) (*valueLog, error) {
+	if maxFileSize <= 0 {
+		maxFileSize = defaultVlogFileSize
+	}
+	l := &valueLog{
+		fs:          fs,
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		noSync:      noSync,
+		packer:      p,
+		files:       make(map[int]*vlogFile),
+	}
+
+	names, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, name := range names {
+		rest, ok := strings.CutPrefix(name, vlogFileName)
+		if !ok {
+			continue
+		}
+		if id, err := strconv.Atoi(rest); err == nil && id >= 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for i, id := range ids {
+		flag := os.O_RDONLY
+		isHead := i == len(ids)-1 && !readOnly
+		if isHead {
+			flag = os.O_RDWR | os.O_APPEND
+		}
+		path := l.path(id)
+		f, err := fs.OpenFile(path, flag, 0o600)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		vf := &vlogFile{id: id, file: f, path: path}
+		l.files[id] = vf
+		l.nextID = id + 1
+		if isHead {
+			// Values whose pointer never made it to a segment are garbage
+			// anyway, only a torn tail has to go.
+			info, size, err := scanFileInfo(f, p)
+			if errors.Is(err, errTornRecord) {
+				err = f.Truncate(size)
+			}
+			if err != nil {
+				l.close()
+				return nil, fmt.Errorf("recover %s: %w", path, err)
+			}
+			vf.size = size
+			vf.info = info
+			l.head = vf
+			// Only sealed files are collected, so records of another key
+			// must not stay at the head.
+			for id := range info.sealedWith {
+				if id != p.keyring.activeID() {
+					l.head = nil
+				}
+			}
+		}
+	}
+	return l, nil
+}
+
+func (l *valueLog) path(id int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%d", vlogFileName, id))
+}
+
+// append stores e and returns the pointer to its value. It reports whether a
+// new head file was started.
+func (l *valueLog) append(e entry) (valuePointer, bool, error) {
+	raw := int64(len(e.value))
+	e, stored := l.packer.pack(e)
+	data := e.Encode()
+	rotated := false
+	if l.head == nil || (l.head.size > 0 && l.head.size+int64(len(data)) > l.maxFileSize) {
+		if err := l.rotate(); err != nil {
+			return valuePointer{}, false, err
+		}
+		rotated = true
+	}
+
+	head := l.head
+	_, err := head.file.Write(data)
+	if err == nil && !l.noSync {
+		err = head.file.Sync()
+	}
+	if err != nil {
+		if terr := head.file.Truncate(head.size); terr != nil {
+			return valuePointer{}, rotated, fmt.Errorf("%w (truncate: %s)", err, terr)
+		}
+		return valuePointer{}, rotated, err
+	}
+	p := pointerTo(head.id, head.size, e)
+	head.size += int64(len(data))
+	l.mu.Lock()
+	head.info.sealedWith[e.keyID()] = true
+	head.info.compression.add(raw, stored)
+	l.mu.Unlock()
+	return p, rotated, nil
+}
+
+func (l *valueLog) rotate() error {
+	id := l.nextID
+	path := l.path(id)
+	f, err := l.fs.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	l.head = &vlogFile{id: id, file: f, path: path, info: newFileInfo()}
+	l.files[id] = l.head
+	return nil
+}
+
+// acquire pins the file so that it is not closed until release.
+func (l *valueLog) acquire(id int) (*vlogFile, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	vf, ok := l.files[id]
+	if !ok {
+		return nil, errVlogGone
+	}
+	vf.refs.Add(1)
+	return vf, nil
+}
+
+// pointerTo returns the pointer to the value of rec, the record written at
+// offset of the file.
+func pointerTo(file int, offset int64, rec entry) valuePointer {
+	p := valuePointer{
+		file:       file,
+		offset:     offset + rec.GetLength() - int64(len(rec.value)),
+		length:     int64(len(rec.value)),
+		sealed:     rec.sealed,
+		compressed: rec.compressed,
+	}
+	if rec.sealed {
+		p.offset, p.length = offset, rec.GetLength()
+	}
+	return p
+}
+
+func (l *valueLog) read(p valuePointer) (string, error) {
+	vf, err := l.acquire(p.file)
+	if err != nil {
+		return "", err
+	}
+	defer vf.refs.Done()
+	buf := make([]byte, p.length)
+	if _, err := vf.file.ReadAt(buf, p.offset); err != nil {
+		return "", err
+	}
+	if p.sealed {
+		var rec entry
+		if err := rec.decode(buf); err != nil {
+			return "", err
+		}
+		rec, _, err := l.packer.unpack(rec)
+		return rec.value, err
+	}
+	if p.compressed {
+		return inflate(string(buf))
+	}
+	return string(buf), nil
+}
+
+// info sums up the fileInfo of all the files. Sealed files do not change,
+// they are only scanned once.
+func (l *valueLog) info() (map[uint32]bool, CompressionStats, error) {
+	l.mu.Lock()
+	files := make([]*vlogFile, 0, len(l.files))
+	for _, vf := range l.files {
+		files = append(files, vf)
+	}
+	l.mu.Unlock()
+	sealedWith := make(map[uint32]bool)
+	var stats CompressionStats
+	for _, vf := range files {
+		l.mu.Lock()
+		info := vf.info
+		l.mu.Unlock()
+		if info == nil {
+			if _, err := l.acquire(vf.id); err != nil {
+				continue
+			}
+			var err error
+			info, _, err = scanFileInfo(vf.file, l.packer)
+			vf.refs.Done()
+			if err != nil {
+				return nil, CompressionStats{}, err
+			}
+			l.mu.Lock()
+			vf.info = info
+			l.mu.Unlock()
+		}
+		l.mu.Lock()
+		for id := range info.sealedWith {
+			sealedWith[id] = true
+		}
+		stats.merge(info.compression)
+		l.mu.Unlock()
+	}
+	return sealedWith, stats, nil
+}
+
+type vlogReader struct {
+	*io.SectionReader
+	vf   *vlogFile
+	once sync.Once
+}
+
+func (r *vlogReader) Close() error {
+	r.once.Do(r.vf.refs.Done)
+	return nil
+}
+
+// reader streams the first n bytes of the value p points at.
+func (l *valueLog) reader(p valuePointer, n int64) (io.ReadCloser, error) {
+	vf, err := l.acquire(p.file)
+	if err != nil {
+		return nil, err
+	}
+	return &vlogReader{SectionReader: io.NewSectionReader(vf.file, p.offset, n), vf: vf}, nil
+}
+
+// sealed lists the files that are no longer appended to, oldest first.
+func (l *valueLog) sealed() []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ids []int
+	for id := range l.files {
+		if l.head == nil || id != l.head.id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// remove drops a collected file once nobody reads from it anymore.
+func (l *valueLog) remove(id int) error {
+	l.mu.Lock()
+	vf, ok := l.files[id]
+	delete(l.files, id)
+	l.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	vf.refs.Wait()
+	vf.file.Close()
+	return l.fs.Remove(vf.path)
+}
+
+func (l *valueLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for _, vf := range l.files {
+		vf.refs.Wait()
+		if cerr := vf.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// CollectValueLog moves the values still in use from the oldest sealed
+// value-log file to the head of the log and deletes the file. It does nothing
+// when there is no sealed file.
+func (db *Db) CollectValueLog() error {
+	if db.vlog == nil {
+		return nil
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	sealed := db.vlog.sealed()
+	if len(sealed) == 0 {
+		return nil
+	}
+	id := sealed[0]
+	vf, err := db.vlog.acquire(id)
+	if err != nil {
+		return nil
+	}
+	_, err = scanRecords(vf.file, func(offset int64, e entry) error {
+		p := pointerTo(id, offset, e)
+		// Relocating packs the value anew, sealed with the active key.
+		e, _, err := db.vlog.packer.unpack(e)
+		if err != nil {
+			return err
+		}
+		// The writer checks that the key still refers to this copy, so
+		// newer values are never overwritten.
+		return db.submit(context.Background(), putOp{entry: e, relocate: &p})
+	})
+	vf.refs.Done()
+	if err != nil {
+		return err
+	}
+	return db.vlog.remove(id)
+}
+
+// maybeCollectValueLog starts a background collection once a couple of
+// sealed files piled up. Called by the writer goroutine.
+func (db *Db) maybeCollectValueLog() {
+	if len(db.vlog.sealed()) < 2 || !db.collecting.CompareAndSwap(false, true) {
+		return
+	}
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		defer db.collecting.Store(false)
+		if err := db.CollectValueLog(); err != nil && err != ErrClosed {
+			log.Printf("value log collection failed: %s", err)
+		}
+	}()
+}
+
+// GetReader streams the string value of key. Values kept in the value log are
+// read from the file as the reader is consumed instead of being loaded into
+// memory, unless they are compressed or encrypted. The reader must be closed.
+func (db *Db) GetReader(key string) (io.ReadCloser, error) {
+	for attempt := 0; ; attempt++ {
+		value, operands, err := db.getRaw(context.Background(), recordKey{key: key}, (*Segment).getFromSegment)
+		if err != nil {
+			return nil, err
+		}
+		if len(operands) > 0 {
+			value, err := db.Get(key)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(strings.NewReader(value)), nil
+		}
+		if !isPointer(value) {
+			if value[len(value)-1:] != "s" {
+				return nil, fmt.Errorf("invalid data type")
+			}
+			return io.NopCloser(strings.NewReader(value[:len(value)-1])), nil
+		}
+
+		p := decodePointer(value)
+		if p.sealed || p.compressed {
+			// Packed values are only readable as a whole.
+			value, err := db.vlog.read(p)
+			if err == errVlogGone && attempt < 3 {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if value[len(value)-1:] != "s" {
+				return nil, fmt.Errorf("invalid data type")
+			}
+			return io.NopCloser(strings.NewReader(value[:len(value)-1])), nil
+		}
+		tag, err := db.vlog.read(valuePointer{file: p.file, offset: p.offset + p.length - 1, length: 1})
+		if err == nil && tag != "s" {
+			return nil, fmt.Errorf("invalid data type")
+		}
+		var r io.ReadCloser
+		if err == nil {
+			r, err = db.vlog.reader(p, p.length-1)
+		}
+		// The value was moved by a collection in the meantime.
+		if err == errVlogGone && attempt < 3 {
+			continue
+		}
+		return r, err
+	}
+}
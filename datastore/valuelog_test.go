@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDb_ValueLog(t *testing.T) {
+	fs := NewFaultFS(1)
+	opts := Options{FS: fs, ValueLogThreshold: 16, ValueLogFileSize: 300}
+	db, err := NewDbWithOptions("/db", 100, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	big := strings.Repeat("large value ", 20)
+
+	t.Run("put/get", func(t *testing.T) {
+		if err := db.Put("small", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("big", big); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]string{"small": "v", "big": big} {
+			value, err := db.Get(key)
+			if err != nil {
+				t.Fatalf("Cannot get %s: %s", key, err)
+			}
+			if value != want {
+				t.Errorf("Bad value returned for %s: %q", key, value)
+			}
+		}
+		raw, _, err := db.getRaw(context.Background(), recordKey{key: "big"}, (*Segment).getFromSegment)
+		if err != nil || !isPointer(raw) {
+			t.Errorf("Expected a value-log pointer in the segment, got %q (%v)", raw, err)
+		}
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		for key, want := range map[string]string{"small": "v", "big": big} {
+			r, err := db.GetReader(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != want {
+				t.Errorf("Bad value streamed for %s: %q", key, data)
+			}
+		}
+	})
+
+	t.Run("collect", func(t *testing.T) {
+		// Every put of a big value fills a value-log file, so most files only
+		// hold overwritten values.
+		for i := 0; i < 5; i++ {
+			if err := db.Put("big", big+strings.Repeat("!", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for len(db.vlog.sealed()) > 0 {
+			if err := db.CollectValueLog(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		names, _ := fs.ReadDir("/db")
+		files := 0
+		for _, name := range names {
+			if strings.HasPrefix(name, vlogFileName) {
+				files++
+			}
+		}
+		if files != 1 {
+			t.Errorf("Expected only the head value-log file to remain, got %v", names)
+		}
+		value, err := db.Get("big")
+		if err != nil || value != big+"!!!!" {
+			t.Errorf("Bad value after collection: %q (%v)", value, err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbWithOptions("/db", 100, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get("big")
+		if err != nil || value != big+"!!!!" {
+			t.Errorf("Bad value after reopen: %q (%v)", value, err)
+		}
+	})
+}
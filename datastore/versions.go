@@ -0,0 +1,332 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var ErrNotVersioned = fmt.Errorf("versions are not retained")
+
+// versionIndex lists every record of a key in a segment, oldest first. It is
+// only kept when versions are retained.
+type versionIndex map[recordKey][]versionPos
+
+type versionPos struct {
+	recordPos
+	version uint64
+	time    int64
+}
+
+type versionRef struct {
+	segment *Segment
+	versionPos
+}
+
+// Version is a value a key had at some point. Versions are numbered by a
+// counter shared by all keys, so the versions of different keys can be
+// ordered too.
+type Version struct {
+	Version uint64
+	Time    time.Time
+	Value   string
+	Deleted bool
+}
+
+func (db *Db) newVersionIndex() versionIndex {
+	if !db.versioned {
+		return nil
+	}
+	return make(versionIndex)
+}
+
+// appendVersion adds v to refs. A value relocated by a value-log collection
+// appears twice with the same version, only the newer copy is kept.
+func appendVersion(refs []versionRef, v versionRef) []versionRef {
+	if n := len(refs); n > 0 && v.version != 0 && refs[n-1].version == v.version {
+		refs[n-1] = v
+		return refs
+	}
+	return append(refs, v)
+}
+
+// versionRefs is run by the index goroutine. The segments of the returned
+// versions are pinned until released.
+func (db *Db) versionRefs(key recordKey) []versionRef {
+	var refs []versionRef
+	for _, s := range db.segments {
+		refs = appendRangeVersions(refs, s, key, false)
+	}
+	for _, v := range refs {
+		v.segment.readers.Add(1)
+	}
+	return refs
+}
+
+func (db *Db) history(ctx context.Context, key recordKey) ([]versionRef, error) {
+	if !db.versioned {
+		return nil, ErrNotVersioned
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	op := indexOp{
+		kind:    opHistory,
+		key:     key,
+		history: make(chan []versionRef, 1),
+	}
+	select {
+	case db.indexOps <- op:
+	case <-db.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return <-op.history, nil
+}
+
+// readVersion returns the value of v without its type tag. It fails with
+// errVlogGone when the value was kept in a value-log file that has been
+// collected since, collections only move current values. The type tagged
+// value of the previous version is kept in current to fold merge operands
+// into.
+func (db *Db) readVersion(key string, v versionRef, current *string) (Version, error) {
+	version := Version{
+		Version: v.version,
+		Time:    time.Unix(0, v.time),
+		Deleted: v.deleted,
+	}
+	if v.deleted {
+		*current = ""
+		return version, nil
+	}
+	value, err := db.readSegment(v.segment, v.offset)
+	if err == nil && v.operand {
+		value, err = db.fold(key, *current, []string{value})
+	}
+	if err != nil {
+		return version, err
+	}
+	*current = value
+	version.Value = value[:len(value)-1]
+	return version, nil
+}
+
+func (db *Db) versions(ctx context.Context, key recordKey) ([]Version, error) {
+	refs, err := db.history(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		res     []Version
+		current string
+	)
+	for _, v := range refs {
+		if err == nil {
+			var version Version
+			version, err = db.readVersion(key.key, v, &current)
+			if err == nil {
+				res = append(res, version)
+			} else if err == errVlogGone {
+				err = nil
+			}
+		}
+		v.segment.readers.Done()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+// latestVersion returns the version of the newest record of key, a deletion
+// included, 0 when it has none.
+func (db *Db) latestVersion(ctx context.Context, key recordKey) (uint64, error) {
+	refs, err := db.history(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	var version uint64
+	for _, v := range refs {
+		version = v.version
+		v.segment.readers.Done()
+	}
+	return version, nil
+}
+
+// versionAt returns the newest version of key for which newer returns false.
+func (db *Db) versionAt(ctx context.Context, key recordKey, newer func(versionPos) bool) (string, error) {
+	refs, err := db.history(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	found := -1
+	for i := range refs {
+		if !newer(refs[i].versionPos) {
+			found = i
+		}
+	}
+	var version Version
+	if found >= 0 {
+		// Merge operands are folded into the value before them.
+		start := found
+		for start > 0 && refs[start].operand {
+			start--
+		}
+		var current string
+		for _, v := range refs[start : found+1] {
+			if version, err = db.readVersion(key.key, v, &current); err != nil {
+				break
+			}
+		}
+	}
+	for _, v := range refs {
+		v.segment.readers.Done()
+	}
+	switch {
+	case err == errVlogGone || found < 0 || (err == nil && version.Deleted):
+		return "", ErrNotFound
+	case err != nil:
+		return "", err
+	}
+	return version.Value, nil
+}
+
+// History returns the retained versions of key, oldest first. Deletions are
+// included as versions with Deleted set.
+func (db *Db) History(key string) ([]Version, error) {
+	return db.versions(context.Background(), recordKey{key: key})
+}
+
+// LatestVersion returns the version of the last change of key, 0 when it was
+// never written.
+func (db *Db) LatestVersion(key string) (uint64, error) {
+	return db.latestVersion(context.Background(), recordKey{key: key})
+}
+
+// GetAt returns the value key had at the given version, that is the value of
+// its newest version not newer than it.
+func (db *Db) GetAt(key string, version uint64) (string, error) {
+	return db.versionAt(context.Background(), recordKey{key: key}, func(v versionPos) bool {
+		return v.version > version
+	})
+}
+
+// GetAtTime returns the value key had at time t.
+func (db *Db) GetAtTime(key string, t time.Time) (string, error) {
+	return db.versionAt(context.Background(), recordKey{key: key}, func(v versionPos) bool {
+		return v.time > t.UnixNano()
+	})
+}
+
+func (b *Bucket) History(key string) ([]Version, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	return b.db.versions(context.Background(), recordKey{bucket: b.id, key: key})
+}
+
+func (b *Bucket) LatestVersion(key string) (uint64, error) {
+	if err := b.check(); err != nil {
+		return 0, err
+	}
+	return b.db.latestVersion(context.Background(), recordKey{bucket: b.id, key: key})
+}
+
+func (b *Bucket) GetAt(key string, version uint64) (string, error) {
+	if err := b.check(); err != nil {
+		return "", err
+	}
+	return b.db.versionAt(context.Background(), recordKey{bucket: b.id, key: key}, func(v versionPos) bool {
+		return v.version > version
+	})
+}
+
+// retained drops the versions of refs that the retention policy lets go.
+// The policies keep the newest versions, so what is left is a suffix that
+// always includes the newest version.
+func (db *Db) retained(refs []versionRef, now int64) []versionRef {
+	cut := len(refs) - 1
+	if db.keepVersions > 1 && len(refs)-db.keepVersions < cut {
+		cut = len(refs) - db.keepVersions
+		if cut < 0 {
+			cut = 0
+		}
+	}
+	if db.keepFor > 0 {
+		oldest := now - int64(db.keepFor)
+		for cut > 0 && refs[cut-1].time >= oldest {
+			cut--
+		}
+	}
+	return refs[cut:]
+}
+
+// mergeVersions passes the retained versions of every live key of sealed to
+// add. Versions in newer segments are not counted, so a merge may keep a few
+// more versions than asked for. The range tombstones become deletions of the
+// keys they cover.
+func (db *Db) mergeVersions(sealed []*Segment, add func(entry) error) error {
+	history := make(map[recordKey][]versionRef)
+	for _, s := range sealed {
+		for key := range s.versions {
+			history[key] = nil
+		}
+	}
+	for key := range history {
+		for _, s := range sealed {
+			history[key] = appendRangeVersions(history[key], s, key, true)
+		}
+	}
+	now := time.Now().UnixNano()
+	heads := make(map[recordKey]string)
+	for key, refs := range history {
+		if !db.bucketLive(key.bucket) || !db.blobLive(key) {
+			continue
+		}
+		if live, err := db.elementLive(sealed, key, heads); err != nil {
+			return err
+		} else if !live {
+			continue
+		}
+		kept := db.retained(refs, now)
+		// Merge operands need the value they apply to.
+		cut := len(refs) - len(kept)
+		for cut > 0 && refs[cut].operand {
+			cut--
+		}
+		written := false
+		for _, v := range refs[cut:] {
+			if db.isClosed() {
+				return ErrClosed
+			}
+			// Nothing older is left for a deletion to hide.
+			if v.deleted && !written {
+				continue
+			}
+			e := entry{
+				key:     key.key,
+				sub:     key.sub,
+				value:   deleteMarker,
+				bucket:  key.bucket,
+				version: v.version,
+				time:    v.time,
+			}
+			if !v.deleted {
+				stored, err := v.segment.readRecord(v.offset)
+				if err != nil {
+					return err
+				}
+				e.value, e.typ = stored.value, stored.typ
+			}
+			if err := add(e); err != nil {
+				return err
+			}
+			written = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDb_Versions(t *testing.T) {
+	fs := NewFaultFS(1)
+	opts := Options{FS: fs, KeepVersions: 3}
+	db, err := NewDbWithOptions("/db", 120, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	var history []Version
+	t.Run("history", func(t *testing.T) {
+		for i := 1; i <= 3; i++ {
+			if err := db.Put("key", "v"+strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+		history, err = db.History("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 4 {
+			t.Fatalf("Expected 4 versions, got %+v", history)
+		}
+		for i, v := range history[:3] {
+			if v.Value != "v"+strconv.Itoa(i+1) || v.Deleted {
+				t.Errorf("Bad version %d: %+v", i, v)
+			}
+		}
+		if !history[3].Deleted {
+			t.Errorf("Expected the deletion as the last version: %+v", history[3])
+		}
+	})
+
+	t.Run("get at", func(t *testing.T) {
+		if value, err := db.GetAt("key", history[1].Version); err != nil || value != "v2" {
+			t.Errorf("Bad value at version %d: %q (%v)", history[1].Version, value, err)
+		}
+		if value, err := db.GetAt("key", history[2].Version); err != nil || value != "v3" {
+			t.Errorf("Bad value at version %d: %q (%v)", history[2].Version, value, err)
+		}
+		if _, err := db.GetAt("key", history[3].Version); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound after the deletion, got %v", err)
+		}
+		if _, err := db.GetAt("key", history[0].Version-1); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound before the first version, got %v", err)
+		}
+		if value, err := db.GetAtTime("key", history[0].Time); err != nil || value != "v1" {
+			t.Errorf("Bad value at %s: %q (%v)", history[0].Time, value, err)
+		}
+		if v, err := db.LatestVersion("key"); err != nil || v != history[3].Version {
+			t.Errorf("Expected the deletion as the latest version, got %d (%v)", v, err)
+		}
+		if v, err := db.LatestVersion("missing"); err != nil || v != 0 {
+			t.Errorf("Expected no version of a missing key, got %d (%v)", v, err)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		db.Put("key", "v4")
+		for i := 0; i < 100; i++ {
+			db.Put("filler"+strconv.Itoa(i%5), "value")
+			time.Sleep(time.Millisecond)
+		}
+		versions, err := db.History("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) < 3 || len(versions) > 4 {
+			t.Errorf("Expected the last 3 versions to be retained, got %+v", versions)
+		}
+		last := versions[len(versions)-1]
+		if last.Value != "v4" {
+			t.Errorf("Bad current version: %+v", last)
+		}
+		if value, err := db.Get("key"); err != nil || value != "v4" {
+			t.Errorf("Bad value: %q (%v)", value, err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		before, _ := db.History("key")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbWithOptions("/db", 120, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := db.History("key")
+		if err != nil || len(after) != len(before) {
+			t.Fatalf("History changed on reopen: %+v, was %+v (%v)", after, before, err)
+		}
+		db.Put("key", "v5")
+		after, _ = db.History("key")
+		if v := after[len(after)-1]; v.Value != "v5" || v.Version <= before[len(before)-1].Version {
+			t.Errorf("Bad version after reopen: %+v", v)
+		}
+	})
+
+	t.Run("not versioned", func(t *testing.T) {
+		plain, err := NewDbWithOptions("/plain", 120, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer plain.Close()
+		if _, err := plain.History("key"); err != ErrNotVersioned {
+			t.Errorf("Expected ErrNotVersioned, got %v", err)
+		}
+	})
+}